@@ -3,6 +3,7 @@ let
   paths = {
     dockerImagesFolder = /var/lib/docteurqui/docker-images;
     secretKeyFile = /var/lib/docteurqui/censor.secret;
+    adminTokenFile = /var/lib/docteurqui/admin-token.secret;
     chromeSeccomp = /var/lib/docteurqui/chrome_seccomp.json;
   };
   dockerNetworks = {
@@ -17,6 +18,7 @@ let
     bindMounts = {
       mailingList = /var/lib/docteurqui/autocontract/mailinglist;
       autocontractSecrets = /var/lib/docteurqui/autocontract/secrets;
+      stats = /var/lib/docteurqui/autocontract/stats;
     };
   };
   mkImageFile = { path }: builtins.path rec {
@@ -125,15 +127,16 @@ in
     };
     environment = {
       "PDF_GEN_URL" = "http://autocontract-pdf-gen:9222";
-      "PDF_INTERNAL_WEB_HOSTNAME" = "autocontract-app";
       "SECRET_CENSOR_KEY" = (builtins.readFile paths.secretKeyFile);
+      "SECRET_ADMIN_TOKEN" = (builtins.readFile paths.adminTokenFile);
     };
     extraDockerOptions = [
       "--init"
       "--network=${dockerNetworks.principal}"
-      "--mount=source=${dockerVolumes.doctorData},target=/docker-vols/doctor-data,readonly"
+      "--mount=source=${dockerVolumes.doctorData},target=/docker-vols/doctor-data"
       "--mount=type=bind,source=${builtins.toString dockerVolumes.bindMounts.autocontractSecrets},target=/docker-vols/secrets,readonly"
       "--mount=type=bind,source=${builtins.toString dockerVolumes.bindMounts.mailingList},target=/docker-vols/mailinglist"
+      "--mount=type=bind,source=${builtins.toString dockerVolumes.bindMounts.stats},target=/docker-vols/stats"
     ];
   };
 
@@ -3,20 +3,27 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	"autocontract/pkg/censor"
 	"autocontract/pkg/csp"
@@ -26,6 +33,7 @@ import (
 	"autocontract/pkg/httperror"
 	"autocontract/pkg/mailinglist"
 	"autocontract/pkg/pdfgen"
+	"autocontract/pkg/stats"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -33,49 +41,63 @@ import (
 
 const (
 	PublicFacingWebsitePort = "18080"
+	AdminMinTokenLength     = 32
 
 	TimeLayout              = "2006-01-02"
 	ParseFormMaxMemoryBytes = 500 * 1024
+	// Leave room for two signatures in a contract request.
+	ContractFormMaxBodyBytes = 1 << 20 // 1 MiB
+	ContractsAPIMaxBodyBytes = 1 << 20 // 1 MiB
+	// ContractWarningsHeader holds the warnings about a generated contract, as a JSON object.
+	ContractWarningsHeader = "X-Contract-Warnings"
+	// ServerShutdownTimeout is how long requests in progress are given to finish when stopping.
+	ServerShutdownTimeout = 20 * time.Second
 )
 
 const (
 	PDFGeneratorInitializationTimeout = 3 * time.Second
 	PDFGeneratorBrowserDevToolsURL    = "http://localhost:9222"
 	PdfGenerationTimeout              = 10 * time.Second
+	PDFGeneratorPoolSize              = 2
+	PDFGeneratorMaxRendersPerTarget   = 50
+	PDFRendererCDP                    = "cdp"
+	PDFRendererFake                   = "fake"
 	TimeoutAddEmailToMailingList      = 6 * time.Second
+	StatsPersistPeriod                = 1 * time.Minute
 
 	DoctorSearchNGramSize            = 3
 	MaxDoctorSearchQueryDuration     = 5 * time.Second
 	DoctorSearchMaxNumberResults     = 5
 	MaxDoctorSearchQueryLength       = 40
 	MaxDoctorSearchConcurrentQueries = 100
+	DoctorSearchMinSimilarity        = 0.3
+	DoctorSearchProfessions          = "10:SM26,SM53,SM54"
+	DoctorSearchPhoneticMatching     = true
+	DoctorSearchCacheRecords         = false
 	DoctorDataUpdatePeriod           = 3 * 24 * time.Hour
 	DoctorDataUpdateMinPeriod        = 2 * time.Hour
 	DoctorDataUpdatePeriodJitter     = 0.03
+	DoctorDataDirectoryPollPeriod    = 1 * time.Minute
+	DoctorDataUpdateMinRecordsRatio  = 0.95
 
-	InternalHTTPServerPDFTemplatePath                = "/pdf"
-	InternalHTTPServerPDFTemplatePort                = "18081"
-	InternalHTTPServerPDFTemplateRequestUserQueryKey = "userDataId"
-
-	ContextUserDataMapKey = iota
-	ContextDoctorSearchKey
+	ContextDoctorSearchKey = iota
 	ContextPdfGenControlKey
 	ContextTimeZoneLocationKey
-	ContextInternalTemplateWebHostKey
 	ContextKeyMailingLister
+	ContextKeyStatsRecorder
 )
 
 var (
-	SharedUserData       = datamap.NewDataMap()
 	SharedDoctorSearcher doctorsearch.DoctorSearcher
 	SharedPdfGenControl  = &pdfgen.Control{}
 	SharedMailingLister  mailinglist.MailingLister
+	SharedStatsRecorder  stats.Recorder
+	// VerifyContractDoctors enables checking the doctors of contracts against the doctor index.
+	VerifyContractDoctors bool
+	// ContractClock gives the time contracts are established at.
+	ContractClock = time.Now
 )
 
-func sharedUserDataFromContext(ctx context.Context) datamap.DataMap {
-	return ctx.Value(ContextUserDataMapKey).(datamap.DataMap)
-}
-
 func sharedDoctorSearcherFromContext(ctx context.Context) doctorsearch.DoctorSearcher {
 	return ctx.Value(ContextDoctorSearchKey).(doctorsearch.DoctorSearcher)
 }
@@ -84,29 +106,25 @@ func pdfGenControlFromContext(ctx context.Context) *pdfgen.Control {
 	return ctx.Value(ContextPdfGenControlKey).(*pdfgen.Control)
 }
 
-func doctorQueryIndexFromContext(ctx context.Context) *pdfgen.Control {
-	return ctx.Value(ContextPdfGenControlKey).(*pdfgen.Control)
-}
-
 func timeZoneLocationFromContext(ctx context.Context) *time.Location {
 	return ctx.Value(ContextTimeZoneLocationKey).(*time.Location)
 }
 
-func internalTemplateWebHostnameFromContext(ctx context.Context) string {
-	return ctx.Value(ContextInternalTemplateWebHostKey).(string)
-}
-
 func fromContextMailingLister(ctx context.Context) mailinglist.MailingLister {
 	return ctx.Value(ContextKeyMailingLister).(mailinglist.MailingLister)
 }
 
+func fromContextStatsRecorder(ctx context.Context) stats.Recorder {
+	return ctx.Value(ContextKeyStatsRecorder).(stats.Recorder)
+}
+
 func withContext(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		var ctx context.Context
-		ctx = context.WithValue(req.Context(), ContextUserDataMapKey, SharedUserData)
-		ctx = context.WithValue(ctx, ContextDoctorSearchKey, SharedDoctorSearcher)
+		ctx = context.WithValue(req.Context(), ContextDoctorSearchKey, SharedDoctorSearcher)
 		ctx = context.WithValue(ctx, ContextPdfGenControlKey, SharedPdfGenControl)
 		ctx = context.WithValue(ctx, ContextKeyMailingLister, SharedMailingLister)
+		ctx = context.WithValue(ctx, ContextKeyStatsRecorder, SharedStatsRecorder)
 		h(w, req.WithContext(ctx))
 	}
 }
@@ -119,14 +137,6 @@ func withTimeZoneLocation(location *time.Location, h http.HandlerFunc) http.Hand
 	}
 }
 
-func withInternalTemplateWebHostname(host string, h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, req *http.Request) {
-		var ctx context.Context
-		ctx = context.WithValue(req.Context(), ContextInternalTemplateWebHostKey, host)
-		h(w, req.WithContext(ctx))
-	}
-}
-
 func forMethod(method string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != method {
@@ -139,59 +149,101 @@ func forMethod(method string, h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// contractProcessingManner is how contracts are processed, for requests with the given context.
+func contractProcessingManner(ctx context.Context) form.FormProcessingManner {
+	manner := form.FormProcessingManner{
+		TimeLocation: timeZoneLocationFromContext(ctx),
+		TimeLayout:   TimeLayout,
+		Now:          ContractClock,
+	}
+	if VerifyContractDoctors {
+		sharedDoctorSearcher := sharedDoctorSearcherFromContext(ctx)
+		manner.LookupDoctor = func(rpps string) (*doctorsearch.DoctorRecord, error) {
+			return doctorsearch.LookupRPPS(ctx, sharedDoctorSearcher, rpps)
+		}
+	}
+	return manner
+}
+
 func genContractHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
 	ctx, cancel := context.WithTimeout(r.Context(), PdfGenerationTimeout)
 	defer cancel()
 
-	timeLocation := timeZoneLocationFromContext(ctx)
+	r.Body = httperror.MaxBytesReader(w, r.Body, ContractFormMaxBodyBytes)
 	err := r.ParseMultipartForm(ParseFormMaxMemoryBytes)
-	if err != nil {
+	if errors.Is(err, httperror.ErrBodyTooLarge) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	safeUserData, err := form.Process(r, form.FormProcessingManner{
-		TimeLocation: timeLocation,
-		TimeLayout:   TimeLayout,
-	})
+	safeUserData, err := form.Process(r, contractProcessingManner(ctx))
 	if err != nil {
 		log.Debug().Msgf("form processing error %s", err)
 		httperror.RichError(w, r, err)
 		return
 	}
 
-	// stuff user data in shared map, addressed by uuid
-	sharedUserData := sharedUserDataFromContext(r.Context())
-	userDataKey, err := sharedUserData.Set(safeUserData)
-	if err != nil {
-		log.Warn().Msgf("issue storing user data for future internal use %s", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	writeContract(ctx, w, r, safeUserData, start)
+}
+
+// contractsAPIHandler generates a contract from a JSON form.ContractRequest, so that other
+// tools can generate contracts. Errors are always returned as JSON.
+func contractsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(r.Context(), PdfGenerationTimeout)
+	defer cancel()
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
 		return
 	}
-	defer sharedUserData.Clear(userDataKey)
 
-	q := url.Values{}
-	q.Set(InternalHTTPServerPDFTemplateRequestUserQueryKey, userDataKey)
-	internalTemplateWebHostname := internalTemplateWebHostnameFromContext(r.Context())
-	host := fmt.Sprintf("%s:%s", internalTemplateWebHostname, InternalHTTPServerPDFTemplatePort)
-	pdfUrl := &url.URL{
-		Scheme:   "http",
-		Host:     host,
-		Path:     InternalHTTPServerPDFTemplatePath,
-		RawQuery: q.Encode(),
+	body := httperror.MaxBytesReader(w, r.Body, ContractsAPIMaxBodyBytes)
+	safeUserData, err := form.ProcessJSON(body, contractProcessingManner(ctx))
+	if err != nil {
+		log.Debug().Msgf("JSON contract request error %s", err)
+		httperror.JSONError(w, err)
+		return
 	}
 
+	writeContract(ctx, w, r, safeUserData, start)
+}
+
+// writeContract generates the PDF of a contract and writes it to w.
+func writeContract(ctx context.Context, w http.ResponseWriter, r *http.Request, safeUserData datamap.SafeUserData, start time.Time) {
 	pdfGenerator := pdfGenControlFromContext(r.Context())
+	statsRecorder := fromContextStatsRecorder(r.Context())
 
-	pdfData, err := pdfGenerator.GeneratePdf(ctx, pdfUrl.String())
+	pdfData, err := pdfGenerator.GeneratePdf(ctx, safeUserData)
 	if err != nil {
 		log.Error().Msgf("error generating PDF: %s", err)
+		statsRecorder.ContractGenerationFailed()
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-
+	pdfGenDuration := time.Since(start)
+
+	contractIdentifier := safeUserData.Identifier()
+	censoredContractID := censor.Censor(contractIdentifier)
+	previousCensoredContractID, _ := censor.CensorPrevious(contractIdentifier)
+	statsRecorder.ContractGenerated(stats.ContractID{
+		Current:  censoredContractID,
+		Previous: previousCensoredContractID,
+	}, pdfGenDuration)
+
+	// Warnings about the data of the contract, e.g. an unknown RPPS number, are sent along the PDF.
+	warnings := safeUserData.GetUserData().Warnings
+	if len(warnings) > 0 {
+		if b, err := json.Marshal(warnings); err == nil {
+			w.Header().Set(ContractWarningsHeader, string(b))
+		}
+	}
 	w.Header().Set("Content-Type", "application/pdf")
 	w.Header().Set("Content-Length", strconv.Itoa(len(pdfData)))
 	_, err = w.Write(pdfData)
@@ -199,11 +251,12 @@ func genContractHandler(w http.ResponseWriter, r *http.Request) {
 		log.Warn().Msgf("writing PDF data failed: %s", err)
 	}
 
-	encodedCensoredContractID := base64.URLEncoding.EncodeToString(censor.Censor(safeUserData.Identifier()))
+	encodedCensoredContractID := base64.URLEncoding.EncodeToString(censoredContractID)
 	log.Info().
 		Str("request_origin", r.Header.Get("Origin")).
-		Dur("pdf_gen_duration", time.Since(start)).
+		Dur("pdf_gen_duration", pdfGenDuration).
 		Str("pseudo_anon_contract_id", encodedCensoredContractID).
+		Int("warnings", len(warnings)).
 		Msg("created a contract")
 }
 
@@ -213,16 +266,32 @@ func doctorSearchHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(ctx, sharedDoctorSearcher.QueryTimeout())
 	defer cancel()
 
-	userQuery := strings.TrimSpace(r.URL.Query().Get("query"))
-	potentialDoctorMatches, err := sharedDoctorSearcher.Query(ctx, userQuery, DoctorSearchMaxNumberResults)
+	statsRecorder := fromContextStatsRecorder(ctx)
+
+	queryOptions := doctorsearch.QueryOptions{
+		Profession: strings.TrimSpace(r.URL.Query().Get("profession")),
+		Specialty:  strings.TrimSpace(r.URL.Query().Get("specialty")),
+		Prefix:     r.URL.Query().Get("prefix") == "true",
+	}
+	userQuery := r.URL.Query().Get("query")
+	if queryOptions.Prefix {
+		// A trailing space tells that the last word is complete.
+		userQuery = strings.TrimLeftFunc(userQuery, unicode.IsSpace)
+	} else {
+		userQuery = strings.TrimSpace(userQuery)
+	}
+	potentialDoctorMatches, err := sharedDoctorSearcher.Query(ctx, userQuery, DoctorSearchMaxNumberResults, queryOptions)
 
 	if err != nil {
 		if errors.Is(err, doctorsearch.ErrTemporarilyUnavailable) {
+			statsRecorder.DoctorSearchQueried(stats.QueryUnavailable)
 			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		} else if errors.Is(err, doctorsearch.ErrInvalidUserQuery) {
+			statsRecorder.DoctorSearchQueried(stats.QueryInvalid)
 			log.Debug().Msgf("invalid doctor search query: %s", err)
 			http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
 		} else {
+			statsRecorder.DoctorSearchQueried(stats.QueryFailed)
 			if errors.Is(err, context.Canceled) == false {
 				log.Warn().Msgf("unexpected error with doctor search query: %s", err)
 			}
@@ -230,6 +299,7 @@ func doctorSearchHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	statsRecorder.DoctorSearchQueried(stats.QuerySucceeded)
 
 	w.Header().Set("Content-Type", "application/json")
 	b, err := json.Marshal(
@@ -246,6 +316,95 @@ func doctorSearchHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	statsRecorder := fromContextStatsRecorder(r.Context())
+
+	b, err := json.Marshal(statsRecorder.Snapshot())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// formSchemaHandler serves the schema of the contract form, so that browsers validate fields
+// like the server does.
+func formSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(struct {
+		Fields []form.Field `json:"fields"`
+	}{form.Schema})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// withAdminToken only lets through requests bearing the admin token.
+func withAdminToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	expectedDigest := sha256.Sum256([]byte("Bearer " + token))
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Compare digests so that the comparison does not depend on the length of the token.
+		digest := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+		if subtle.ConstantTimeCompare(digest[:], expectedDigest[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+func writeDoctorDataStatus(w http.ResponseWriter, status doctorsearch.Status) {
+	b, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func adminDoctorDataStatusHandler(w http.ResponseWriter, r *http.Request) {
+	sharedDoctorSearcher := sharedDoctorSearcherFromContext(r.Context())
+	writeDoctorDataStatus(w, sharedDoctorSearcher.Status())
+}
+
+func adminDoctorSearchStatsHandler(w http.ResponseWriter, r *http.Request) {
+	sharedDoctorSearcher := sharedDoctorSearcherFromContext(r.Context())
+	b, err := json.Marshal(sharedDoctorSearcher.Stats())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func adminDoctorDataUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	sharedDoctorSearcher := sharedDoctorSearcherFromContext(r.Context())
+	sharedDoctorSearcher.TriggerUpdate()
+	log.Info().Msg("doctor data update requested by admin")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func adminDoctorDataRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	sharedDoctorSearcher := sharedDoctorSearcherFromContext(r.Context())
+	err := sharedDoctorSearcher.Rollback()
+	if errors.Is(err, doctorsearch.ErrNoPreviousData) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("error rolling back doctor data")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Info().Msg("doctor data rolled back by admin")
+	writeDoctorDataStatus(w, sharedDoctorSearcher.Status())
+}
+
 var newLineRegexp = regexp.MustCompile(`\r?\n`)
 
 const FrontEndErrLogItemLimit = 800
@@ -284,29 +443,6 @@ func frontendErrorLogHandler(w http.ResponseWriter, r *http.Request) {
 	log.Warn().Msg(sb.String())
 }
 
-func pdfTemplateHandler(w http.ResponseWriter, r *http.Request) {
-	// As an extra paranoid step, use a CSP header for internal web-server used for PDF generation.
-	// Go's html/template package is used for escaping user content so injections shouldn't be an issue,
-	// but defense in depth can't hurt.
-	w.Header().Set(csp.HeaderCSP, csp.InternalPdfServerCSPHeader)
-
-	userDataKey := r.URL.Query().Get(InternalHTTPServerPDFTemplateRequestUserQueryKey)
-
-	sharedUserData := sharedUserDataFromContext(r.Context())
-	userData, err := sharedUserData.Get(userDataKey)
-	if err != nil {
-		log.Error().Msgf("error retrieving internal data for PDF: %s", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-	pdfGenerator := pdfGenControlFromContext(r.Context())
-
-	err = pdfGenerator.Template.Execute(w, userData)
-	if err != nil {
-		log.Error().Msgf("error serving internal PDF template: %s", err)
-	}
-}
-
 func emailForMailingListHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -352,23 +488,40 @@ func (fs *sourceMapHidingFileSystem) Open(name string) (http.File, error) {
 //   also responds to requests for PDF generation.
 //
 // - The PDF generating service, which interacts with a headless Chrome process.
-// It also uses an HTTP server, but bound only to localhost, for the headless web browser to connect to.
+// Contracts are handed over to the browser in-memory, it never needs to connect back to us.
 //
 // - A statistics/analytics service which records and also serves a public facing route to see them.
 func main() {
 	publicFacingWebsitePort := flag.String("p", PublicFacingWebsitePort, "port to serve on")
 	publicFacingWebsitePathRoot := flag.String("http-data", "", "the directory containing files to host over HTTP")
 	drDataFilePath := flag.String("dr-data-file", "", "the file containing the doctor contact data. This should be an extraction from https://annuaire.sante.fr/web/site-pro/extractions-publiques")
+	drUpdateURL := flag.String("dr-update-url", doctorsearch.ASIPDataURL, "the URL of the ZIP file to update the doctor data from, e.g. a local mirror")
+	drUpdateCAFilePath := flag.String("dr-update-ca-file", "", "a file containing the PEM encoded root certificates to trust when downloading doctor data (defaults to the ASIP root certificate for the ASIP URL, and to the system's root certificates otherwise)")
+	drUpdateDirPath := flag.String("dr-update-dir", "", "a directory to watch for new doctor data files, instead of downloading them")
+	drProfessions := flag.String("dr-professions", DoctorSearchProfessions, "the professions to index, separated by ';', each optionally followed by ':' and a comma-separated list of specialties, e.g. '10:SM54;40' for general practitioners and dentists")
+	drVerifyContracts := flag.Bool("dr-verify-contracts", false, "check that the RPPS numbers of the doctors of contracts are indexed, and match their names, warning about mismatches")
+	drCacheRecords := flag.Bool("doctor-search-cache-records", DoctorSearchCacheRecords, "keep the indexed doctor records in memory, instead of reading search results from the data file (faster, but uses more memory)")
+	drUpdateManual := flag.Bool("dr-update-manual", false, fmt.Sprintf("only update doctor data when triggered (by sending the %s signal), instead of periodically", syscall.SIGUSR1))
 
 	pdfTemplateFilePath := flag.String("pdf-template-file", "", "the HTML file used as a template for contract PDFs")
+	pdfRenderer := flag.String("pdf-renderer", PDFRendererCDP, fmt.Sprintf("the backend used to render PDFs: '%s' for a headless browser, '%s' for a browser-less stub (useful when developping)", PDFRendererCDP, PDFRendererFake))
 	pdfGenBrowserDevToolsUrl := flag.String("pdf-browser-devtools-url", PDFGeneratorBrowserDevToolsURL, "the URL of the browser devtools server to target and control for PDF generation")
-	pdfInternalTemplateWebHostname := flag.String("pdf-internal-web-hostname", "", "the hostname that external services should use to access the internal contract template web server")
+	pdfPoolSize := flag.Int("pdf-pool-size", PDFGeneratorPoolSize, "the number of browser pages used to generate PDFs concurrently")
+	pdfMaxRendersPerTarget := flag.Int("pdf-target-max-renders", PDFGeneratorMaxRendersPerTarget, "the number of PDFs a browser page generates before being replaced (0 to never replace)")
 
 	suppliedCensorKey := flag.String("censor-key", "", "key for HMAC-sha256 used to hash personally identifiable data")
+	suppliedPreviousCensorKey := flag.String("censor-previous-key", "", "the previous censor key, to be supplied for a while after a key rotation")
 
 	envMailingListPath := flag.String("mailinglist-file", "", "the file to which emails from users will be appended to")
 	envMailingListPubKeyFile := flag.String("mailinglist-pubkey-file", "", "a file containing the Base-64 encoded public key to encrypt mailing list entries with")
 
+	envStatsPath := flag.String("stats-file", "", "the file in which anonymous usage statistics are persisted")
+	envStatsContractsPath := flag.String("stats-contracts-file", "", "the file in which pseudonymous contract identifiers are recorded, to count unique contracts")
+
+	adminHost := flag.String("admin-host", "localhost", "the host or IP address to serve the admin HTTP API on, which should not be exposed publicly")
+	adminPort := flag.String("admin-p", "", "port to serve the admin HTTP API on (disabled when empty)")
+	suppliedAdminToken := flag.String("admin-token", "", "the bearer token which must be supplied to use the admin HTTP API")
+
 	// Flags useful when developping.
 	devMode := flag.Bool("dev", false, "enables dev mode which tailors logging output")
 	devWebsiteProxyPort := flag.String("http-proxy", "", "a port to reverse-proxy the user-facing web HTTP requests (useful for developping front-end)")
@@ -389,11 +542,11 @@ func main() {
 	if *pdfTemplateFilePath == "" {
 		log.Fatal().Msg("an HTML file must be specified for PDF template")
 	}
-	if *pdfGenBrowserDevToolsUrl == "" {
-		log.Fatal().Msg("a URL must be specified for the browser devtools")
+	if *pdfRenderer != PDFRendererCDP && *pdfRenderer != PDFRendererFake {
+		log.Fatal().Msgf("unknown PDF renderer '%s'", *pdfRenderer)
 	}
-	if *pdfInternalTemplateWebHostname == "" {
-		log.Fatal().Msg("a hostname must be specified for the internal template web host")
+	if *pdfRenderer == PDFRendererCDP && *pdfGenBrowserDevToolsUrl == "" {
+		log.Fatal().Msg("a URL must be specified for the browser devtools")
 	}
 
 	var censorSecretKey []byte
@@ -408,6 +561,28 @@ func main() {
 	if err := censor.Init(censorSecretKey); err != nil {
 		log.Fatal().Msgf("could not initialize censor package: %s", err)
 	}
+	if *suppliedPreviousCensorKey != "" {
+		if err := censor.InitPrevious([]byte(*suppliedPreviousCensorKey)); err != nil {
+			log.Fatal().Msgf("could not use previous censor key: %s", err)
+		}
+	}
+
+	adminToken := *suppliedAdminToken
+	if *adminPort != "" {
+		if *devMode && adminToken == "" {
+			b := make([]byte, AdminMinTokenLength)
+			if _, err := rand.Read(b); err != nil {
+				log.Fatal().Msgf("could not read random data for admin token: %s", err)
+			}
+			adminToken = base64.RawURLEncoding.EncodeToString(b)
+			log.Warn().
+				Str("admin_token", adminToken).
+				Msg("generated admin token (INSECURE)")
+		}
+		if len(adminToken) < AdminMinTokenLength {
+			log.Fatal().Msgf("the admin token must be at least %d characters long", AdminMinTokenLength)
+		}
+	}
 
 	// Load time-zone for Paris.
 	parisLocation, err := time.LoadLocation("Europe/Paris")
@@ -415,14 +590,79 @@ func main() {
 		log.Fatal().Msgf("could not load Paris time zone information %s", err)
 	}
 
-	err = SharedPdfGenControl.Init(*pdfTemplateFilePath, *pdfGenBrowserDevToolsUrl, PDFGeneratorInitializationTimeout)
+	var renderer pdfgen.Renderer
+	if *pdfRenderer == PDFRendererFake {
+		log.Warn().Msg("using fake PDF renderer, generated contracts only contain plain text")
+		renderer = pdfgen.NewFakeRenderer()
+	} else {
+		renderer, err = pdfgen.NewCDPRenderer(*pdfGenBrowserDevToolsUrl, PDFGeneratorInitializationTimeout, pdfgen.PoolConfig{
+			Size:                *pdfPoolSize,
+			MaxRendersPerTarget: *pdfMaxRendersPerTarget,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msgf("could not initialize PDF renderer")
+		}
+	}
+	err = SharedPdfGenControl.Init(*pdfTemplateFilePath, renderer)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("could not initialize PDF sub-system")
 	}
 	defer SharedPdfGenControl.Shutdown()
 
 	// Setup doctor search structure.
-	SharedDoctorSearcher = doctorsearch.New(*drDataFilePath, DoctorSearchNGramSize, MaxDoctorSearchQueryLength, MaxDoctorSearchConcurrentQueries, MaxDoctorSearchQueryDuration, DoctorDataUpdatePeriod, DoctorDataUpdateMinPeriod, DoctorDataUpdatePeriodJitter)
+	professionFilters, err := doctorsearch.ParseProfessionFilters(*drProfessions)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid doctor professions to index")
+	}
+	var drUpdateSource doctorsearch.UpdateSource
+	drUpdatePeriod := DoctorDataUpdatePeriod
+	if *drUpdateDirPath != "" {
+		drUpdateSource = doctorsearch.NewDirectorySource(*drUpdateDirPath)
+		drUpdatePeriod = DoctorDataDirectoryPollPeriod
+	} else if *drUpdateURL == doctorsearch.ASIPDataURL && *drUpdateCAFilePath == "" {
+		drUpdateSource = doctorsearch.NewASIPSource()
+	} else {
+		var caBundlePEM []byte
+		if *drUpdateCAFilePath != "" {
+			caBundlePEM, err = ioutil.ReadFile(*drUpdateCAFilePath)
+			if err != nil {
+				log.Fatal().Msgf("could not read doctor data CA bundle: %s", err)
+			}
+		}
+		drUpdateSource, err = doctorsearch.NewHTTPSource(*drUpdateURL, caBundlePEM)
+		if err != nil {
+			log.Fatal().Msgf("could not use doctor data update URL: %s", err)
+		}
+	}
+	if *drUpdateManual {
+		drUpdatePeriod = 0
+	}
+	VerifyContractDoctors = *drVerifyContracts
+	SharedDoctorSearcher = doctorsearch.New(*drDataFilePath, doctorsearch.Config{
+		NGramSize:            DoctorSearchNGramSize,
+		MaxUserQueryLength:   MaxDoctorSearchQueryLength,
+		MaxConcurrentQueries: MaxDoctorSearchConcurrentQueries,
+		MaxQueryDuration:     MaxDoctorSearchQueryDuration,
+		MinSimilarity:        DoctorSearchMinSimilarity,
+		Professions:          professionFilters,
+		PhoneticMatching:     DoctorSearchPhoneticMatching,
+		CacheRecords:         *drCacheRecords,
+		UpdateSource:         drUpdateSource,
+		UpdatePeriod:         drUpdatePeriod,
+		UpdateMinPeriod:      DoctorDataUpdateMinPeriod,
+		UpdatePeriodJitter:   DoctorDataUpdatePeriodJitter,
+
+		UpdateMinRecordsRatio: DoctorDataUpdateMinRecordsRatio,
+	})
+
+	// Allow triggering doctor data updates by hand.
+	updateSignals := make(chan os.Signal, 1)
+	signal.Notify(updateSignals, syscall.SIGUSR1)
+	go func() {
+		for range updateSignals {
+			SharedDoctorSearcher.TriggerUpdate()
+		}
+	}()
 
 	// Setup mailing list structure
 	var mailingListPath string
@@ -462,29 +702,39 @@ func main() {
 		log.Fatal().Err(err).Msgf("could not initialize mailinglist sub-system")
 	}
 
-	// Internal HTTP server for use with headless Web browser instance to convert web pages to PDF.
-	errChan := make(chan error)
-	go func() {
-		pdfServeMux := http.NewServeMux()
-		pdfServeMux.HandleFunc(InternalHTTPServerPDFTemplatePath, withContext(forMethod(http.MethodGet, pdfTemplateHandler)))
-
-		pdfServer := &http.Server{
-			// TODO: when not running within a container, we'd ideally want this to be bound to localhost and not to all interfaces.
-			Addr:              fmt.Sprintf(":%s", InternalHTTPServerPDFTemplatePort),
-			Handler:           pdfServeMux,
-			ReadHeaderTimeout: 10 * time.Second,
-			ReadTimeout:       10 * time.Second,
-			WriteTimeout:      PdfGenerationTimeout,
-			MaxHeaderBytes:    1 << 20,
+	// Setup statistics
+	statsPath := *envStatsPath
+	statsContractsPath := *envStatsContractsPath
+	if *devMode {
+		if statsPath == "" {
+			statsFile, err := ioutil.TempFile("", "stats")
+			if err != nil {
+				log.Fatal().Msgf("could not create temporary statistics file: %s", err)
+			}
+			statsFile.Close()
+			statsPath = statsFile.Name()
 		}
-		err := pdfServer.ListenAndServe()
-		if err != nil {
-			errChan <- err
+		if statsContractsPath == "" {
+			statsContractsFile, err := ioutil.TempFile("", "stats-contracts")
+			if err != nil {
+				log.Fatal().Msgf("could not create temporary contracts file: %s", err)
+			}
+			statsContractsFile.Close()
+			statsContractsPath = statsContractsFile.Name()
 		}
-	}()
+	}
+	if statsPath == "" || statsContractsPath == "" {
+		log.Fatal().Msg("files must be specified for statistics")
+	}
+	SharedStatsRecorder, err = stats.New(statsPath, statsContractsPath, parisLocation, StatsPersistPeriod)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("could not initialize statistics sub-system")
+	}
 
+	errChan := make(chan error)
+	var servers []*http.Server
 	// Public-facing HTTP server.
-	go func() {
+	{
 		publicServeMux := http.NewServeMux()
 
 		var rootHandler http.Handler
@@ -508,16 +758,30 @@ func main() {
 
 		publicServeMux.HandleFunc("/b/generate-contract",
 			withContext(
-				withInternalTemplateWebHostname(*pdfInternalTemplateWebHostname,
-					withTimeZoneLocation(parisLocation,
-						forMethod(http.MethodPost,
-							genContractHandler)))))
+				withTimeZoneLocation(parisLocation,
+					forMethod(http.MethodPost,
+						genContractHandler))))
+
+		publicServeMux.HandleFunc("/b/v1/contracts",
+			withContext(
+				withTimeZoneLocation(parisLocation,
+					forMethod(http.MethodPost,
+						contractsAPIHandler))))
+
+		publicServeMux.HandleFunc("/b/form-schema",
+			forMethod(http.MethodGet,
+				formSchemaHandler))
 
 		publicServeMux.HandleFunc("/b/search-doctor",
 			withContext(
 				forMethod(http.MethodGet,
 					doctorSearchHandler)))
 
+		publicServeMux.HandleFunc("/b/stats",
+			withContext(
+				forMethod(http.MethodGet,
+					statsHandler)))
+
 		publicServeMux.HandleFunc("/b/log-error",
 			forMethod(http.MethodPost,
 				frontendErrorLogHandler))
@@ -535,15 +799,90 @@ func main() {
 			WriteTimeout:      20 * time.Second,
 			MaxHeaderBytes:    1 * (1 << 20), // 1 MiB
 		}
-		err := s.ListenAndServe()
-		if err != nil {
-			errChan <- err
+		servers = append(servers, s)
+		go func() {
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}()
+	}
+
+	// Admin HTTP server, which should not be exposed publicly.
+	if *adminPort != "" {
+		adminServeMux := http.NewServeMux()
+
+		adminServeMux.HandleFunc("/admin/doctor-data",
+			withAdminToken(adminToken,
+				withContext(
+					forMethod(http.MethodGet,
+						adminDoctorDataStatusHandler))))
+
+		adminServeMux.HandleFunc("/admin/doctor-data/update",
+			withAdminToken(adminToken,
+				withContext(
+					forMethod(http.MethodPost,
+						adminDoctorDataUpdateHandler))))
+
+		adminServeMux.HandleFunc("/admin/doctor-search/stats",
+			withAdminToken(adminToken,
+				withContext(
+					forMethod(http.MethodGet,
+						adminDoctorSearchStatsHandler))))
+
+		adminServeMux.HandleFunc("/admin/doctor-data/rollback",
+			withAdminToken(adminToken,
+				withContext(
+					forMethod(http.MethodPost,
+						adminDoctorDataRollbackHandler))))
+
+		s := &http.Server{
+			Addr:              net.JoinHostPort(*adminHost, *adminPort),
+			Handler:           adminServeMux,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			// Rolling back may need to create an index.
+			WriteTimeout:   5 * time.Minute,
+			MaxHeaderBytes: 1 * (1 << 20), // 1 MiB
 		}
-	}()
+		servers = append(servers, s)
+		go func() {
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}()
+
+		log.Info().
+			Str("host", *adminHost).
+			Str("port", *adminPort).
+			Msgf("autocontract admin HTTP service starting on %s", net.JoinHostPort(*adminHost, *adminPort))
+	}
 
 	log.Info().
 		Str("port", *publicFacingWebsitePort).
 		Msgf("autocontract HTTP service starting on port %s", *publicFacingWebsitePort)
-	err = <-errChan
-	log.Fatal().Msgf("issue with an HTTP server: %s", err)
+	stopSignals := make(chan os.Signal, 1)
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errChan:
+		log.Error().Msgf("issue with an HTTP server: %s", err)
+	case sig := <-stopSignals:
+		log.Info().Msgf("received %s signal, stopping", sig)
+	}
+
+	// Let requests in progress finish, so that they make it into statistics.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), ServerShutdownTimeout)
+	for _, s := range servers {
+		if shutdownErr := s.Shutdown(shutdownCtx); shutdownErr != nil {
+			log.Error().Err(shutdownErr).Msgf("could not gracefully stop HTTP server %s", s.Addr)
+		}
+	}
+	cancelShutdown()
+
+	// Statistics are otherwise only persisted periodically.
+	if closeErr := SharedStatsRecorder.Close(); closeErr != nil {
+		log.Error().Err(closeErr).Msg("could not persist statistics")
+	}
+	if err != nil {
+		os.Exit(1)
+	}
 }
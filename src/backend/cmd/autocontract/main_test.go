@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"autocontract/pkg/censor"
+	"autocontract/pkg/doctorsearch"
+	"autocontract/pkg/pdfgen"
+	"autocontract/pkg/stats"
+
+	"github.com/rs/zerolog"
+)
+
+const testContractTemplate = `<html><body>
+<p>{{.Regular.Name}}, RPPS {{.Regular.NumberRPPS}}</p>
+<p>remplacé par {{.Substituting.Name}}</p>
+<p>{{.FormattedPeriods}}</p>
+</body></html>`
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	// Contracts of the tests are for June 2020.
+	ContractClock = func() time.Time { return time.Date(2020, time.May, 15, 12, 0, 0, 0, time.UTC) }
+
+	dir, err := ioutil.TempDir("", "autocontract-test")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := censor.Init(make([]byte, censor.MinKeySize)); err != nil {
+		panic(err)
+	}
+
+	templatePath := filepath.Join(dir, "template.html")
+	if err := ioutil.WriteFile(templatePath, []byte(testContractTemplate), 0600); err != nil {
+		panic(err)
+	}
+	if err := SharedPdfGenControl.Init(templatePath, pdfgen.NewFakeRenderer()); err != nil {
+		panic(err)
+	}
+
+	SharedStatsRecorder, err = stats.New(filepath.Join(dir, "stats.json"), filepath.Join(dir, "contracts.log"), time.UTC, time.Hour)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func validContractForm() map[string][]string {
+	return map[string][]string{
+		"period-start":              {"2020-06-01"},
+		"period-end":                {"2020-06-05"},
+		"regular-name":              {"Marie Curie"},
+		"regular-rpps":              {"10101010105"},
+		"regular-address":           {"1 rue des Lilas, 75016 PARIS"},
+		"substitute-name":           {"Pierre Curie"},
+		"substitute-title":          {"Docteur"},
+		"substitute-rpps":           {"10202020201"},
+		"substitute-siret":          {"73282932000009"},
+		"substitute-substitutingID": {"1234"},
+		"substitute-address":        {"2 rue des Lilas, 75016 PARIS"},
+		"financials-retrocession":   {"70"},
+	}
+}
+
+func newContractRequest(t *testing.T, fields map[string][]string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, values := range fields {
+		for _, value := range values {
+			if err := mw.WriteField(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/b/generate-contract", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func serveContractRequest(req *http.Request) *httptest.ResponseRecorder {
+	handler := withContext(
+		withTimeZoneLocation(time.UTC,
+			forMethod(http.MethodPost,
+				genContractHandler)))
+
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestGenerateContract(t *testing.T) {
+	before := SharedStatsRecorder.Snapshot()
+
+	w := serveContractRequest(newContractRequest(t, validContractForm()))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/pdf" {
+		t.Errorf("Content-Type = %s, expected application/pdf", contentType)
+	}
+	pdf := w.Body.Bytes()
+	for _, expected := range []string{"Marie Curie, RPPS 10101010105", "Pierre Curie", "du 1er au 5 Juin 2020 compris"} {
+		if !bytes.Contains(pdf, []byte(expected)) {
+			t.Errorf("PDF does not contain '%s'", expected)
+		}
+	}
+
+	after := SharedStatsRecorder.Snapshot()
+	if after.Contracts.Total != before.Contracts.Total+1 {
+		t.Errorf("contract was not counted in statistics")
+	}
+}
+
+func TestGenerateContractWithInvalidForm(t *testing.T) {
+	fields := validContractForm()
+	delete(fields, "regular-name")
+	req := newContractRequest(t, fields)
+	req.Header.Set("Accept", "application/json")
+
+	w := serveContractRequest(req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, expected %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	var issues map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := issues["regular-name"]; !ok || len(issues) != 1 {
+		t.Errorf("expected a single issue for 'regular-name', got %v", issues)
+	}
+}
+
+func TestGenerateContractWithLargeForm(t *testing.T) {
+	fields := validContractForm()
+	fields["regular-address"] = []string{strings.Repeat("a", ContractFormMaxBodyBytes)}
+
+	w := serveContractRequest(newContractRequest(t, fields))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, expected %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+const validContractJSON = `{
+	"periods": [{"start": "2020-06-01", "end": "2020-06-05"}],
+	"regular": {"name": "Marie Curie", "rpps": "10101010105", "address": "1 rue des Lilas, 75016 PARIS"},
+	"substitute": {
+		"name": "Pierre Curie", "title": "Docteur", "rpps": "10202020201", "siret": "73282932000009",
+		"substituting_id": "1234", "address": "2 rue des Lilas, 75016 PARIS"
+	},
+	"financials": {"retrocession": 70}
+}`
+
+func serveContractsAPIRequest(contentType string, body string) *httptest.ResponseRecorder {
+	handler := withContext(
+		withTimeZoneLocation(time.UTC,
+			forMethod(http.MethodPost,
+				contractsAPIHandler)))
+
+	req := httptest.NewRequest(http.MethodPost, "/b/v1/contracts", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestContractsAPI(t *testing.T) {
+	w := serveContractsAPIRequest("application/json", validContractJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	for _, expected := range []string{"Marie Curie, RPPS 10101010105", "Pierre Curie", "du 1er au 5 Juin 2020 compris"} {
+		if !bytes.Contains(w.Body.Bytes(), []byte(expected)) {
+			t.Errorf("PDF does not contain '%s'", expected)
+		}
+	}
+
+	invalid := strings.Replace(validContractJSON, `"end": "2020-06-05"`, `"end": "5 juin"`, 1)
+	invalid = strings.Replace(invalid, `"rpps": "10101010105"`, `"rpps": "101"`, 1)
+	invalid = strings.Replace(invalid, `"rpps": "10202020201"`, `"rpps": "10202020202"`, 1)
+	invalid = strings.Replace(invalid, `"siret": "73282932000009"`, `"siret": "7328293200000A"`, 1)
+	invalid = strings.Replace(invalid, `"retrocession": 70`, `"night_shift_retrocession": 70`, 1)
+	w = serveContractsAPIRequest("application/json; charset=utf-8", invalid)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, expected %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body.String())
+	}
+	var issues map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/periods/0/end":           "could not parse input",
+		"/regular/rpps":            "unexpected input length",
+		"/substitute/rpps":         "invalid number",
+		"/substitute/siret":        "invalid number",
+		"/financials/retrocession": "input can not be empty",
+	}
+	if !reflect.DeepEqual(issues, expected) {
+		t.Errorf("got issues %v, expected %v", issues, expected)
+	}
+
+	for _, test := range []struct {
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{"multipart/form-data", validContractJSON, http.StatusUnsupportedMediaType},
+		{"application/json", `{"periods": `, http.StatusBadRequest},
+		{"application/json", `{"unknown": true}`, http.StatusBadRequest},
+		// Only the substitute has a title, SIRET number and substituting ID.
+		{"application/json", `{"regular": {"siret": "73282932000009"}}`, http.StatusBadRequest},
+		{"application/json", validContractJSON + `}`, http.StatusBadRequest},
+		{"application/json", validContractJSON + validContractJSON, http.StatusBadRequest},
+		{"application/json", `{"regular": {"address": "` + strings.Repeat("a", ContractsAPIMaxBodyBytes) + `"}}`, http.StatusRequestEntityTooLarge},
+	} {
+		w := serveContractsAPIRequest(test.contentType, test.body)
+		if w.Code != test.expectedStatus {
+			t.Errorf("'%.50s' request: status = %d, expected %d", test.body, w.Code, test.expectedStatus)
+		}
+	}
+
+	// The reason why JSON can't be read is sent back.
+	w = serveContractsAPIRequest("application/json", `{"unknown": true}`)
+	var jsonError struct {
+		Message string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &jsonError); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(jsonError.Message, `unknown field "unknown"`) {
+		t.Errorf("unexpected error message '%s'", jsonError.Message)
+	}
+}
+
+// fakeDoctorSearcher only knows the doctors of its records.
+type fakeDoctorSearcher struct {
+	doctorsearch.DoctorSearcher
+	records []doctorsearch.DoctorRecord
+}
+
+func (f fakeDoctorSearcher) Query(ctx context.Context, query string, maxNumberResults int, options doctorsearch.QueryOptions) ([]doctorsearch.DoctorRecord, error) {
+	for _, record := range f.records {
+		if record.RPPSNumber == query {
+			return []doctorsearch.DoctorRecord{record}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f fakeDoctorSearcher) QueryTimeout() time.Duration {
+	return time.Second
+}
+
+func TestContractsAPIDoctorWarnings(t *testing.T) {
+	SharedDoctorSearcher = fakeDoctorSearcher{records: []doctorsearch.DoctorRecord{
+		{RPPSNumber: "10101010105", FirstName: "Irène", LastName: "Joliot-Curie"},
+	}}
+	VerifyContractDoctors = true
+	defer func() {
+		SharedDoctorSearcher = nil
+		VerifyContractDoctors = false
+	}()
+	expectedWarnings := map[string]string{
+		"/regular/name":    "name does not match the RPPS number",
+		"/substitute/rpps": "unknown RPPS number",
+	}
+
+	// Warnings don't prevent generating the contract.
+	w := serveContractsAPIRequest("application/json", validContractJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, expected %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var warnings map[string]string
+	if err := json.Unmarshal([]byte(w.Header().Get(ContractWarningsHeader)), &warnings); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(warnings, expectedWarnings) {
+		t.Errorf("got warnings %v, expected %v", warnings, expectedWarnings)
+	}
+	// They are kept in the PDF too.
+	if !bytes.Contains(w.Body.Bytes(), []byte("/Keywords <FEFF")) {
+		t.Errorf("the PDF has no keywords")
+	}
+
+	// But they come along errors.
+	invalid := strings.Replace(validContractJSON, `"retrocession": 70`, `"retrocession": 170`, 1)
+	w = serveContractsAPIRequest("application/json", invalid)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, expected %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body.String())
+	}
+	var issues struct {
+		Retrocession string            `json:"/financials/retrocession"`
+		Warnings     map[string]string `json:"warnings"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &issues); err != nil {
+		t.Fatal(err)
+	}
+	if issues.Retrocession != "could not parse input" || !reflect.DeepEqual(issues.Warnings, expectedWarnings) {
+		t.Errorf("unexpected issues %s", w.Body.String())
+	}
+
+	// Matching doctors raise no warnings.
+	matching := strings.Replace(validContractJSON, `"name": "Marie Curie"`, `"name": "Irène Joliot-Curie"`, 1)
+	matching = strings.Replace(matching, `"name": "Pierre Curie"`, `"name": "Dr Joliot-Curie"`, 1)
+	matching = strings.Replace(matching, `"rpps": "10202020201"`, `"rpps": "10101010105"`, 1)
+	w = serveContractsAPIRequest("application/json", matching)
+	if w.Code != http.StatusOK || w.Header().Get(ContractWarningsHeader) != "" {
+		t.Errorf("status = %d, warnings '%s'", w.Code, w.Header().Get(ContractWarningsHeader))
+	}
+}
+
+func TestFormSchema(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/b/form-schema", nil)
+	w := httptest.NewRecorder()
+	formSchemaHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, expected %d", w.Code, http.StatusOK)
+	}
+
+	var schema struct {
+		Fields []struct {
+			Name       string `json:"name"`
+			Optional   bool   `json:"optional"`
+			Validators []struct {
+				Kind   string `json:"kind"`
+				Length int    `json:"length"`
+				Min    *int   `json:"min"`
+				Max    *int   `json:"max"`
+			} `json:"validators"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]int, len(schema.Fields))
+	for i, field := range schema.Fields {
+		fields[field.Name] = i
+	}
+	for _, name := range []string{"period-start", "regular-rpps", "substitute-siret", "financials-nightShiftRetrocession"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("schema has no field '%s'", name)
+		}
+	}
+
+	rpps := schema.Fields[fields["regular-rpps"]]
+	if rpps.Optional || len(rpps.Validators) != 4 || rpps.Validators[1].Kind != "maxLength" || rpps.Validators[1].Length != 11 {
+		t.Errorf("unexpected RPPS field %+v", rpps)
+	}
+	nightShift := schema.Fields[fields["financials-nightShiftRetrocession"]]
+	if !nightShift.Optional || len(nightShift.Validators) != 1 {
+		t.Fatalf("unexpected night shift retrocession field %+v", nightShift)
+	}
+	if v := nightShift.Validators[0]; v.Kind != "integer" || v.Min == nil || *v.Min != 0 || v.Max == nil || *v.Max != 100 {
+		t.Errorf("unexpected night shift retrocession validator %+v", v)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	const token = "0123456789abcdef0123456789abcdef"
+	handler := withAdminToken(token, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for authorization, expectedStatus := range map[string]int{
+		"":                   http.StatusUnauthorized,
+		token:                http.StatusUnauthorized,
+		"Bearer not-a-token": http.StatusUnauthorized,
+		"Bearer " + token:    http.StatusNoContent,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/doctor-data", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != expectedStatus {
+			t.Errorf("Authorization '%s': status = %d, expected %d", authorization, w.Code, expectedStatus)
+		}
+	}
+}
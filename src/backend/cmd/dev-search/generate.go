@@ -0,0 +1,90 @@
+package main
+
+import (
+	"autocontract/pkg/doctorsearch"
+	"autocontract/pkg/doctorsearch/synthetic"
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// generate writes a synthetic data file with numPeople people to dataFilePath. When queriesFilePath
+// and expectedFilePath are not empty, numQueries queries for indexed people are written there too,
+// along with the RPPS number each query is expected to find.
+func generate(dataFilePath string, numPeople int, queriesFilePath, expectedFilePath string, numQueries int, professions []doctorsearch.ProfessionFilter) error {
+	f, err := os.Create(dataFilePath)
+	if err != nil {
+		return err
+	}
+	people, err := synthetic.Write(f, synthetic.Config{NumPeople: numPeople, Seed: 1})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if queriesFilePath == "" || expectedFilePath == "" {
+		return nil
+	}
+
+	var indexed []synthetic.Person
+	for _, person := range people {
+		if person.IDType != "8" || person.Military {
+			continue
+		}
+		for _, filter := range professions {
+			if filter.Matches(person.ProfessionCode, person.Specialty) {
+				indexed = append(indexed, person)
+				break
+			}
+		}
+	}
+	if len(indexed) == 0 {
+		return fmt.Errorf("no generated person is indexed")
+	}
+
+	queriesFile, err := os.Create(queriesFilePath)
+	if err != nil {
+		return err
+	}
+	defer queriesFile.Close()
+	expectedFile, err := os.Create(expectedFilePath)
+	if err != nil {
+		return err
+	}
+	defer expectedFile.Close()
+
+	queries, expected := bufio.NewWriter(queriesFile), bufio.NewWriter(expectedFile)
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < numQueries; i++ {
+		person := indexed[rng.Intn(len(indexed))]
+		var query string
+		// Vary queries the way users do: with the location of the doctor, in another order,
+		// or with a typo.
+		switch i % 3 {
+		case 0:
+			query = person.FirstName + " " + person.LastName + " " + person.Sites[0].PostalCode
+		case 1:
+			query = strings.ToLower(person.LastName + " " + person.FirstName + " " + person.Sites[0].Commune)
+		case 2:
+			lastName := []rune(person.LastName)
+			typo := 1 + rng.Intn(len(lastName)-1)
+			query = person.FirstName + " " + string(lastName[:typo]) + string(lastName[typo+1:]) + " " + person.Sites[0].PostalCode
+		}
+		fmt.Fprintln(queries, query)
+		fmt.Fprintf(expected, "%s\t%s\n", query, person.ID)
+	}
+	if err := queries.Flush(); err != nil {
+		return err
+	}
+	if err := expected.Flush(); err != nil {
+		return err
+	}
+	if err := queriesFile.Close(); err != nil {
+		return err
+	}
+	return expectedFile.Close()
+}
@@ -14,25 +14,89 @@ import (
 
 func main() {
 	drDataFilePath := flag.String("dr-data-file", "", "the file containing the doctor contact data. This should be an extraction from https://annuaire.sante.fr/web/site-pro/extractions-publiques")
+	drProfessions := flag.String("dr-professions", "10:SM26,SM53,SM54", "the professions to index, see the autocontract command")
+	profession := flag.String("profession", "", "only search records of this profession code")
+	phonetic := flag.Bool("phonetic", true, "also match names which sound like the query")
+	cacheRecords := flag.Bool("cache-records", true, "keep the indexed records in memory instead of reading them from the data file")
+	queriesFilePath := flag.String("queries", "", "replay the queries of this file, one per line, instead of reading queries from stdin")
+	expectedFilePath := flag.String("expected", "", "measure the recall of replayed queries against this file, where each line is a query, a tab and the expected RPPS numbers separated by commas")
+	concurrency := flag.Int("concurrency", 100, "the number of concurrent queries when replaying queries")
+	maxResults := flag.Int("max-results", 25, "the maximum number of results of a query")
+	generatePeople := flag.Int("generate", 0, "write a synthetic data file with this number of people to the data file path, and the queries and expected results of as many as -generate-queries queries when -queries and -expected are given, then exit")
+	generateQueries := flag.Int("generate-queries", 1000, "the number of queries to generate")
 	flag.Parse()
 
+	professionFilters, err := doctorsearch.ParseProfessionFilters(*drProfessions)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid professions")
+	}
+
 	zerolog.SetGlobalLevel(zerolog.TraceLevel)
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
+	if *generatePeople > 0 {
+		if err := generate(*drDataFilePath, *generatePeople, *queriesFilePath, *expectedFilePath, *generateQueries, professionFilters); err != nil {
+			log.Fatal().Err(err).Msg("could not generate synthetic data")
+		}
+		return
+	}
+
 	const (
 		DoctorSearchNGramSize            = 3
 		MaxDoctorSearchQueryLength       = 300
 		MaxDoctorSearchConcurrentQueries = 200
 		MaxDoctorSearchQueryTime         = 20 * time.Second
-
-		MaxNumberResults = 25
+		DoctorSearchMinSimilarity        = 0.3
 	)
-	searcher := doctorsearch.New(*drDataFilePath,
-		DoctorSearchNGramSize,
-		MaxDoctorSearchQueryLength,
-		MaxDoctorSearchConcurrentQueries,
-		MaxDoctorSearchQueryTime,
-		0, 0, 0)
+	searcher := doctorsearch.New(*drDataFilePath, doctorsearch.Config{
+		NGramSize:            DoctorSearchNGramSize,
+		MaxUserQueryLength:   MaxDoctorSearchQueryLength,
+		MaxConcurrentQueries: MaxDoctorSearchConcurrentQueries,
+		MaxQueryDuration:     MaxDoctorSearchQueryTime,
+		MinSimilarity:        DoctorSearchMinSimilarity,
+		Professions:          professionFilters,
+		PhoneticMatching:     *phonetic,
+		CacheRecords:         *cacheRecords,
+	})
+
+	if *queriesFilePath != "" {
+		// Replay mode does not log each query.
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+		queries, err := readLines(*queriesFilePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not read queries")
+		}
+		var expected map[string][]string
+		if *expectedFilePath != "" {
+			expected, err = readExpectedResults(*expectedFilePath)
+			if err != nil {
+				log.Fatal().Err(err).Msg("could not read expected results")
+			}
+		}
+
+		// The index is created in the background.
+		for deadline := time.Now().Add(10 * time.Minute); searcher.Status().IndexCreatedAt.IsZero(); {
+			if time.Now().After(deadline) {
+				log.Fatal().Msg("the index was not ready in time")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		report := replay(searcher, queries, expected, *concurrency, *maxResults, doctorsearch.QueryOptions{Profession: *profession})
+		event := log.Info().
+			Int("queries", report.numQueries).
+			Int("errors", report.numErrors).
+			Dur("duration", report.duration).
+			Float64("queries_per_second", float64(report.numQueries)/report.duration.Seconds()).
+			Dur("p50", report.percentile(0.50)).
+			Dur("p95", report.percentile(0.95)).
+			Dur("p99", report.percentile(0.99))
+		if expected != nil {
+			event = event.Int("expected_results", report.numExpected).Float64("recall", report.recall())
+		}
+		event.Msg("replay done")
+		return
+	}
 
 	log.Debug().Msg("Starting...\n")
 	scanner := bufio.NewScanner(os.Stdin)
@@ -41,7 +105,7 @@ func main() {
 		ctx := context.Background()
 
 		start := time.Now()
-		results, err := searcher.Query(ctx, input, MaxNumberResults)
+		results, err := searcher.Query(ctx, input, *maxResults, doctorsearch.QueryOptions{Profession: *profession})
 		queryDuration := time.Since(start)
 
 		if err != nil {
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"autocontract/pkg/doctorsearch"
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readLines returns the non-empty lines of the file at filePath.
+func readLines(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readExpectedResults reads a file where each line is a query, a tab, and the RPPS numbers
+// the query should find, separated by commas.
+func readExpectedResults(filePath string) (map[string][]string, error) {
+	lines, err := readLines(filePath)
+	if err != nil {
+		return nil, err
+	}
+	expected := make(map[string][]string, len(lines))
+	for i, line := range lines {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d of %s has no tab", i+1, filePath)
+		}
+		for _, rpps := range strings.Split(parts[1], ",") {
+			if !contains(expected[parts[0]], rpps) {
+				expected[parts[0]] = append(expected[parts[0]], rpps)
+			}
+		}
+	}
+	return expected, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+type replayReport struct {
+	numQueries  int
+	numErrors   int
+	duration    time.Duration
+	latencies   []time.Duration
+	numExpected int
+	numFound    int
+}
+
+// percentile returns the latency below which the share p (between 0.0 and 1.0) of queries are.
+func (r *replayReport) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i]
+}
+
+// recall returns the share of the expected results which were found.
+func (r *replayReport) recall() float64 {
+	if r.numExpected == 0 {
+		return 0
+	}
+	return float64(r.numFound) / float64(r.numExpected)
+}
+
+// replay runs queries with the given number of concurrent clients, and measures how many of the
+// expected results (which may be nil) were found.
+func replay(searcher doctorsearch.DoctorSearcher, queries []string, expected map[string][]string, concurrency int, maxNumberResults int, options doctorsearch.QueryOptions) *replayReport {
+	report := &replayReport{numQueries: len(queries)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queriesChan := make(chan string)
+
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for query := range queriesChan {
+				queryStart := time.Now()
+				results, err := searcher.Query(context.Background(), query, maxNumberResults, options)
+				latency := time.Since(queryStart)
+
+				found := make(map[string]bool, len(results))
+				for _, result := range results {
+					found[result.RPPSNumber] = true
+				}
+				mu.Lock()
+				report.latencies = append(report.latencies, latency)
+				if err != nil {
+					report.numErrors++
+				}
+				for _, rpps := range expected[query] {
+					report.numExpected++
+					if found[rpps] {
+						report.numFound++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, query := range queries {
+		queriesChan <- query
+	}
+	close(queriesChan)
+	wg.Wait()
+	report.duration = time.Since(start)
+
+	sort.Slice(report.latencies, func(i, j int) bool { return report.latencies[i] < report.latencies[j] })
+	return report
+}
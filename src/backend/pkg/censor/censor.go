@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"hash"
+	"sync"
 )
 
 const (
@@ -15,6 +16,9 @@ const (
 type censor struct {
 	initialized bool
 	hmacHash    hash.Hash
+	// previousHmacHash uses the secret which was in use before the current one, if any.
+	previousHmacHash hash.Hash
+	mutex            sync.Mutex
 }
 
 var (
@@ -28,9 +32,28 @@ func (c *censor) censor(s string) []byte {
 		panic("call to censor.Censor() before censor.Init()")
 	}
 
-	c.hmacHash.Write([]byte(s))
-	b := c.hmacHash.Sum(nil)
-	c.hmacHash.Reset()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return sum(c.hmacHash, s)
+}
+
+func (c *censor) censorPrevious(s string) ([]byte, bool) {
+	if !c.initialized {
+		panic("call to censor.CensorPrevious() before censor.Init()")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.previousHmacHash == nil {
+		return nil, false
+	}
+	return sum(c.previousHmacHash, s), true
+}
+
+func sum(h hash.Hash, s string) []byte {
+	h.Write([]byte(s))
+	b := h.Sum(nil)
+	h.Reset()
 	return b
 }
 
@@ -46,6 +69,28 @@ func Init(secret []byte) error {
 	return nil
 }
 
+// InitPrevious sets the secret which was used before the one given to Init.
+//
+// This allows values censored before a key rotation to be matched to their new censored value.
+func InitPrevious(secret []byte) error {
+	if !defaultCensor.initialized {
+		return fmt.Errorf("must be called after Init()")
+	}
+	if len(secret) < MinKeySize {
+		return fmt.Errorf("previous secret is %d bytes, but minimum length is %d", len(secret), MinKeySize)
+	}
+	defaultCensor.mutex.Lock()
+	defer defaultCensor.mutex.Unlock()
+	defaultCensor.previousHmacHash = hmac.New(sha256.New, secret)
+	return nil
+}
+
 func Censor(s string) []byte {
 	return defaultCensor.censor(s)
 }
+
+// CensorPrevious censors s with the previous secret.
+// It returns false if no previous secret was set.
+func CensorPrevious(s string) ([]byte, bool) {
+	return defaultCensor.censorPrevious(s)
+}
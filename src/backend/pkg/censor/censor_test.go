@@ -83,3 +83,20 @@ func TestTwoStringsAreCensoredToDifferentValues(t *testing.T) {
 		t.Errorf("different strings should censor to different values:\n%v\n%v\n", a, b)
 	}
 }
+
+func TestPreviousKeyCensorsDifferently(t *testing.T) {
+	Init(goodKey())
+	previousKey := mkKey(MinKeySize)
+	previousKey[0] = 1
+	if err := InitPrevious(previousKey); err != nil {
+		t.Fatalf("should set previous key: %s", err)
+	}
+	a := Censor(StringWithPersonalData)
+	b, ok := CensorPrevious(StringWithPersonalData)
+	if !ok {
+		t.Fatalf("previous key should be used")
+	}
+	if bytes.Equal(a, b) == true {
+		t.Errorf("different keys should censor to different values:\n%v\n%v\n", a, b)
+	}
+}
@@ -9,7 +9,7 @@ const (
 	HeaderCSP                 = "Content-Security-Policy"
 	HeaderXContentTypeOptions = "X-Content-Type-Options"
 
-	InternalPdfServerCSPHeader = `default-src 'none'; style-src 'unsafe-inline'; img-src data:`
+	PdfDocumentCSPHeader = `default-src 'none'; style-src 'unsafe-inline'; img-src data:`
 )
 
 type AddCSPSecurity interface {
@@ -3,12 +3,10 @@ package datamap
 import (
 	"fmt"
 	"html/template"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
-
-	"autocontract/pkg/uuid"
 )
 
 const (
@@ -173,8 +171,13 @@ type UserData struct {
 	Periods                 []Period
 	Financials              Financials
 	DateContractEstablished time.Time
+	// Warnings are about data which may be wrong, but did not prevent making the contract, by
+	// the name of the field they are about.
+	Warnings map[string]string
 }
 
+// duration returns the number of days of the period, which must not end before it starts
+// (MergePeriods leaves such periods out).
 func (p *Period) duration() (days int) {
 	a := p.Start
 	b := p.End
@@ -182,9 +185,6 @@ func (p *Period) duration() (days int) {
 	if a.Location() != b.Location() {
 		b = b.In(a.Location())
 	}
-	if a.After(b) {
-		a, b = b, a
-	}
 
 	duration := b.Sub(a)
 	hours := duration.Hours()
@@ -196,9 +196,52 @@ func (p *Period) duration() (days int) {
 	return
 }
 
+// MergePeriods returns the periods in chronological order, adjacent periods being merged, e.g.
+// 1-5 June and 6-8 June become 1-8 June. Periods overlapping previous ones are merged too, and
+// their indexes in periods are returned.
+//
+// Periods ending before they start have no days, and are left out.
+func MergePeriods(periods []Period) (merged []Period, overlapping []int) {
+	order := make([]int, 0, len(periods))
+	for i, p := range periods {
+		if !p.End.Before(p.Start) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return periods[order[i]].Start.Before(periods[order[j]].Start)
+	})
+
+	for _, index := range order {
+		p := periods[index]
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			// Dates are days, so a period starting the day after the last one ends is adjacent.
+			if p.Start.Sub(last.End) <= 24*time.Hour {
+				if !p.Start.After(last.End) {
+					overlapping = append(overlapping, index)
+				}
+				if p.End.After(last.End) {
+					last.End = p.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, p)
+	}
+	return merged, overlapping
+}
+
+// mergedPeriods returns the periods of the contract merged, so that no day is counted twice.
+// Periods of processed forms already are, but UserData may come from elsewhere.
+func (u *UserData) mergedPeriods() []Period {
+	merged, _ := MergePeriods(u.Periods)
+	return merged
+}
+
 func (u *UserData) totalDuration() (days int) {
 	days = 0
-	for _, period := range u.Periods {
+	for _, period := range u.mergedPeriods() {
 		diffDays := period.duration()
 		days += diffDays
 	}
@@ -216,15 +259,16 @@ func (u *UserData) FormattedDuration() string {
 
 // TODO: fix & test this
 func (u *UserData) FormattedPeriods() string {
-	if len(u.Periods) == 0 {
+	periods := u.mergedPeriods()
+	if len(periods) == 0 {
 		return ""
 	}
 
 	var formattedPeriods []periodFormatted
 
 	areAllPeriodsInSameYear := true
-	firstPeriodYear := u.Periods[0].formatted().start.year
-	for _, period := range u.Periods {
+	firstPeriodYear := periods[0].formatted().start.year
+	for _, period := range periods {
 		fp := period.formatted()
 		formattedPeriods = append(formattedPeriods, fp)
 
@@ -264,7 +308,7 @@ func (u *UserData) FormattedPeriods() string {
 
 	s := ""
 	for idx, fp := range formattedPeriods {
-		numDays := u.Periods[idx].duration()
+		numDays := periods[idx].duration()
 		isLastElement := idx == len(formattedPeriods)-1
 
 		if idx == 0 && numDays == 1 {
@@ -326,42 +370,3 @@ func MarkSafe(u UserData) SafeUserData {
 		userData: u,
 	}
 }
-
-type DataMap interface {
-	Get(key string) (*UserData, error)
-	Set(data SafeUserData) (string, error)
-	Clear(key string)
-}
-
-type dataMap struct {
-	internalMap sync.Map
-}
-
-func NewDataMap() DataMap {
-	return &dataMap{
-		internalMap: sync.Map{},
-	}
-}
-
-func (m *dataMap) Get(key string) (*UserData, error) {
-	value, ok := m.internalMap.Load(key)
-	if !ok {
-		return nil, fmt.Errorf("no user data found for key '%s'", key)
-	}
-	u := value.(UserData)
-	return &u, nil
-}
-
-func (m *dataMap) Set(data SafeUserData) (string, error) {
-	uuid, err := uuid.NewUuid()
-	if err != nil {
-		return "", err
-	}
-	key := uuid.String()
-	m.internalMap.Store(key, data.GetUserData())
-	return key, nil
-}
-
-func (m *dataMap) Clear(key string) {
-	m.internalMap.Delete(key)
-}
@@ -98,7 +98,39 @@ func TestPeriods(t *testing.T) {
 					time.Date(2017, time.March, 3, 0, 0, 0, 0, time.UTC),
 				},
 			},
-			expectedValues{"1 jour", "pour le 3 Mars"},
+			expectedValues{"1 jour", "pour le 3 Mars 2017"},
+		},
+		{
+			"overlapping and adjacent periods, out of order",
+			[]Period{
+				{
+					time.Date(2018, time.June, 12, 0, 0, 0, 0, time.UTC),
+					time.Date(2018, time.June, 13, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					time.Date(2018, time.June, 7, 0, 0, 0, 0, time.UTC),
+					time.Date(2018, time.June, 9, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					time.Date(2018, time.June, 8, 0, 0, 0, 0, time.UTC),
+					time.Date(2018, time.June, 10, 0, 0, 0, 0, time.UTC),
+				},
+			},
+			expectedValues{"6 jours", "du 7 au 10 Juin compris et du 12 au 13 Juin 2018 compris"},
+		},
+		{
+			"reversed period",
+			[]Period{
+				{
+					time.Date(2018, time.June, 7, 0, 0, 0, 0, time.UTC),
+					time.Date(2018, time.June, 9, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					time.Date(2018, time.June, 20, 0, 0, 0, 0, time.UTC),
+					time.Date(2018, time.June, 15, 0, 0, 0, 0, time.UTC),
+				},
+			},
+			expectedValues{"3 jours", "du 7 au 9 Juin 2018 compris"},
 		},
 		{
 			"single days interspersed with period",
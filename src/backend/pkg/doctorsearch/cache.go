@@ -0,0 +1,99 @@
+package doctorsearch
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// recordCache holds the indexed records of a data file in memory, so that queries do not
+// read the data file at all.
+//
+// Records are kept as a struct of arrays rather than a slice of records: the string fields
+// of all records are substrings of a single string, which saves memory and leaves very
+// few pointers for the garbage collector to scan.
+type recordCache struct {
+	// startOffsets are the offsets of the records in the data file, in increasing order.
+	startOffsets []int64
+	ppIdTypes    []uint8
+	// fieldEnds holds, for each record, the end of each of its string fields in fields.
+	fieldEnds []uint32
+	fields    string
+}
+
+// newRecordCache reads all records of the rpps table from r, which is read sequentially once.
+func newRecordCache(r io.ReaderAt, columns columnLayout, rpps indexTable) (*recordCache, error) {
+	allPostings := postings(rpps.postings)
+	offsets := make([]DatabaseFileOffsetsRecord, allPostings.Len())
+	for i := range offsets {
+		offsets[i] = allPostings.At(i)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].StartOffset < offsets[j].StartOffset })
+
+	cache := &recordCache{
+		startOffsets: make([]int64, 0, len(offsets)),
+		ppIdTypes:    make([]uint8, 0, len(offsets)),
+		fieldEnds:    make([]uint32, 0, len(offsets)*numRecordStringFields),
+	}
+	var fields strings.Builder
+	br := bufio.NewReaderSize(io.NewSectionReader(r, 0, math.MaxInt64), 64*1024)
+	var position int64
+	var line []byte
+	for _, offset := range offsets {
+		if offset.StartOffset < position {
+			// Already cached.
+			continue
+		}
+		if err := checkPosting(offset); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(int(offset.StartOffset - position)); err != nil {
+			return nil, err
+		}
+		if uint32(cap(line)) >= offset.Length {
+			line = line[:offset.Length]
+		} else {
+			line = make([]byte, offset.Length)
+		}
+		if _, err := io.ReadFull(br, line); err != nil {
+			return nil, err
+		}
+		position = offset.StartOffset + int64(offset.Length)
+
+		record, err := columns.parseRecord(string(line))
+		if err != nil {
+			return nil, err
+		}
+		cache.startOffsets = append(cache.startOffsets, offset.StartOffset)
+		cache.ppIdTypes = append(cache.ppIdTypes, record.PPIdType)
+		for _, field := range record.stringFields() {
+			fields.WriteString(*field)
+			cache.fieldEnds = append(cache.fieldEnds, uint32(fields.Len()))
+		}
+	}
+	cache.fields = fields.String()
+	return cache, nil
+}
+
+// record returns the cached record starting at offset, if there is one.
+func (c *recordCache) record(offset int64) (rawPersonActivityRecord, bool) {
+	n := len(c.startOffsets)
+	i := sort.Search(n, func(i int) bool { return c.startOffsets[i] >= offset })
+	if i >= n || c.startOffsets[i] != offset {
+		return rawPersonActivityRecord{}, false
+	}
+
+	record := rawPersonActivityRecord{PPIdType: c.ppIdTypes[i]}
+	ends := c.fieldEnds[i*numRecordStringFields : (i+1)*numRecordStringFields]
+	var start uint32
+	if i > 0 {
+		start = c.fieldEnds[i*numRecordStringFields-1]
+	}
+	for j, field := range record.stringFields() {
+		*field = c.fields[start:ends[j]]
+		start = ends[j]
+	}
+	return record, true
+}
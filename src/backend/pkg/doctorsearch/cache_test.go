@@ -0,0 +1,103 @@
+package doctorsearch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"autocontract/pkg/doctorsearch/synthetic"
+)
+
+func TestRecordCache(t *testing.T) {
+	fixture := newFixtureIndex(t)
+
+	f, err := os.Open(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := fixtureIndexOptions
+	options.cacheRecords = true
+	index, err := newNGramsIndex(f, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// All activity sites are cached, not only the default ones.
+	if n := len(index.cache.startOffsets); n != 11 {
+		t.Errorf("%d records cached instead of 11", n)
+	}
+	for i := 0; i < fixture.tables.rpps.numKeys; i++ {
+		rpps := string(fixture.tables.rpps.key(i))
+		if got, expected := queryRecord(t, index, rpps), queryRecord(t, fixture, rpps); got != expected {
+			t.Errorf("got cached record %+v, expected %+v", got, expected)
+		}
+	}
+	if _, ok := index.cache.record(1); ok {
+		t.Errorf("found a cached record in the middle of a line")
+	}
+}
+
+// writeBenchmarkDataFile writes a data file with numPeople people, made by the synthetic data
+// generator, and returns its path.
+func writeBenchmarkDataFile(tb testing.TB, numPeople int) (string, []synthetic.Person) {
+	dir, err := ioutil.TempDir("", "doctorsearch-synthetic")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	filePath := filepath.Join(dir, "PS_LibreAcces_Personne_activite_synthetic.txt")
+	f, err := os.Create(filePath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	people, err := synthetic.Write(f, synthetic.Config{NumPeople: numPeople, Seed: 1})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return filePath, people
+}
+
+// benchmarkQueries are typical queries for the synthetic data.
+var benchmarkQueries = []string{"pierre martin", "sophie bernardet", "durand", "lefebvre isabelle", "michel 75016", "10000001234"}
+
+// BenchmarkConcurrentQueries compares the throughput of queries reading records from the data
+// file and from the record cache, with as many concurrent queries as the server allows.
+func BenchmarkConcurrentQueries(b *testing.B) {
+	// The MaxDoctorSearchConcurrentQueries of the server.
+	const maxConcurrentQueries = 100
+	dataFilePath, _ := writeBenchmarkDataFile(b, 20000)
+
+	for _, cacheRecords := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%t", cacheRecords), func(b *testing.B) {
+			f, err := os.Open(dataFilePath)
+			if err != nil {
+				b.Fatal(err)
+			}
+			options := fixtureIndexOptions
+			options.cacheRecords = cacheRecords
+			index, err := newNGramsIndex(f, options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer index.Close()
+
+			b.SetParallelism((maxConcurrentQueries + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := index.query(context.Background(), benchmarkQueries[i%len(benchmarkQueries)], 5, 0.3, QueryOptions{}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
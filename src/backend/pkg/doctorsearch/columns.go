@@ -0,0 +1,122 @@
+package doctorsearch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// recordColumn describes a column of the data file used to fill a rawPersonActivityRecord.
+type recordColumn struct {
+	name string
+	// A data file without a required column is rejected, other columns are left empty when missing.
+	required bool
+	set      func(rec *rawPersonActivityRecord, value string)
+}
+
+// ppIdTypeColumn is the (required) column holding the type of the record's ID.
+const ppIdTypeColumn = "Type d'identifiant PP"
+
+var recordColumns = []recordColumn{
+	{"Identifiant PP", true, func(rec *rawPersonActivityRecord, v string) { rec.PPId = v }},
+	{"Libellé civilité d'exercice", false, func(rec *rawPersonActivityRecord, v string) { rec.LibelleCiviliteExercice = v }},
+	{"Nom d'exercice", true, func(rec *rawPersonActivityRecord, v string) { rec.Nom = v }},
+	{"Prénom d'exercice", true, func(rec *rawPersonActivityRecord, v string) { rec.Prenom = v }},
+	{"Code profession", true, func(rec *rawPersonActivityRecord, v string) { rec.CodeProfession = v }},
+	{"Libellé profession", false, func(rec *rawPersonActivityRecord, v string) { rec.LibelleProfession = v }},
+	{"Code catégorie professionnelle", false, func(rec *rawPersonActivityRecord, v string) { rec.CodeCategorieProfessionnelle = v }},
+	{"Code savoir-faire", true, func(rec *rawPersonActivityRecord, v string) { rec.CodeSavoirFaire = v }},
+	{"Libellé savoir-faire", false, func(rec *rawPersonActivityRecord, v string) { rec.LibelleSavoirFaire = v }},
+	{"Code mode exercice", false, func(rec *rawPersonActivityRecord, v string) { rec.CodeModeExercice = v }},
+	{"Numéro Voie (coord. structure)", false, func(rec *rawPersonActivityRecord, v string) { rec.NumeroVoie = v }},
+	{"Indice répétition voie (coord. structure)", false, func(rec *rawPersonActivityRecord, v string) { rec.IndiceRepetitionVoie = v }},
+	{"Libellé type de voie (coord. structure)", false, func(rec *rawPersonActivityRecord, v string) { rec.LibelleTypeDeVoie = v }},
+	{"Libellé Voie (coord. structure)", false, func(rec *rawPersonActivityRecord, v string) { rec.LibelleVoie = v }},
+	{"Code postal (coord. structure)", false, func(rec *rawPersonActivityRecord, v string) { rec.CodePostal = v }},
+	{"Libellé commune (coord. structure)", false, func(rec *rawPersonActivityRecord, v string) { rec.LibelleCommune = v }},
+}
+
+// columnLayout gives the position of the used columns in the lines of a data file,
+// as described by its header line.
+type columnLayout struct {
+	numColumns int
+	ppIdType   int
+	// columns holds the position of each of recordColumns, or -1 when it is missing.
+	columns []int
+}
+
+// columnKey normalizes a column name, so that minor changes to the names don't matter.
+func columnKey(name string) string {
+	return strings.ToLower(removeAccents(strings.TrimSpace(name)))
+}
+
+// parseColumnLayout reads the header line of a data file. It only fails when required
+// columns are missing, so that columns can be added or moved around in new extractions.
+func parseColumnLayout(header string) (columnLayout, error) {
+	names := strings.Split(strings.TrimPrefix(header, "\ufeff"), "|")
+	positions := make(map[string]int, len(names))
+	for i, name := range names {
+		key := columnKey(name)
+		if _, ok := positions[key]; !ok {
+			positions[key] = i
+		}
+	}
+
+	var missing []string
+	layout := columnLayout{
+		numColumns: len(names),
+		columns:    make([]int, len(recordColumns)),
+	}
+	var ok bool
+	if layout.ppIdType, ok = positions[columnKey(ppIdTypeColumn)]; !ok {
+		missing = append(missing, ppIdTypeColumn)
+	}
+	for i, column := range recordColumns {
+		position, ok := positions[columnKey(column.name)]
+		if !ok {
+			position = -1
+			if column.required {
+				missing = append(missing, column.name)
+			}
+		}
+		layout.columns[i] = position
+	}
+
+	if len(missing) != 0 {
+		return columnLayout{}, fmt.Errorf("%w: missing columns '%s'", ErrUnexpectedColumnLayout, strings.Join(missing, "', '"))
+	}
+	return layout, nil
+}
+
+// readColumnLayout reads the header line at the start of r.
+func readColumnLayout(r io.ReaderAt) (columnLayout, error) {
+	header, err := bufio.NewReader(io.NewSectionReader(r, 0, math.MaxInt64)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return columnLayout{}, err
+	}
+	return parseColumnLayout(strings.TrimRight(header, "\r\n"))
+}
+
+func (l columnLayout) parseRecord(line string) (*rawPersonActivityRecord, error) {
+	cols := strings.Split(line, "|")
+	if len(cols) != l.numColumns {
+		return nil, fmt.Errorf("%w: line has %d columns instead of %d", ErrUnexpectedColumnLayout, len(cols), l.numColumns)
+	}
+	ppIdType, err := strconv.ParseUint(cols[l.ppIdType], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &rawPersonActivityRecord{
+		PPIdType: uint8(ppIdType),
+	}
+	for i, column := range recordColumns {
+		if position := l.columns[i]; position != -1 {
+			column.set(record, cols[position])
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,131 @@
+package doctorsearch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFixtureLayout writes the fixture records with another column layout, and returns the path
+// of the written file. layout gives, for each written column, its position in the fixture or
+// -1 for a column added with the given name.
+func writeFixtureLayout(t *testing.T, layout []int, addedName string) string {
+	content, err := ioutil.ReadFile(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	for i, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		cols := strings.Split(line, "|")
+		newCols := make([]string, len(layout))
+		for j, position := range layout {
+			if position != -1 {
+				newCols[j] = cols[position]
+			} else if i == 0 {
+				newCols[j] = addedName
+			} else {
+				newCols[j] = "?"
+			}
+		}
+		out.WriteString(strings.Join(newCols, "|") + "\n")
+	}
+
+	filePath := filepath.Join(tmpDir(t), filepath.Base(fixtureFilePath))
+	if err := ioutil.WriteFile(filePath, []byte(out.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func queryRecord(t *testing.T, index *nGramsIndex, rpps string) rawPersonActivityRecord {
+	t.Helper()
+	res, err := index.query(context.Background(), rpps, 1, 0.3, QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.orderedRecords) != 1 {
+		t.Fatalf("no record found for RPPS %s", rpps)
+	}
+	return res.orderedRecords[0]
+}
+
+func TestColumnLayouts(t *testing.T) {
+	fixture := newFixtureIndex(t)
+
+	current := make([]int, 53)
+	for i := range current {
+		current[i] = i
+	}
+	// Older extractions had fewer columns, e.g. no national ID nor sector of activity.
+	var older []int
+	for i := range current {
+		if i != 2 && (i < 48 || i > 51) {
+			older = append(older, i)
+		}
+	}
+	// New columns may be added, and existing ones moved around.
+	reordered := append([]int{1, 0, -1, 37, 35}, current[2:35]...)
+	reordered = append(reordered, current[38:]...)
+	reordered = append(reordered, 36)
+
+	layouts := []struct {
+		name   string
+		layout []int
+	}{
+		{"current", current},
+		{"older", older},
+		{"reordered", reordered},
+	}
+	for _, l := range layouts {
+		f, err := os.Open(writeFixtureLayout(t, l.layout, "Nouvelle colonne"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := newNGramsIndex(f, fixtureIndexOptions)
+		if err != nil {
+			t.Fatalf("%s layout: %s", l.name, err)
+		}
+		defer index.Close()
+
+		if index.numRecords != fixture.numRecords {
+			t.Errorf("%s layout: %d records indexed instead of %d", l.name, index.numRecords, fixture.numRecords)
+		}
+		for i := 0; i < fixture.tables.rpps.numKeys; i++ {
+			rpps := string(fixture.tables.rpps.key(i))
+			if got, expected := queryRecord(t, index, rpps), queryRecord(t, fixture, rpps); got != expected {
+				t.Errorf("%s layout: got record %+v, expected %+v", l.name, got, expected)
+			}
+		}
+	}
+}
+
+func TestColumnLayoutMissingColumns(t *testing.T) {
+	content, err := ioutil.ReadFile(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := strings.SplitN(string(content), "\n", 2)[0]
+
+	// Optional columns are left empty.
+	layout, err := parseColumnLayout(strings.Replace(header, "Code postal (coord. structure)", "Code postal", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := layout.parseRecord(strings.SplitN(string(content), "\n", 3)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.CodePostal != "" || record.LibelleCommune == "" {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	// Required columns are not.
+	_, err = parseColumnLayout(strings.Replace(header, "Code profession|", "Profession|", 1))
+	if !errors.Is(err, ErrUnexpectedColumnLayout) || !strings.Contains(err.Error(), "Code profession") {
+		t.Errorf("got error %v, expected a missing column", err)
+	}
+}
@@ -0,0 +1,112 @@
+package doctorsearch
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// damerauLevenshtein returns the edit distance between a and b, counting insertions, deletions,
+// substitutions and transpositions of adjacent characters.
+//
+// This is the "optimal string alignment" variant: a substring can't be edited more than once.
+func damerauLevenshtein(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	// d[i][j] is the distance between the first i runes of a and the first j runes of b.
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(
+				d[i-1][j]+1,      // deletion
+				d[i][j-1]+1,      // insertion
+				d[i-1][j-1]+cost, // substitution
+			)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				// transposition
+				if t := d[i-2][j-2] + cost; t < d[i][j] {
+					d[i][j] = t
+				}
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func min3(a, b, c int) int {
+	m := a
+	if b < m {
+		m = b
+	}
+	if c < m {
+		m = c
+	}
+	return m
+}
+
+// nameDistance returns how far the query tokens are from a doctor's last and first names.
+//
+// As users type names in any order, both pairings of the first two query tokens with
+// (last name, first name) are tried, and the best one is kept.
+// Any further query token is paired with whichever name is closest.
+//
+// When lastIsPrefix is true, the last query token is only compared to the start of names,
+// as users are still typing it.
+func nameDistance(queryTokens []string, lastName string, firstName string, lastIsPrefix bool) int {
+	lastName = strings.ToLower(removeAccents(lastName))
+	firstName = strings.ToLower(removeAccents(firstName))
+
+	best := -1
+	for _, names := range [2][2]string{{lastName, firstName}, {firstName, lastName}} {
+		total := 0
+		for i, token := range queryTokens {
+			prefix := lastIsPrefix && i == len(queryTokens)-1
+			if i < len(names) {
+				total += tokenDistance(token, names[i], prefix)
+			} else {
+				total += minInt(tokenDistance(token, names[0], prefix), tokenDistance(token, names[1], prefix))
+			}
+		}
+		if best == -1 || total < best {
+			best = total
+		}
+	}
+	return best
+}
+
+// tokenDistance returns the edit distance between a query token and a name,
+// or the start of the name when the token is a prefix.
+func tokenDistance(token string, name string, prefix bool) int {
+	if prefix {
+		if runes := []rune(name); len(runes) > utf8.RuneCountInString(token) {
+			name = string(runes[:utf8.RuneCountInString(token)])
+		}
+	}
+	return damerauLevenshtein(token, name)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,42 @@
+package doctorsearch
+
+import "testing"
+
+func TestDamerauLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"martin", "martin", 0},
+		{"martin", "", 6},
+		{"lefevre", "lefebvre", 1},
+		{"lefevre", "lefevrier", 2},
+		{"matrin", "martin", 1},
+		{"hélène", "helene", 2},
+		{"ca", "abc", 3},
+	}
+	for _, test := range tests {
+		if d := damerauLevenshtein(test.a, test.b); d != test.expected {
+			t.Errorf("distance between '%s' and '%s' = %d, expected %d", test.a, test.b, d, test.expected)
+		}
+	}
+}
+
+func TestNameDistance(t *testing.T) {
+	if d := nameDistance([]string{"pierre", "martin"}, "MARTIN", "Pierre", false); d != 0 {
+		t.Errorf("distance = %d, expected 0 whatever the order of names", d)
+	}
+	if d := nameDistance([]string{"helene", "dupont"}, "DUPONT", "Hélène", false); d != 0 {
+		t.Errorf("distance = %d, expected 0 when ignoring accents", d)
+	}
+	if d := nameDistance([]string{"dupont"}, "DUPONT", "Hélène", false); d != 0 {
+		t.Errorf("distance = %d, expected 0 for a single name", d)
+	}
+	if d := nameDistance([]string{"pierre", "mar"}, "MARTINEZ", "Pierre", true); d != 0 {
+		t.Errorf("distance = %d, expected 0 for a prefix of a name", d)
+	}
+	if d := nameDistance([]string{"pierre", "mar"}, "MARTINEZ", "Pierre", false); d != 5 {
+		t.Errorf("distance = %d, expected 5 for a whole name", d)
+	}
+}
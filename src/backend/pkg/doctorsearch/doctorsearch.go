@@ -2,10 +2,13 @@ package doctorsearch
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -19,76 +22,308 @@ import (
 var (
 	ErrTemporarilyUnavailable = errors.New("busy creating index")
 	ErrInvalidUserQuery       = errors.New("invalid user query")
+	ErrNoPreviousData         = errors.New("no previous data file to roll back to")
+	ErrUnexpectedColumnLayout = errors.New("unexpected data file column layout")
+	ErrRejectedUpdate         = errors.New("rejected suspicious data file update")
 )
 
 func isMn(r rune) bool {
 	return unicode.Is(unicode.Mn, r) // Mn: nonspacing marks
 }
 
-var removeAccentsTransformer = transform.Chain(norm.NFD, transform.RemoveFunc(isMn), norm.NFC)
+// removeAccents returns s without any diacritics, e.g. "é" becomes "e".
+func removeAccents(s string) string {
+	// Transformers hold state, so a new one is needed for each (possibly concurrent) use.
+	removeAccentsTransformer := transform.Chain(norm.NFD, transform.RemoveFunc(isMn), norm.NFC)
+	r, _, err := transform.String(removeAccentsTransformer, s)
+	if err != nil {
+		return s
+	}
+	return r
+}
 
 type DoctorRecord struct {
 	RPPSNumber string `json:"rpps"`
 	FullName   string `json:"name"`
 	Address    string `json:"address"`
+
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	// Profession is the label of the profession, e.g. "Médecin" or "Chirurgien-Dentiste".
+	Profession string `json:"profession"`
+	// Title is the honorific used by the doctor, e.g. "Docteur".
+	Title     string `json:"title"`
+	Specialty string `json:"specialty"`
+	// ExerciseMode is one of "libéral", "salarié" or "bénévole", or empty when unknown.
+	ExerciseMode string `json:"exercise_mode"`
+	PostalCode   string `json:"postal_code"`
+	Commune      string `json:"commune"`
+
+	// Sites lists the addresses where the doctor practices, starting with the default one
+	// (whose details are also the ones above).
+	Sites []DoctorSite `json:"sites"`
+
+	// MatchedFields lists which of "rpps", "name", "postal_code" and "commune" matched the query.
+	MatchedFields []string `json:"matched_fields"`
+}
+
+// DoctorSite is an address where a doctor practices.
+type DoctorSite struct {
+	Address      string `json:"address"`
+	ExerciseMode string `json:"exercise_mode"`
+	PostalCode   string `json:"postal_code"`
+	Commune      string `json:"commune"`
+}
+
+// doctorSites returns the distinct addresses of the activity sites of a person.
+func doctorSites(records []rawPersonActivityRecord) []DoctorSite {
+	sites := make([]DoctorSite, 0, len(records))
+	seen := make(map[string]bool, len(records))
+	for i := range records {
+		address := records[i].Address()
+		if address == "" || seen[address] {
+			continue
+		}
+		seen[address] = true
+		sites = append(sites, DoctorSite{
+			Address:      address,
+			ExerciseMode: records[i].ExerciseMode(),
+			PostalCode:   records[i].PostalCode(),
+			Commune:      records[i].Commune(),
+		})
+	}
+	return sites
 }
 
 type DoctorSearcher interface {
-	Query(context.Context, string, int) ([]DoctorRecord, error)
+	Query(context.Context, string, int, QueryOptions) ([]DoctorRecord, error)
 	QueryTimeout() time.Duration
+	// TriggerUpdate asks for the doctor data to be updated from its source as soon as possible.
+	TriggerUpdate()
+	// Status describes the doctor data in use, and the last update.
+	Status() Status
+	// Rollback goes back to using the doctor data which was replaced by the last update.
+	Rollback() error
+	// Stats describes the queries being serviced, and the switches to new doctor data.
+	Stats() Stats
+}
+
+// Status describes the doctor data in use, and the last update.
+type Status struct {
+	IndexCreatedAt time.Time `json:"index_created_at"`
+	NumRecords     int       `json:"num_records"`
+	// DataFileSHA256 is the hex encoded hash of the data file.
+	DataFileSHA256 string `json:"data_file_sha256"`
+	// LastUpdateAttempt is the zero time if no update was attempted since startup.
+	LastUpdateAttempt time.Time `json:"last_update_attempt"`
+	// LastUpdateError is empty if the last update succeeded, or found no new data.
+	LastUpdateError string `json:"last_update_error"`
+	CanRollback     bool   `json:"can_rollback"`
+	// RejectedUpdates counts the updates rejected since startup because the new data
+	// looked suspicious, the reasons of the last rejection being in LastUpdateError.
+	RejectedUpdates int `json:"rejected_updates"`
+}
+
+// Stats describes the queries being serviced, and the switches to new doctor data.
+// Counters are since startup.
+type Stats struct {
+	MaxConcurrentQueries int64 `json:"max_concurrent_queries"`
+	InFlightQueries      int64 `json:"in_flight_queries"`
+	// InFlightQueriesOnOldIndex are queries started before the last index switch, which
+	// the old index is kept open for.
+	InFlightQueriesOnOldIndex int64 `json:"in_flight_queries_on_old_index"`
+	// WaitingQueries are waiting for the number of in-flight queries to go below the maximum.
+	WaitingQueries int64 `json:"waiting_queries"`
+
+	IndexSwaps int64 `json:"index_swaps"`
+	// DelayedIndexSwaps counts new indexes which could not be used straight away, as queries
+	// were still running on the old index. They are used once those queries are done.
+	DelayedIndexSwaps int64 `json:"delayed_index_swaps"`
+	// DroppedIndexSwaps counts delayed new indexes which were replaced by a newer one before
+	// being used.
+	DroppedIndexSwaps int64 `json:"dropped_index_swaps"`
+	// PendingIndexSwap is whether a new index is waiting to be used.
+	PendingIndexSwap bool `json:"pending_index_swap"`
+
+	Acquires int64 `json:"acquires"`
+	// AcquireTimeouts counts the queries which gave up waiting, usually because of too many
+	// concurrent queries.
+	AcquireTimeouts  int64         `json:"acquire_timeouts"`
+	AcquireWaitTotal time.Duration `json:"acquire_wait_total_ns"`
+	AcquireWaitMax   time.Duration `json:"acquire_wait_max_ns"`
+}
+
+// searcherState is shared by all copies of a drSearcher.
+type searcherState struct {
+	// filesMu is held while the data files are being replaced, or verified.
+	filesMu sync.Mutex
+
+	mu     sync.Mutex
+	status Status
+	// index is the one in use, which new indexes are checked against before being used.
+	index *nGramsIndex
+}
+
+func (s *searcherState) indexUsed(index *nGramsIndex) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index = index
+	s.status.IndexCreatedAt = index.header.createdAt
+	s.status.NumRecords = index.numRecords
+	s.status.DataFileSHA256 = hex.EncodeToString(index.header.dataFileSHA256[:])
+}
+
+func (s *searcherState) currentIndex() *nGramsIndex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index
+}
+
+func (s *searcherState) updateAttempted(t time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LastUpdateAttempt = t
+	s.status.LastUpdateError = ""
+	if err != nil {
+		s.status.LastUpdateError = err.Error()
+	}
+	if errors.Is(err, ErrRejectedUpdate) {
+		s.status.RejectedUpdates++
+	}
+}
+
+// Config holds the settings of a DoctorSearcher.
+type Config struct {
+	NGramSize int
+	// MaxUserQueryLength is measured in bytes (and not in runes i.e characteres).
+	MaxUserQueryLength   int
+	MaxConcurrentQueries int
+	MaxQueryDuration     time.Duration
+	// MinSimilarity is the minimum share (between 0.0 and 1.0) of the query's ngrams that a record
+	// must contain to be part of the results.
+	MinSimilarity float32
+	// Professions selects the records to index. When nil, DefaultProfessionFilters is used.
+	Professions []ProfessionFilter
+	// PhoneticMatching makes names which sound like the query match it too, e.g. "Filipe"
+	// for "Philippe", although not as well as names spelled like the query.
+	PhoneticMatching bool
+	// CacheRecords keeps the indexed records in memory, instead of reading the results of
+	// each query from the data file.
+	CacheRecords bool
+
+	// UpdateSource provides new data files. When nil, the data file is never updated.
+	UpdateSource UpdateSource
+	// UpdatePeriod is the delay between updates. When 0, updates only happen when triggered.
+	UpdatePeriod time.Duration
+	// UpdateMinPeriod is the delay before trying again after a failed update.
+	UpdateMinPeriod time.Duration
+	// UpdatePeriodJitter is a percentage of the above periods, expressed between 0.0 and 1.0
+	UpdatePeriodJitter float32
+	// UpdateMinRecordsRatio is the minimum number of records of new data, relative to the data
+	// in use (between 0.0 and 1.0), for an update to be accepted. It is also the minimum share
+	// of a sample of the RPPS numbers in use which must still be present in the new data.
+	// When 0, those checks are disabled.
+	UpdateMinRecordsRatio float32
 }
 
 type drSearcher struct {
 	indexControl       indexControl
+	indexUpdater       *indexUpdater
+	state              *searcherState
 	dataFilePath       string
-	nGramSize          int
+	indexOptions       indexOptions
 	maxUserQueryLength int
 	maxQueryDuration   time.Duration
+	minSimilarity      float32
 }
 
 // New returns a DoctorSearcher capable of servicing user queries.
-//
-// Note that maxUserQueryLength is measured in bytes (and not in runes i.e characteres).
-func New(rawDataFilePath string, nGramSize int, maxUserQueryLength int, maxConcurrentQueries int, maxQueryDuration time.Duration, indexUpdatePeriod time.Duration, indexUpdateMinPeriod time.Duration, indexUpdatePeriodJitter float32) DoctorSearcher {
+func New(rawDataFilePath string, config Config) DoctorSearcher {
+	professions := config.Professions
+	if professions == nil {
+		professions = DefaultProfessionFilters
+	}
 	dr := &drSearcher{
-		indexControl:       NewIndexControl(maxConcurrentQueries),
-		dataFilePath:       filepath.Clean(rawDataFilePath),
-		nGramSize:          nGramSize,
-		maxUserQueryLength: maxUserQueryLength,
-		maxQueryDuration:   maxQueryDuration,
+		indexControl: NewIndexControl(config.MaxConcurrentQueries),
+		state:        &searcherState{},
+		dataFilePath: filepath.Clean(rawDataFilePath),
+		indexOptions: indexOptions{
+			nGramSize:    config.NGramSize,
+			professions:  professions,
+			phonetic:     config.PhoneticMatching,
+			cacheRecords: config.CacheRecords,
+		},
+		maxUserQueryLength: config.MaxUserQueryLength,
+		maxQueryDuration:   config.MaxQueryDuration,
+		minSimilarity:      config.MinSimilarity,
+	}
+	if config.UpdateSource != nil {
+		dr.indexUpdater = newIndexUpdater(config)
 	}
 
 	// Launch background worker that attempts to create an index straight away,
 	// from an existing data file.
 	// The worker then runs the index update loop.
 	go func() {
-		index, err := buildIndex(dr.dataFilePath, dr.nGramSize)
+		index, err := buildIndex(dr.dataFilePath, dr.indexOptions)
 
 		firstUpdate := NormalUpdate
 		if err != nil {
 			firstUpdate = FastUpdate
 		} else {
-			dr.indexControl.UseIndex(index)
-		}
+			dr.useIndex(index)
 
-		if indexUpdatePeriod != 0 {
-			iu := indexUpdater{
-				updatePeriod:       indexUpdatePeriod,
-				updateMinPeriod:    indexUpdateMinPeriod,
-				updatePeriodJitter: indexUpdatePeriodJitter,
+			// Now that queries can use the index, check that it was not loaded from a stale index file.
+			dr.state.filesMu.Lock()
+			if rebuilt, err := verifyIndex(index, dr.dataFilePath, dr.indexOptions); err != nil {
+				log.Error().Msgf("error verifying index: %s", err)
+			} else if rebuilt != nil {
+				dr.useIndex(rebuilt)
 			}
-			iu.Start(firstUpdate, dr)
+			dr.state.filesMu.Unlock()
+		}
+
+		if dr.indexUpdater != nil {
+			dr.indexUpdater.Start(firstUpdate, dr)
 		}
 	}()
 
 	return dr
 }
 
+// useIndex starts using index for queries.
+func (dr *drSearcher) useIndex(index *nGramsIndex) {
+	dr.indexControl.UseIndex(index)
+	dr.state.indexUsed(index)
+}
+
+func (dr *drSearcher) Status() Status {
+	dr.state.mu.Lock()
+	status := dr.state.status
+	dr.state.mu.Unlock()
+
+	_, err := os.Stat(previousDataFilePath(dr.dataFilePath))
+	status.CanRollback = err == nil
+	return status
+}
+
+func (dr drSearcher) Stats() Stats {
+	return dr.indexControl.Stats()
+}
+
+func (dr drSearcher) TriggerUpdate() {
+	if dr.indexUpdater == nil {
+		log.Warn().Msg("no update source configured, ignoring update trigger")
+		return
+	}
+	dr.indexUpdater.Trigger()
+}
+
 func (dr drSearcher) QueryTimeout() time.Duration {
 	return dr.maxQueryDuration
 }
 
-func (dr drSearcher) Query(ctx context.Context, unsafeUserQuery string, maxNumberResults int) ([]DoctorRecord, error) {
+func (dr drSearcher) Query(ctx context.Context, unsafeUserQuery string, maxNumberResults int, options QueryOptions) ([]DoctorRecord, error) {
 	start := time.Now()
 	defer func() {
 		log.Trace().
@@ -106,13 +341,23 @@ func (dr drSearcher) Query(ctx context.Context, unsafeUserQuery string, maxNumbe
 		return nil, fmt.Errorf("%w, query (%d bytes) was not valid utf-8", ErrInvalidUserQuery, len(unsafeUserQuery))
 	}
 
-	normalizedNoAccentQuery, _, err := transform.String(removeAccentsTransformer, unsafeUserQuery)
-	if err != nil {
-		return nil, fmt.Errorf("%w, query normalization and accent removal failed", ErrInvalidUserQuery)
+	normalizedNoAccentQuery := removeAccents(unsafeUserQuery)
+
+	// A query ending with a space has a complete last word.
+	if options.Prefix && strings.TrimRightFunc(normalizedNoAccentQuery, unicode.IsSpace) != normalizedNoAccentQuery {
+		options.Prefix = false
+	}
+	// In prefix mode, the start of a name is padded with a single space, so it can be shorter.
+	minQueryLength := dr.indexOptions.nGramSize
+	if options.Prefix {
+		minQueryLength -= 1
+	}
+	if utf8.RuneCountInString(strings.TrimSpace(normalizedNoAccentQuery)) < minQueryLength {
+		return nil, fmt.Errorf("%w, minimum query length is %d", ErrInvalidUserQuery, minQueryLength)
 	}
 
-	if utf8.RuneCountInString(normalizedNoAccentQuery) < dr.nGramSize {
-		return nil, fmt.Errorf("%w, minimum query length is %d", ErrInvalidUserQuery, dr.nGramSize)
+	if options.Profession != "" && !dr.indexesProfession(options.Profession) {
+		return nil, fmt.Errorf("%w, profession '%s' is not indexed", ErrInvalidUserQuery, options.Profession)
 	}
 
 	// Limit the number of concurrent queries.
@@ -126,7 +371,7 @@ func (dr drSearcher) Query(ctx context.Context, unsafeUserQuery string, maxNumbe
 		return nil, ErrTemporarilyUnavailable
 	}
 
-	records, err := storedIndex.query(ctx, normalizedNoAccentQuery, maxNumberResults)
+	records, err := storedIndex.query(ctx, normalizedNoAccentQuery, maxNumberResults, dr.minSimilarity, options)
 	if err != nil {
 		return nil, err
 	}
@@ -137,6 +382,18 @@ func (dr drSearcher) Query(ctx context.Context, unsafeUserQuery string, maxNumbe
 			RPPSNumber: rec.RPPS(),
 			FullName:   rec.FullName(),
 			Address:    rec.Address(),
+
+			FirstName:    rec.FirstName(),
+			LastName:     rec.LastName(),
+			Profession:   rec.Profession(),
+			Title:        rec.Title(),
+			Specialty:    rec.Specialty(),
+			ExerciseMode: rec.ExerciseMode(),
+			PostalCode:   rec.PostalCode(),
+			Commune:      rec.Commune(),
+			Sites:        doctorSites(records.sites[i]),
+
+			MatchedFields: records.matches[i].Names(),
 		}
 		results[i] = result
 	}
@@ -144,17 +401,103 @@ func (dr drSearcher) Query(ctx context.Context, unsafeUserQuery string, maxNumbe
 	return results, nil
 }
 
+func (dr drSearcher) indexesProfession(code string) bool {
+	for _, filter := range dr.indexOptions.professions {
+		if filter.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIndex hashes the data file at dataFilePath if index was loaded from an index file, as the
+// size and modification time of the data file are not enough to tell it changed, e.g. when it is
+// restored from a backup. This reads the whole data file, so it is not done when loading the index.
+//
+// If the index file is stale, it is removed and another index is returned. Otherwise nil is returned.
+func verifyIndex(index *nGramsIndex, dataFilePath string, options indexOptions) (*nGramsIndex, error) {
+	if !index.loaded {
+		return nil, nil
+	}
+	sum, err := fileSHA256(dataFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if sum == index.header.dataFileSHA256 {
+		return nil, nil
+	}
+
+	log.Warn().Msgf("index file of %s was created from another data file, creating the index again", dataFilePath)
+	if err := os.Remove(indexFilePath(dataFilePath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return buildIndex(dataFilePath, options)
+}
+
 // buildIndex creates an index using the data file at path dataFilePath.
-func buildIndex(dataFilePath string, nGramSize int) (*nGramsIndex, error) {
+//
+// The index is stored in a file next to the data file, which is used instead
+// of scanning the data file again when it is up to date.
+func buildIndex(dataFilePath string, options indexOptions) (*nGramsIndex, error) {
 	databaseFile, err := os.Open(dataFilePath)
 	if err != nil {
 		log.Error().Msgf("error opening index data file %s", err)
 		return nil, err
 	}
+	fi, err := databaseFile.Stat()
+	if err != nil {
+		databaseFile.Close()
+		log.Error().Msgf("error opening index data file %s", err)
+		return nil, err
+	}
+	expectedHeader := dataFileHeader(fi, options)
+	indexPath := indexFilePath(dataFilePath)
 
 	start := time.Now()
-	index, err := newNGramsIndex(databaseFile, nGramSize)
+	data, releaseData, err := loadIndexFile(indexPath, expectedHeader)
+	if err == nil {
+		index, err := newNGramsIndexFromData(databaseFile, data, releaseData, options.cacheRecords)
+		if err != nil {
+			releaseData()
+			databaseFile.Close()
+			return nil, err
+		}
+		index.loaded = true
+		log.Info().
+			Dur("load_duration", time.Since(start)).
+			Int("records", index.numRecords).
+			Int("index_entries", index.tables.ngrams.numKeys).
+			Msg("loaded doctor search index file")
+		return index, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("could not use index file %s: %s", indexPath, err)
+	}
+
+	builder, header, err := scanRecords(databaseFile, options)
+	if err != nil {
+		databaseFile.Close()
+		log.Error().Msgf("error creating index %s", err)
+		return nil, err
+	}
+	header.dataFileSize = expectedHeader.dataFileSize
+	header.dataFileModTime = expectedHeader.dataFileModTime
+	header.createdAt = time.Now()
+	data = encodeIndex(header, builder)
+	releaseData = func() error { return nil }
+
+	// Prefer using the index file, so that the index data is not kept in the heap.
+	if err := writeIndexFile(indexPath, data); err != nil {
+		log.Warn().Msgf("error writing index file, keeping index in memory: %s", err)
+	} else if mappedData, releaseMappedData, err := loadIndexFile(indexPath, expectedHeader); err != nil {
+		log.Warn().Msgf("error loading written index file, keeping index in memory: %s", err)
+	} else {
+		data, releaseData = mappedData, releaseMappedData
+	}
+
+	index, err := newNGramsIndexFromData(databaseFile, data, releaseData, options.cacheRecords)
 	if err != nil {
+		releaseData()
+		databaseFile.Close()
 		log.Error().Msgf("error creating index %s", err)
 		return nil, err
 	}
@@ -162,7 +505,7 @@ func buildIndex(dataFilePath string, nGramSize int) (*nGramsIndex, error) {
 	log.Info().
 		Dur("create_duration", time.Since(start)).
 		Int("records", index.numRecords).
-		Int("index_entries", len(index.underlyingIndex)).
+		Int("index_entries", index.tables.ngrams.numKeys).
 		Msg("created doctor search index")
 
 	return index, nil
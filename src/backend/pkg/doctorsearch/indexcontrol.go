@@ -2,6 +2,8 @@ package doctorsearch
 
 import (
 	"context"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -9,37 +11,58 @@ import (
 type indexControl struct {
 	indexes            [2]*nGramsIndex
 	numInFlightQueries [2]int64
+	// pendingIndex is a new index waiting for the queries on the old index to be done,
+	// before it replaces the current index.
+	pendingIndex *nGramsIndex
 
 	maxConcurrentQueries int64
+	numSwaps             int64
+	numDelayedSwaps      int64
+	numDroppedSwaps      int64
+	// acquireCounters are shared by all copies of the indexControl, as they are updated by
+	// the queries themselves.
+	acquireCounters *acquireCounters
 
 	acquireChan    chan *nGramsIndex
 	releaseChan    chan *nGramsIndex
 	signalNewIndex chan *nGramsIndex
+	statsRequests  chan chan Stats
+}
+
+type acquireCounters struct {
+	numAcquires    int64
+	numTimeouts    int64
+	totalWaitNanos int64
+	maxWaitNanos   int64
+	numWaiting     int64
 }
 
 func NewIndexControl(maxConcurrentQueries int) indexControl {
 	ic := indexControl{
-		acquireChan:          make(chan *nGramsIndex),
-		releaseChan:          make(chan *nGramsIndex),
-		signalNewIndex:       make(chan *nGramsIndex, 1),
+		acquireChan: make(chan *nGramsIndex),
+		releaseChan: make(chan *nGramsIndex),
+		// Not buffered, so that a new index is taken into account as soon as UseIndex returns.
+		signalNewIndex:       make(chan *nGramsIndex),
+		statsRequests:        make(chan chan Stats),
 		maxConcurrentQueries: int64(maxConcurrentQueries),
+		acquireCounters:      &acquireCounters{},
 	}
 	go ic.start()
 	return ic
 }
 
-func (ic *indexControl) start() {
-	const (
-		CurrentIndex = 0
-		OldIndex     = 1
-	)
+const (
+	currentIndex = 0
+	oldIndex     = 1
+)
 
+func (ic *indexControl) start() {
 	var (
 		totalInFlightQueries int64
 		acqChan              = ic.acquireChan
 	)
 	for {
-		totalInFlightQueries = ic.numInFlightQueries[CurrentIndex] + ic.numInFlightQueries[OldIndex]
+		totalInFlightQueries = ic.numInFlightQueries[currentIndex] + ic.numInFlightQueries[oldIndex]
 		if totalInFlightQueries >= ic.maxConcurrentQueries {
 			// A nil channel is never ready, so this effectively switches off
 			// the "acquire case", acting as a limit on the number of outstanding
@@ -49,63 +72,126 @@ func (ic *indexControl) start() {
 			acqChan = ic.acquireChan
 		}
 		select {
-		case acqChan <- ic.indexes[CurrentIndex]:
-			ic.numInFlightQueries[CurrentIndex] += 1
+		case acqChan <- ic.indexes[currentIndex]:
+			ic.numInFlightQueries[currentIndex] += 1
 		case releasedIndex := <-ic.releaseChan:
-			if releasedIndex == nil {
-				continue
-			} else if releasedIndex == ic.indexes[CurrentIndex] {
-				ic.numInFlightQueries[CurrentIndex] -= 1
+			// Queries may have acquired no index at all (nil), before the first index was used.
+			if releasedIndex == ic.indexes[currentIndex] {
+				ic.numInFlightQueries[currentIndex] -= 1
 			} else {
-				ic.numInFlightQueries[OldIndex] -= 1
+				ic.numInFlightQueries[oldIndex] -= 1
 				// If no more queries are in-flight on the old index,
 				// it means we can safely signal clean it up.
-				if ic.numInFlightQueries[OldIndex] == 0 {
+				if ic.numInFlightQueries[oldIndex] == 0 {
 					ic.cleanupOldIndex()
+					if ic.pendingIndex != nil {
+						ic.swap(ic.pendingIndex)
+						ic.pendingIndex = nil
+					}
 				}
 			}
 		case newIndex := <-ic.signalNewIndex:
-			if ic.indexes[OldIndex] != nil {
-				// TOOD: kind of a logic/temporal error, this shouldnt happen
-				// reject the index, too bad...
+			if ic.numInFlightQueries[oldIndex] == 0 {
+				ic.swap(newIndex)
 				continue
 			}
 
-			ic.indexes[OldIndex], ic.indexes[CurrentIndex] = ic.indexes[CurrentIndex], newIndex
-			ic.numInFlightQueries[OldIndex] = ic.numInFlightQueries[CurrentIndex]
-
-			log.Info().Msg("switched active index")
-
-			// If no queries are outstanding on the old index, we can clean it up straight away.
-			if ic.numInFlightQueries[OldIndex] == 0 {
-				ic.cleanupOldIndex()
+			// The current index can't become the old one while queries are still running on
+			// the old one, so the new index waits for them to be done. Only the latest new
+			// index is kept waiting.
+			ic.numDelayedSwaps += 1
+			if ic.pendingIndex != nil {
+				ic.numDroppedSwaps += 1
+				ic.pendingIndex.Close()
+				log.Warn().Msg("dropped pending index, replaced by a newer one")
 			}
+			ic.pendingIndex = newIndex
+			log.Warn().
+				Int64("in_flight_queries", ic.numInFlightQueries[oldIndex]).
+				Msg("old index still in use, delaying index switch")
+		case reply := <-ic.statsRequests:
+			reply <- ic.stats()
 		}
 	}
 }
 
-func (ic *indexControl) cleanupOldIndex() {
-	const OldIndex = 1
+// swap makes newIndex the current index, the current index becoming the old one.
+// There must be no queries in-flight on the old index.
+func (ic *indexControl) swap(newIndex *nGramsIndex) {
+	ic.indexes[oldIndex], ic.indexes[currentIndex] = ic.indexes[currentIndex], newIndex
+	ic.numInFlightQueries[oldIndex] = ic.numInFlightQueries[currentIndex]
+	ic.numInFlightQueries[currentIndex] = 0
+	ic.numSwaps += 1
+
+	log.Info().Msg("switched active index")
 
-	oldIndex := ic.indexes[OldIndex]
-	if oldIndex != nil {
-		oldIndex.Close()
+	// If no queries are outstanding on the old index, we can clean it up straight away.
+	if ic.numInFlightQueries[oldIndex] == 0 {
+		ic.cleanupOldIndex()
 	}
-	ic.indexes[OldIndex] = nil
-	ic.numInFlightQueries[OldIndex] = 0
+}
+
+func (ic *indexControl) cleanupOldIndex() {
+	index := ic.indexes[oldIndex]
+	if index != nil {
+		index.Close()
+	}
+	ic.indexes[oldIndex] = nil
+	ic.numInFlightQueries[oldIndex] = 0
 
 	log.Info().Msg("cleaned-up old index")
 }
 
+func (ic *indexControl) stats() Stats {
+	return Stats{
+		MaxConcurrentQueries:      ic.maxConcurrentQueries,
+		InFlightQueries:           ic.numInFlightQueries[currentIndex],
+		InFlightQueriesOnOldIndex: ic.numInFlightQueries[oldIndex],
+		WaitingQueries:            atomic.LoadInt64(&ic.acquireCounters.numWaiting),
+		IndexSwaps:                ic.numSwaps,
+		DelayedIndexSwaps:         ic.numDelayedSwaps,
+		DroppedIndexSwaps:         ic.numDroppedSwaps,
+		PendingIndexSwap:          ic.pendingIndex != nil,
+		Acquires:                  atomic.LoadInt64(&ic.acquireCounters.numAcquires),
+		AcquireTimeouts:           atomic.LoadInt64(&ic.acquireCounters.numTimeouts),
+		AcquireWaitTotal:          time.Duration(atomic.LoadInt64(&ic.acquireCounters.totalWaitNanos)),
+		AcquireWaitMax:            time.Duration(atomic.LoadInt64(&ic.acquireCounters.maxWaitNanos)),
+	}
+}
+
+// Stats returns the counters of the indexControl.
+func (ic *indexControl) Stats() Stats {
+	reply := make(chan Stats)
+	ic.statsRequests <- reply
+	return <-reply
+}
+
 func (ic *indexControl) UseIndex(index *nGramsIndex) {
 	ic.signalNewIndex <- index
 }
 
 func (ic *indexControl) Acquire(ctx context.Context) (*nGramsIndex, error) {
+	counters := ic.acquireCounters
+	start := time.Now()
+	atomic.AddInt64(&counters.numWaiting, 1)
+	defer func() {
+		atomic.AddInt64(&counters.numWaiting, -1)
+		wait := int64(time.Since(start))
+		atomic.AddInt64(&counters.totalWaitNanos, wait)
+		for {
+			max := atomic.LoadInt64(&counters.maxWaitNanos)
+			if wait <= max || atomic.CompareAndSwapInt64(&counters.maxWaitNanos, max, wait) {
+				break
+			}
+		}
+	}()
+
 	select {
 	case ix := <-ic.acquireChan:
+		atomic.AddInt64(&counters.numAcquires, 1)
 		return ix, nil
 	case <-ctx.Done():
+		atomic.AddInt64(&counters.numTimeouts, 1)
 		return nil, ctx.Err()
 	}
 }
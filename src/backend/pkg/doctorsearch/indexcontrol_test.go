@@ -0,0 +1,81 @@
+package doctorsearch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func acquire(t *testing.T, ic *indexControl, expected *nGramsIndex) {
+	t.Helper()
+	index, err := ic.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != expected {
+		t.Fatalf("acquired another index than expected")
+	}
+}
+
+func TestIndexControlDelayedSwaps(t *testing.T) {
+	ic := NewIndexControl(10)
+	a, b, c, d := newFixtureIndex(t), newFixtureIndex(t), newFixtureIndex(t), newFixtureIndex(t)
+
+	// Queries may run before the first index is used.
+	acquire(t, &ic, nil)
+	ic.Release(nil)
+
+	ic.UseIndex(a)
+	acquire(t, &ic, a)
+	// a is still in use, but it's the current index so b can be used.
+	ic.UseIndex(b)
+	acquire(t, &ic, b)
+
+	// a is still in use as the old index, so c must wait, and is then replaced by d.
+	ic.UseIndex(c)
+	ic.UseIndex(d)
+	acquire(t, &ic, b)
+	stats := ic.Stats()
+	expected := Stats{
+		MaxConcurrentQueries:      10,
+		InFlightQueries:           2,
+		InFlightQueriesOnOldIndex: 1,
+		IndexSwaps:                2,
+		DelayedIndexSwaps:         2,
+		DroppedIndexSwaps:         1,
+		PendingIndexSwap:          true,
+		Acquires:                  4,
+	}
+	stats.AcquireWaitTotal, stats.AcquireWaitMax = 0, 0
+	if stats != expected {
+		t.Errorf("got stats %+v, expected %+v", stats, expected)
+	}
+
+	// Once a is released, d is used straight away.
+	ic.Release(a)
+	acquire(t, &ic, d)
+	ic.Release(b)
+	ic.Release(b)
+	ic.Release(d)
+	stats = ic.Stats()
+	if stats.IndexSwaps != 3 || stats.PendingIndexSwap || stats.InFlightQueries != 0 || stats.InFlightQueriesOnOldIndex != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestIndexControlAcquireTimeouts(t *testing.T) {
+	ic := NewIndexControl(1)
+	index := newFixtureIndex(t)
+	ic.UseIndex(index)
+	acquire(t, &ic, index)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := ic.Acquire(ctx); err == nil {
+		t.Fatalf("acquired an index above the maximum number of concurrent queries")
+	}
+	stats := ic.Stats()
+	if stats.AcquireTimeouts != 1 || stats.Acquires != 1 || stats.AcquireWaitMax < 20*time.Millisecond {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
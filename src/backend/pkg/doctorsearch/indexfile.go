@@ -0,0 +1,384 @@
+package doctorsearch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The index is stored in a file next to the data file, so that it can be memory-mapped
+// on startup instead of being created again.
+//
+// All integers are little-endian. The file starts with a fixed size header:
+//
+//	magic             [8]byte  "DQNGRAMS"
+//	version           uint32
+//	nGramSize         uint32
+//	dataFileSize      int64    size of the data file the index was created from
+//	dataFileModTime   int64    modification time (in ns since the epoch) of that data file
+//	numRecords        uint64
+//	checksum          uint32   CRC-32 (Castagnoli) of the rest of the header, and of the tables but their postings
+//	optionsChecksum   uint32   identifies the other options the index was created with
+//	dataFileSHA256    [32]byte
+//	createdAt         int64    creation time of the index, in ns since the epoch
+//
+// It is followed by the ngrams, locations, RPPS, scopes and phonetics tables, each made of:
+//
+//	numKeys           uint32
+//	keysLength        uint32   length of the keys blob, in bytes
+//	numPostings       uint32
+//	(padding)         [4]byte
+//	entries           [numKeys]{keyOffset, keyLength, firstPosting, numPostings uint32}, sorted by key
+//	keys              [keysLength]byte
+//	postings          [numPostings]{startOffset int64, length uint32}, sorted by startOffset for each key
+//
+// The postings of the RPPS table are the activity sites of a person instead, the default one
+// first, which is the one the other tables refer to.
+//
+// Postings make up most of the file, so they are not checksummed: this would read the whole file
+// on startup. They are checked when records are read instead, see checkPosting.
+const (
+	indexFileMagic      = "DQNGRAMS"
+	indexFileVersion    = 6
+	indexFileSuffix     = ".ngrams"
+	indexFileHeaderSize = 88
+
+	indexTableHeaderSize = 16
+	indexTableEntrySize  = 16
+	postingSize          = 12
+
+	// maxRecordLength is the length of the longest record that can be indexed, as records are
+	// scanned with a bufio.Scanner.
+	maxRecordLength = bufio.MaxScanTokenSize
+)
+
+var (
+	errIndexFileFormat   = errors.New("unexpected index file format")
+	errIndexFileVersion  = errors.New("unsupported index file version")
+	errIndexFileChecksum = errors.New("index file checksum mismatch")
+	errIndexFileStale    = errors.New("index file was created from another data file or with other options")
+	errIndexFilePosting  = errors.New("index file posting is out of range")
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// indexFilePath returns the path of the index file for the data file at dataFilePath.
+func indexFilePath(dataFilePath string) string {
+	return dataFilePath + indexFileSuffix
+}
+
+type indexFileHeader struct {
+	nGramSize       int
+	optionsChecksum uint32
+	dataFileSize    int64
+	dataFileModTime int64
+	numRecords      int
+	dataFileSHA256  [sha256.Size]byte
+	createdAt       time.Time
+}
+
+func dataFileHeader(fi os.FileInfo, options indexOptions) indexFileHeader {
+	return indexFileHeader{
+		nGramSize:       options.nGramSize,
+		optionsChecksum: options.checksum(),
+		dataFileSize:    fi.Size(),
+		dataFileModTime: fi.ModTime().UnixNano(),
+	}
+}
+
+// postings is a sorted list of record offsets, as stored in the index.
+type postings []byte
+
+func (p postings) Len() int {
+	return len(p) / postingSize
+}
+
+func (p postings) At(i int) DatabaseFileOffsetsRecord {
+	b := p[i*postingSize:]
+	return DatabaseFileOffsetsRecord{
+		StartOffset: int64(binary.LittleEndian.Uint64(b)),
+		Length:      binary.LittleEndian.Uint32(b[8:]),
+	}
+}
+
+// contains returns whether the postings contain a record starting at the given offset.
+func (p postings) contains(offset int64) bool {
+	n := p.Len()
+	i := sort.Search(n, func(i int) bool { return p.At(i).StartOffset >= offset })
+	return i < n && p.At(i).StartOffset == offset
+}
+
+// checkPosting returns an error if p can't be the location of a record, which may happen
+// if the postings of an index file are corrupted.
+func checkPosting(p DatabaseFileOffsetsRecord) error {
+	if p.StartOffset < 0 || p.Length > maxRecordLength {
+		return errIndexFilePosting
+	}
+	return nil
+}
+
+// indexTable maps keys to postings.
+type indexTable struct {
+	numKeys  int
+	entries  []byte
+	keys     []byte
+	postings []byte
+}
+
+func (t indexTable) key(i int) []byte {
+	e := t.entries[i*indexTableEntrySize:]
+	keyOffset := binary.LittleEndian.Uint32(e)
+	keyLength := binary.LittleEndian.Uint32(e[4:])
+	return t.keys[keyOffset : keyOffset+keyLength]
+}
+
+// lookup returns the postings of key, which are empty if the key is not in the table.
+func (t indexTable) lookup(key string) postings {
+	i := sort.Search(t.numKeys, func(i int) bool { return string(t.key(i)) >= key })
+	if i >= t.numKeys || string(t.key(i)) != key {
+		return nil
+	}
+	e := t.entries[i*indexTableEntrySize:]
+	firstPosting := int(binary.LittleEndian.Uint32(e[8:]))
+	numPostings := int(binary.LittleEndian.Uint32(e[12:]))
+	return postings(t.postings[firstPosting*postingSize : (firstPosting+numPostings)*postingSize])
+}
+
+type indexTables struct {
+	ngrams    indexTable
+	locations indexTable
+	rpps      indexTable
+	scopes    indexTable
+	phonetics indexTable
+}
+
+// indexTablesBuilder holds the tables of an index while it is being created.
+type indexTablesBuilder struct {
+	ngrams    map[string][]DatabaseFileOffsetsRecord
+	locations map[string][]DatabaseFileOffsetsRecord
+	rpps      map[string][]DatabaseFileOffsetsRecord
+	scopes    map[string][]DatabaseFileOffsetsRecord
+	phonetics map[string][]DatabaseFileOffsetsRecord
+}
+
+// encodeIndex returns the content of an index file.
+func encodeIndex(header indexFileHeader, builder *indexTablesBuilder) []byte {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, indexFileHeaderSize))
+	// Keep track of the checksummed part of each table.
+	var checksummed [][2]int
+	for _, table := range []map[string][]DatabaseFileOffsetsRecord{builder.ngrams, builder.locations, builder.rpps, builder.scopes, builder.phonetics} {
+		start := buf.Len()
+		checksummedLength := encodeIndexTable(&buf, table)
+		checksummed = append(checksummed, [2]int{start, start + checksummedLength})
+	}
+	data := buf.Bytes()
+
+	h := data[:indexFileHeaderSize]
+	copy(h, indexFileMagic)
+	binary.LittleEndian.PutUint32(h[8:], indexFileVersion)
+	binary.LittleEndian.PutUint32(h[12:], uint32(header.nGramSize))
+	binary.LittleEndian.PutUint64(h[16:], uint64(header.dataFileSize))
+	binary.LittleEndian.PutUint64(h[24:], uint64(header.dataFileModTime))
+	binary.LittleEndian.PutUint64(h[32:], uint64(header.numRecords))
+	binary.LittleEndian.PutUint32(h[44:], header.optionsChecksum)
+	copy(h[48:], header.dataFileSHA256[:])
+	binary.LittleEndian.PutUint64(h[80:], uint64(header.createdAt.UnixNano()))
+	checksum := crc32.Checksum(h[44:], crc32cTable)
+	for _, r := range checksummed {
+		checksum = crc32.Update(checksum, crc32cTable, data[r[0]:r[1]])
+	}
+	binary.LittleEndian.PutUint32(h[40:], checksum)
+	return data
+}
+
+// encodeIndexTable appends table to buf, and returns the length of its part that is checksummed,
+// i.e. everything but the postings.
+func encodeIndexTable(buf *bytes.Buffer, table map[string][]DatabaseFileOffsetsRecord) int {
+	keys := make([]string, 0, len(table))
+	var keysLength, numPostings int
+	for key, offsets := range table {
+		keys = append(keys, key)
+		keysLength += len(key)
+		numPostings += len(offsets)
+	}
+	sort.Strings(keys)
+
+	var b [indexTableEntrySize]byte
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(keys)))
+	binary.LittleEndian.PutUint32(b[4:], uint32(keysLength))
+	binary.LittleEndian.PutUint32(b[8:], uint32(numPostings))
+	binary.LittleEndian.PutUint32(b[12:], 0)
+	buf.Write(b[:indexTableHeaderSize])
+
+	var keyOffset, firstPosting int
+	for _, key := range keys {
+		binary.LittleEndian.PutUint32(b[0:], uint32(keyOffset))
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(key)))
+		binary.LittleEndian.PutUint32(b[8:], uint32(firstPosting))
+		binary.LittleEndian.PutUint32(b[12:], uint32(len(table[key])))
+		buf.Write(b[:indexTableEntrySize])
+		keyOffset += len(key)
+		firstPosting += len(table[key])
+	}
+	for _, key := range keys {
+		buf.WriteString(key)
+	}
+	checksummedLength := indexTableHeaderSize + len(keys)*indexTableEntrySize + keysLength
+	for _, key := range keys {
+		for _, offset := range table[key] {
+			binary.LittleEndian.PutUint64(b[0:], uint64(offset.StartOffset))
+			binary.LittleEndian.PutUint32(b[8:], offset.Length)
+			buf.Write(b[:postingSize])
+		}
+	}
+	return checksummedLength
+}
+
+// decodeIndex checks the content of an index file, and returns its header and tables.
+// The tables point into data, which must be kept around as long as they are used.
+func decodeIndex(data []byte) (indexFileHeader, indexTables, error) {
+	if len(data) < indexFileHeaderSize || string(data[:8]) != indexFileMagic {
+		return indexFileHeader{}, indexTables{}, errIndexFileFormat
+	}
+	h := data[:indexFileHeaderSize]
+	if version := binary.LittleEndian.Uint32(h[8:]); version != indexFileVersion {
+		return indexFileHeader{}, indexTables{}, fmt.Errorf("%w %d", errIndexFileVersion, version)
+	}
+	header := indexFileHeader{
+		nGramSize:       int(binary.LittleEndian.Uint32(h[12:])),
+		optionsChecksum: binary.LittleEndian.Uint32(h[44:]),
+		dataFileSize:    int64(binary.LittleEndian.Uint64(h[16:])),
+		dataFileModTime: int64(binary.LittleEndian.Uint64(h[24:])),
+		numRecords:      int(binary.LittleEndian.Uint64(h[32:])),
+		createdAt:       time.Unix(0, int64(binary.LittleEndian.Uint64(h[80:]))),
+	}
+	copy(header.dataFileSHA256[:], h[48:80])
+
+	var tables indexTables
+	checksum := crc32.Checksum(h[44:], crc32cTable)
+	rest := data[indexFileHeaderSize:]
+	for _, table := range []*indexTable{&tables.ngrams, &tables.locations, &tables.rpps, &tables.scopes, &tables.phonetics} {
+		var err error
+		var checksummed []byte
+		*table, checksummed, rest, err = decodeIndexTable(rest)
+		if err != nil {
+			return indexFileHeader{}, indexTables{}, err
+		}
+		checksum = crc32.Update(checksum, crc32cTable, checksummed)
+	}
+	if len(rest) != 0 {
+		return indexFileHeader{}, indexTables{}, errIndexFileFormat
+	}
+	if checksum != binary.LittleEndian.Uint32(h[40:]) {
+		return indexFileHeader{}, indexTables{}, errIndexFileChecksum
+	}
+	return header, tables, nil
+}
+
+// decodeIndexTable returns the table at the start of data, along with its checksummed part
+// and the data following it.
+func decodeIndexTable(data []byte) (indexTable, []byte, []byte, error) {
+	if len(data) < indexTableHeaderSize {
+		return indexTable{}, nil, nil, errIndexFileFormat
+	}
+	numKeys := int(binary.LittleEndian.Uint32(data[0:]))
+	keysLength := int(binary.LittleEndian.Uint32(data[4:]))
+	numPostings := int(binary.LittleEndian.Uint32(data[8:]))
+	tableData := data
+	data = data[indexTableHeaderSize:]
+
+	entriesLength := numKeys * indexTableEntrySize
+	postingsLength := numPostings * postingSize
+	if len(data) < entriesLength+keysLength+postingsLength {
+		return indexTable{}, nil, nil, errIndexFileFormat
+	}
+	table := indexTable{
+		numKeys:  numKeys,
+		entries:  data[:entriesLength],
+		keys:     data[entriesLength : entriesLength+keysLength],
+		postings: data[entriesLength+keysLength : entriesLength+keysLength+postingsLength],
+	}
+
+	// Check the entries once, so that lookups can't go out of bounds later on.
+	for i := 0; i < numKeys; i++ {
+		e := table.entries[i*indexTableEntrySize:]
+		keyEnd := uint64(binary.LittleEndian.Uint32(e)) + uint64(binary.LittleEndian.Uint32(e[4:]))
+		postingsEnd := uint64(binary.LittleEndian.Uint32(e[8:])) + uint64(binary.LittleEndian.Uint32(e[12:]))
+		if keyEnd > uint64(keysLength) || postingsEnd > uint64(numPostings) {
+			return indexTable{}, nil, nil, errIndexFileFormat
+		}
+	}
+	checksummed := tableData[:indexTableHeaderSize+entriesLength+keysLength]
+	return table, checksummed, data[entriesLength+keysLength+postingsLength:], nil
+}
+
+// writeIndexFile atomically writes the index data to filePath.
+func writeIndexFile(filePath string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
+// readerSHA256 returns the hash of everything read from r.
+func readerSHA256(r io.Reader) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return sum, err
+	}
+	copy(sum[:], hash.Sum(nil))
+	return sum, nil
+}
+
+// loadIndexFile memory-maps the index file at filePath, and checks that it was created
+// from a data file and with options matching the expected header.
+//
+// The data file is not hashed, as this would read all of it: see verifyIndex.
+// The returned release function unmaps the file, once the index is not used anymore.
+func loadIndexFile(filePath string, expected indexFileHeader) ([]byte, func() error, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	data, release, err := mapFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, _, err := decodeIndex(data)
+	if err == nil && (header.nGramSize != expected.nGramSize ||
+		header.optionsChecksum != expected.optionsChecksum ||
+		header.dataFileSize != expected.dataFileSize ||
+		header.dataFileModTime != expected.dataFileModTime) {
+		err = errIndexFileStale
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return data, release, nil
+}
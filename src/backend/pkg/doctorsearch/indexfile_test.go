@@ -0,0 +1,147 @@
+package doctorsearch
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tmpDataFile copies the fixture data file to a temporary directory, so that index files can be written next to it.
+func tmpDataFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "doctorsearch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	b, err := ioutil.ReadFile(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFilePath := filepath.Join(dir, "data.txt")
+	if err := ioutil.WriteFile(dataFilePath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dataFilePath
+}
+
+func expectedIndexHeader(t *testing.T, dataFilePath string) indexFileHeader {
+	fi, err := os.Stat(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dataFileHeader(fi, fixtureIndexOptions)
+}
+
+func TestIndexFile(t *testing.T) {
+	dataFilePath := tmpDataFile(t)
+
+	created, err := buildIndex(dataFilePath, fixtureIndexOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer created.Close()
+
+	if _, err := os.Stat(indexFilePath(dataFilePath)); err != nil {
+		t.Fatalf("index file was not written: %s", err)
+	}
+	_, release, err := loadIndexFile(indexFilePath(dataFilePath), expectedIndexHeader(t, dataFilePath))
+	if err != nil {
+		t.Fatalf("index file could not be loaded: %s", err)
+	}
+	release()
+
+	loaded, err := buildIndex(dataFilePath, fixtureIndexOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+
+	if loaded.numRecords != created.numRecords {
+		t.Errorf("loaded index has %d records, expected %d", loaded.numRecords, created.numRecords)
+	}
+	for _, query := range []string{"lefevre", "martin bordeaux", "10000000006"} {
+		expectRPPS(t, query, queryRPPS(t, loaded, query, 5, 0.3), queryRPPS(t, created, query, 5, 0.3)...)
+	}
+}
+
+func TestIndexFileRejected(t *testing.T) {
+	dataFilePath := tmpDataFile(t)
+	indexPath := indexFilePath(dataFilePath)
+
+	index, err := buildIndex(dataFilePath, fixtureIndexOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+
+	otherNGramSize := expectedIndexHeader(t, dataFilePath)
+	otherNGramSize.nGramSize = 4
+	if _, _, err := loadIndexFile(indexPath, otherNGramSize); !errors.Is(err, errIndexFileStale) {
+		t.Errorf("index file with another ngram size: got error %v, expected %v", err, errIndexFileStale)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(dataFilePath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadIndexFile(indexPath, expectedIndexHeader(t, dataFilePath)); !errors.Is(err, errIndexFileStale) {
+		t.Errorf("index file of a modified data file: got error %v, expected %v", err, errIndexFileStale)
+	}
+
+	// A data file with the same size and modification time, but another content.
+	index, err = buildIndex(dataFilePath, fixtureIndexOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+	fi, err := os.Stat(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("DUPONT"), []byte("DUPOND"), 1)
+	if err := ioutil.WriteFile(dataFilePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dataFilePath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	index, err = buildIndex(dataFilePath, fixtureIndexOptions)
+	if err != nil {
+		t.Fatalf("index file could not be loaded without checking the data file hash: %s", err)
+	}
+	defer index.Close()
+	// Verifying the index replaces the stale index file.
+	rebuilt, err := verifyIndex(index, dataFilePath, fixtureIndexOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt == nil {
+		t.Fatal("index of a data file with another content was not created again")
+	}
+	defer rebuilt.Close()
+	if again, err := verifyIndex(rebuilt, dataFilePath, fixtureIndexOptions); again != nil || err != nil {
+		t.Errorf("created index was verified again: got %v, %v", again, err)
+	}
+
+	b, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Postings are not checksummed, but the rest of the header is.
+	b[indexFileHeaderSize-1] ^= 0xff
+	if err := ioutil.WriteFile(indexPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadIndexFile(indexPath, expectedIndexHeader(t, dataFilePath)); !errors.Is(err, errIndexFileChecksum) {
+		t.Errorf("corrupted index file: got error %v, expected %v", err, errIndexFileChecksum)
+	}
+}
@@ -1,86 +1,21 @@
 package doctorsearch
 
 import (
-	"archive/zip"
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"crypto/sha256"
 	"errors"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"math/rand"
-	"net"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-// An HTTP client that only trusts an "ASIP Sante" root certificate.
-var httpClient *http.Client
-
-func init() {
-	// ASIP Sante root certificate.
-	// See http://igc-sante.esante.gouv.fr/PC/
-	const ASIPRootCertPEM = `
------BEGIN CERTIFICATE-----
-MIIGKDCCBBCgAwIBAgISESDOGfk0b5RW/ycAI9hSkDe1MA0GCSqGSIb3DQEBCwUA
-MHkxCzAJBgNVBAYTAkZSMRMwEQYDVQQKDApBU0lQLVNBTlRFMRcwFQYDVQQLDA4w
-MDAyIDE4NzUxMjc1MTESMBAGA1UECwwJSUdDLVNBTlRFMSgwJgYDVQQDDB9BQyBS
-QUNJTkUgSUdDLVNBTlRFIEVMRU1FTlRBSVJFMB4XDTEzMDYyNTAwMDAwMFoXDTMz
-MDYyNTAwMDAwMFoweTELMAkGA1UEBhMCRlIxEzARBgNVBAoMCkFTSVAtU0FOVEUx
-FzAVBgNVBAsMDjAwMDIgMTg3NTEyNzUxMRIwEAYDVQQLDAlJR0MtU0FOVEUxKDAm
-BgNVBAMMH0FDIFJBQ0lORSBJR0MtU0FOVEUgRUxFTUVOVEFJUkUwggIiMA0GCSqG
-SIb3DQEBAQUAA4ICDwAwggIKAoICAQDNo99sZJlo3F6n4X67RF+xqBT3yGmA6LLd
-HIvTfDBCQ1l442eEOPHGXkyRkMHBI+q38Jily25liY7AjYElGpege2NbIyPQRTJS
-hF+ENJKccUDpJnv85OhSd+0NamF07GWd5Mi5AXyXprLxCOs+93rh18lTN8M0JoFQ
-mTNLhZTUZsobLMd0hYGShgC6BiNbHTAQpps11jYqWMpvTTRq1SFHHvrR3WMbUZDT
-Lj25f2DxIcy4x/ulfqmE/5x9uRC40+yG6ExxjkVU/7lkipGpvp0XxufQDIr9jntx
-VYszzu9Ti5jV1cDnlG8KfnAV1GZhX5WgY+1/QDnxq/A/JNW7H0YMkx9BZcQQ75JP
-fUU/HYX3GFrAx8YiW46E+SspGkBUFz4Qr2xKIch9akf+GbXlDPIy3L26Au05/dcf
-ZlDLIa3RsDUrby/m9EHK8P5uVVQG/KIUgnqr1Go/psMWztO2F+BCjau5pKg0a9k6
-kQFp0oETPKlYxo8Qsrq1iju7HuEPtHKn+UcpKddDjTGW6aAQS5qVVsqPFv2lCPBK
-71037VrjaJ0XV+jqqN9SUCEEZSFvPmIzv0UdOEd29igJSlXYH+RGTn/RMZ+iIB7C
-CAhIQy+tFw9VRFWyCGeOrFg+8fBsosmOffQ80rkOGts4SpTkEI038djuwYMEbu9O
-p6Pntk58dwIDAQABo4GpMIGmMA8GA1UdEwEB/wQFMAMBAf8wDgYDVR0PAQH/BAQD
-AgEGMEMGA1UdIAQ8MDowOAYEVR0gADAwMC4GCCsGAQUFBwIBFiJodHRwOi8vaWdj
-LXNhbnRlLmVzYW50ZS5nb3V2LmZyL1BDMB0GA1UdDgQWBBSMb+rVi4L6+b6H3HMO
-JxUHR8SeLzAfBgNVHSMEGDAWgBSMb+rVi4L6+b6H3HMOJxUHR8SeLzANBgkqhkiG
-9w0BAQsFAAOCAgEALPVMH5yLBZgbwYXbkLdmkB44GzANJ39ibwmhWqlbOfZZmpQh
-NC71ftzfluSTUTb4QF/zAPylpRRmzJRtmUdOlYZToE3gWtxnNOcbLFtGDp0uvGYb
-+FqrzghOICWgM3JWstPNGW681fQgmWH6OJQs5eWIZpkpl/wSWhbq0GuPXZXnYDGi
-I4wtxHgwbKE7rokqHO/HPK/GJ5yn7oWBp2cy96hYIw9O9NUKzhZYD+EXXrmdrX1W
-LjxhAICs1CIaFuIuXLnaSrV52kWUcmDJ3+oRqbRIXTB1nBcUL1jDV2cugLCJV+GQ
-wb16yAAHz8B2lH4H6j6RTWr9wIuQZcSw9E/YqY8vRnSws0KmRM5mwwU/QAgINdH4
-iDFyeFJjLEvV0ny7wiP0if+Mzjil3r6oghQ1SOv3AN33nkK5wWtOVksIQhBaTSMq
-xxiwSfb2/QX6S8hZ3k85bMsWPDGE3MHlZjDUB4EhxaRASyGFR1/3mqzPX5sJaCAL
-2iF3qDDs2WGmwoBBHySFdsEEPBZm5OelN5uTgZ7ub7LM/s1BTU1RFQsO4CEYL/op
-zss8O6vlDwDNCyt/09yS2RvQZV+E7/5cCi0gumwnhKE0uRjLs36jm055En2LQX95
-fE/rZpnSMWBDwCpNvgXLoejYigfVJPFzSPen5mo1uPPwMkEwXggooIu5diM=
------END CERTIFICATE-----`
-
-	rootCA := x509.NewCertPool()
-	ok := rootCA.AppendCertsFromPEM([]byte(ASIPRootCertPEM))
-	if !ok {
-		log.Fatal().Msg("Error adding ASIP SANTE certificate to cert pool")
-	}
-
-	tr := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout: 30 * time.Second,
-		}).DialContext,
-		DisableKeepAlives:     true,
-		ExpectContinueTimeout: 2 * time.Second,
-		TLSHandshakeTimeout:   15 * time.Second,
-		TLSClientConfig: &tls.Config{
-			RootCAs: rootCA,
-		},
-	}
-	httpClient = &http.Client{Transport: tr}
-}
-
 type NextUpdate int
 
 const (
@@ -88,15 +23,30 @@ const (
 	FastUpdate
 )
 
-var (
-	errUnexpectedZIP = errors.New("ZIP file did not contain expected data file")
-)
+// fetchTimeout bounds the time taken to fetch a new data file, so that a stalled download
+// does not block updates forever.
+const fetchTimeout = 30 * time.Minute
 
 type indexUpdater struct {
+	source UpdateSource
+	// When updatePeriod is 0, updates only happen when triggered.
 	updatePeriod    time.Duration
 	updateMinPeriod time.Duration
 	// Jitter percentage, expressed between 0.0 and 1.0
 	updatePeriodJitter float32
+	minRecordsRatio    float32
+	trigger            chan struct{}
+}
+
+func newIndexUpdater(config Config) *indexUpdater {
+	return &indexUpdater{
+		source:             config.UpdateSource,
+		updatePeriod:       config.UpdatePeriod,
+		updateMinPeriod:    config.UpdateMinPeriod,
+		updatePeriodJitter: config.UpdatePeriodJitter,
+		minRecordsRatio:    config.UpdateMinRecordsRatio,
+		trigger:            make(chan struct{}, 1),
+	}
 }
 
 func (iu *indexUpdater) nextUpdateDelay(next NextUpdate) time.Duration {
@@ -112,128 +62,254 @@ func (iu *indexUpdater) nextUpdateDelay(next NextUpdate) time.Duration {
 	return p + jitter
 }
 
+// Trigger asks for an update to happen as soon as possible.
+func (iu *indexUpdater) Trigger() {
+	select {
+	case iu.trigger <- struct{}{}:
+	default:
+		// An update is already pending.
+	}
+}
+
 func (iu *indexUpdater) Start(firstUpdate NextUpdate, dr *drSearcher) {
 	ticker := time.NewTicker(math.MaxInt64)
 	nextUpdate := firstUpdate
 
 	for {
-		nextUpdateDelay := iu.nextUpdateDelay(nextUpdate)
-		ticker.Reset(nextUpdateDelay)
-		log.Trace().
-			Dur("delay", nextUpdateDelay).
-			Msg("scheduled next data file update")
-		<-ticker.C
-
-		tmpFilePath, cleanup, err := downloadNewData()
-		if err != nil {
-			log.Error().Msgf("error downloading new data file: %s", err)
-			nextUpdate = FastUpdate
-			cleanup()
-			continue
+		if iu.updatePeriod != 0 {
+			nextUpdateDelay := iu.nextUpdateDelay(nextUpdate)
+			ticker.Reset(nextUpdateDelay)
+			log.Trace().
+				Dur("delay", nextUpdateDelay).
+				Msg("scheduled next data file update")
 		}
-
-		index, err := buildIndex(tmpFilePath, dr.nGramSize)
-		if err != nil {
-			log.Error().Msgf("error building new index from new data: %s", err)
-			nextUpdate = FastUpdate
-		} else {
-			dr.indexControl.UseIndex(index)
-			nextUpdate = NormalUpdate
-
-			// On succesful index creation and use, move the downloaded data file
-			// to the canonical location, i.e. overwrite the previous records and replace
-			// them with the
-			moveErr := os.Rename(tmpFilePath, dr.dataFilePath)
-			if moveErr != nil {
-				log.Error().Msgf("error overwriting data file: %s", moveErr)
-			}
+		select {
+		case <-ticker.C:
+		case <-iu.trigger:
+			log.Info().Msg("triggered data file update")
 		}
 
-		cleanup()
+		var err error
+		nextUpdate, err = iu.update(dr)
+		dr.state.updateAttempted(time.Now(), err)
 	}
 }
 
-// downloadNewData checks for an update to the doctor data file.
-// It returns a path to the new data file, which is completely owned by the caller:
-// it can be moved, renamed etc...
-// To avoid leaking resources (disk space), the caller should call the cleanup
-// function as soon as they do not need this file anymore.
-func downloadNewData() (string, func(), error) {
-	const URL = "https://service.annuaire.sante.fr/annuaire-sante-webservices/V300/services/extraction/PS_LibreAcces"
-	const FileNamePrefix = "PS_LibreAcces_Personne_activite_"
-
-	resp, err := httpClient.Get(URL)
+// update fetches a new data file from the source, and starts using it if an index can be created from it.
+func (iu *indexUpdater) update(dr *drSearcher) (NextUpdate, error) {
+	// Download next to the data file, so that it can simply be renamed to replace it.
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dr.dataFilePath), "download-task-*")
 	if err != nil {
-		return "", func() {}, err
+		log.Error().Msgf("error creating temporary directory for new data file: %s", err)
+		return FastUpdate, err
 	}
+	defer os.RemoveAll(tmpDir)
 	log.Trace().
-		Int64("http_content_length", resp.ContentLength).
-		Msg("downloading data file")
+		Str("tmp_dir_path", tmpDir).
+		Msg("created temporary directory for download")
 
-	tmpDir, err := ioutil.TempDir("", "download-task-*")
-	cleanupFunc := func() {
-		os.RemoveAll(tmpDir)
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	tmpFilePath, err := iu.source.Fetch(ctx, tmpDir)
+	cancel()
+	if errors.Is(err, ErrNoNewData) {
+		log.Trace().Msg("no new data file")
+		return NormalUpdate, nil
+	} else if err != nil {
+		log.Error().Msgf("error downloading new data file: %s", err)
+		return FastUpdate, err
 	}
-	if err != nil {
-		return "", cleanupFunc, err
+
+	dr.state.filesMu.Lock()
+	defer dr.state.filesMu.Unlock()
+
+	// Sources may provide known data again, e.g. the directory source after a restart. Neither
+	// the data in use nor the previous data (which may have been rolled back from) are new.
+	if known, err := isKnownDataFile(dr, tmpFilePath); err != nil {
+		log.Error().Msgf("error hashing new data file: %s", err)
+		return FastUpdate, err
+	} else if known {
+		log.Debug().Msg("new data file is the data file in use, or the previous one")
+		return NormalUpdate, nil
 	}
-	log.Trace().
-		Str("tmp_dir_path", tmpDir).
-		Msg("created temporary directory for download")
 
-	tmpFile, err := ioutil.TempFile(tmpDir, "*.zip")
-	if err != nil {
-		return "", cleanupFunc, err
+	index, err := buildIndex(tmpFilePath, dr.indexOptions)
+	if errors.Is(err, ErrUnexpectedColumnLayout) {
+		log.Error().
+			Strs("reasons", []string{err.Error()}).
+			Msg("rejected new data file")
+		return NormalUpdate, fmt.Errorf("%w: %s", ErrRejectedUpdate, err)
+	} else if err != nil {
+		log.Error().Msgf("error building new index from new data: %s", err)
+		return FastUpdate, err
+	}
+	if current := dr.state.currentIndex(); current != nil {
+		if reasons := checkNewIndex(current, index, iu.minRecordsRatio); len(reasons) != 0 {
+			// Keep the data file in use, the source may well provide the same data next time
+			// so there is no point in trying again soon.
+			index.Close()
+			log.Error().
+				Strs("reasons", reasons).
+				Msg("rejected new data file")
+			return NormalUpdate, fmt.Errorf("%w: %s", ErrRejectedUpdate, strings.Join(reasons, ", "))
+		}
 	}
-	defer tmpFile.Close()
 
-	_, err = io.Copy(tmpFile, resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		return "", cleanupFunc, err
+	// On succesful index creation, move the downloaded data file to the canonical location,
+	// i.e. overwrite the previous records and replace them with the new ones. The replaced
+	// records are kept around to allow rolling back.
+	// The new index is only used once its data file is there, so that it is still used after
+	// a restart.
+	if err := dr.replaceDataFile(tmpFilePath); err != nil {
+		index.Close()
+		log.Error().Msgf("error overwriting data file: %s", err)
+		return FastUpdate, fmt.Errorf("could not replace data file: %w", err)
 	}
+	dr.useIndex(index)
+	return NormalUpdate, nil
+}
 
-	_, err = tmpFile.Seek(0, 0)
+// fileSHA256 returns the hash of the content of the file at filePath.
+func fileSHA256(filePath string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(filePath)
 	if err != nil {
-		return "", cleanupFunc, err
+		return sum, err
 	}
-	fi, err := tmpFile.Stat()
+	defer f.Close()
+	return readerSHA256(f)
+}
+
+// isKnownDataFile tells whether the data file at filePath has the same content as the data file
+// in use, or as the previous data file.
+func isKnownDataFile(dr *drSearcher, filePath string) (bool, error) {
+	sum, err := fileSHA256(filePath)
 	if err != nil {
-		return "", cleanupFunc, err
+		return false, err
 	}
+	if current := dr.state.currentIndex(); current != nil && sum == current.header.dataFileSHA256 {
+		return true, nil
+	}
+	previousSum, err := fileSHA256(previousDataFilePath(dr.dataFilePath))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return sum == previousSum, nil
+}
 
-	zipr, err := zip.NewReader(tmpFile, fi.Size())
-	if err != nil {
-		return "", cleanupFunc, err
+// numSpotChecks is the maximum number of RPPS numbers in use looked up in new data.
+const numSpotChecks = 100
+
+// checkNewIndex compares a new index to the one in use, and returns the reasons why
+// it looks suspicious, e.g. because it was created from a truncated data file.
+func checkNewIndex(current *nGramsIndex, next *nGramsIndex, minRecordsRatio float32) []string {
+	if minRecordsRatio == 0 {
+		return nil
+	}
+	var reasons []string
+
+	if float32(next.numRecords) < minRecordsRatio*float32(current.numRecords) {
+		reasons = append(reasons, fmt.Sprintf("%d records instead of %d", next.numRecords, current.numRecords))
 	}
 
-	var zipFile *zip.File
-	for _, f := range zipr.File {
-		if strings.HasPrefix(f.Name, FileNamePrefix) {
-			zipFile = f
-			break
+	// Look up RPPS numbers spread over the sorted table of the current index.
+	numChecks := minInt(numSpotChecks, current.tables.rpps.numKeys)
+	var numFound int
+	for i := 0; i < numChecks; i++ {
+		key := current.tables.rpps.key(i * current.tables.rpps.numKeys / numChecks)
+		if next.tables.rpps.lookup(string(key)).Len() != 0 {
+			numFound++
 		}
 	}
-	if zipFile == nil {
-		return "", cleanupFunc, errUnexpectedZIP
+	if float32(numFound) < minRecordsRatio*float32(numChecks) {
+		reasons = append(reasons, fmt.Sprintf("%d out of %d sampled RPPS numbers found", numFound, numChecks))
 	}
+	return reasons
+}
 
-	tmpDataFile, err := ioutil.TempFile(tmpDir, "data-*.txt")
-	if err != nil {
-		return "", cleanupFunc, err
+// previousDataFilePath returns the path where the data file replaced by the last update is kept.
+func previousDataFilePath(dataFilePath string) string {
+	return dataFilePath + ".previous"
+}
+
+// replaceDataFile moves the data file at newDataFilePath to the canonical location,
+// and keeps the current data file as the previous one.
+//
+// The new data file must be on the same file system as the current one, since it is renamed.
+func (dr *drSearcher) replaceDataFile(newDataFilePath string) error {
+	previousPath := previousDataFilePath(dr.dataFilePath)
+	err := moveDataFile(dr.dataFilePath, previousPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	hadDataFile := err == nil
+	if err := moveDataFile(newDataFilePath, dr.dataFilePath); err != nil {
+		if hadDataFile {
+			// Put back the data file in use.
+			if restoreErr := moveDataFile(previousPath, dr.dataFilePath); restoreErr != nil {
+				log.Error().Msgf("error restoring data file: %s", restoreErr)
+			}
+		}
+		return err
 	}
-	defer tmpDataFile.Close()
+	return nil
+}
 
-	zipFileReader, err := zipFile.Open()
-	if err != nil {
-		return "", cleanupFunc, err
+// Rollback starts using the previous data file again, i.e. the one replaced by the last update.
+// The current data file then becomes the previous one.
+func (dr *drSearcher) Rollback() error {
+	dr.state.filesMu.Lock()
+	defer dr.state.filesMu.Unlock()
+
+	previousPath := previousDataFilePath(dr.dataFilePath)
+	if _, err := os.Stat(previousPath); errors.Is(err, os.ErrNotExist) {
+		return ErrNoPreviousData
+	} else if err != nil {
+		return err
 	}
-	defer zipFileReader.Close()
 
-	_, err = io.Copy(tmpDataFile, zipFileReader)
+	index, err := buildIndex(previousPath, dr.indexOptions)
 	if err != nil {
-		return "", cleanupFunc, err
+		return err
+	}
+	// Rollbacks are rare, so the index is verified before being used.
+	if rebuilt, err := verifyIndex(index, previousPath, dr.indexOptions); err != nil {
+		index.Close()
+		return err
+	} else if rebuilt != nil {
+		index.Close()
+		index = rebuilt
 	}
 
-	return tmpDataFile.Name(), cleanupFunc, nil
+	// Swap the data files through a temporary name.
+	swapPath := dr.dataFilePath + ".swap"
+	if err := moveDataFile(dr.dataFilePath, swapPath); err != nil {
+		index.Close()
+		return err
+	}
+	if err := moveDataFile(previousPath, dr.dataFilePath); err != nil {
+		moveDataFile(swapPath, dr.dataFilePath)
+		index.Close()
+		return err
+	}
+	if err := moveDataFile(swapPath, previousPath); err != nil {
+		log.Error().Msgf("error keeping the rolled back data file: %s", err)
+	}
+
+	dr.useIndex(index)
+	log.Info().Msg("rolled back to previous data file")
+	return nil
+}
+
+// moveDataFile renames a data file, along with its index file.
+func moveDataFile(from string, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if err := os.Rename(indexFilePath(from), indexFilePath(to)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// An outdated index file is not used, it will be created again when needed.
+		log.Warn().Msgf("error moving index file: %s", err)
+	}
+	return nil
 }
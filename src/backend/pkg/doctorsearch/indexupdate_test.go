@@ -0,0 +1,254 @@
+package doctorsearch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForStatus waits until the status of dr satisfies the condition.
+func waitForStatus(t *testing.T, dr DoctorSearcher, condition func(Status) bool) Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := dr.Status()
+		if condition(status) {
+			return status
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for status, last one was %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpdateAndRollback(t *testing.T) {
+	dataFilePath := tmpDataFile(t)
+	original, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalSum := sha256.Sum256(original)
+	originalHash := hex.EncodeToString(originalSum[:])
+
+	// The update drops Claire Rousseau.
+	var lines []string
+	for _, line := range strings.SplitAfter(string(original), "\n") {
+		if !strings.Contains(line, "ROUSSEAU") {
+			lines = append(lines, line)
+		}
+	}
+	watchedDir := tmpDir(t)
+	updated := []byte(strings.Join(lines, ""))
+	if err := ioutil.WriteFile(filepath.Join(watchedDir, "PS_LibreAcces_Personne_activite_202010170000.txt"), updated, 0600); err != nil {
+		t.Fatal(err)
+	}
+	updatedSum := sha256.Sum256(updated)
+	updatedHash := hex.EncodeToString(updatedSum[:])
+
+	dr := New(dataFilePath, Config{
+		NGramSize:            3,
+		MaxUserQueryLength:   100,
+		MaxConcurrentQueries: 10,
+		MaxQueryDuration:     time.Second,
+		MinSimilarity:        0.3,
+		UpdateSource:         NewDirectorySource(watchedDir),
+	})
+
+	status := waitForStatus(t, dr, func(s Status) bool { return s.NumRecords != 0 })
+	if status.DataFileSHA256 != originalHash || status.NumRecords != 9 || status.CanRollback {
+		t.Errorf("unexpected status before update %+v", status)
+	}
+	if err := dr.Rollback(); !errors.Is(err, ErrNoPreviousData) {
+		t.Errorf("rollback before update: got error %v, expected %v", err, ErrNoPreviousData)
+	}
+
+	dr.TriggerUpdate()
+	status = waitForStatus(t, dr, func(s Status) bool { return !s.LastUpdateAttempt.IsZero() })
+	if status.LastUpdateError != "" || status.DataFileSHA256 != updatedHash || status.NumRecords != 8 || !status.CanRollback {
+		t.Errorf("unexpected status after update %+v", status)
+	}
+
+	if err := dr.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	status = dr.Status()
+	if status.DataFileSHA256 != originalHash || status.NumRecords != 9 || !status.CanRollback {
+		t.Errorf("unexpected status after rollback %+v", status)
+	}
+	// The index control switches indexes in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		results, err := dr.Query(context.Background(), "claire rousseau", 5, QueryOptions{})
+		if err == nil && len(results) != 0 && results[0].RPPSNumber == "10000000010" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("query after rollback returned %v, %v", results, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Rolling back again goes back to the updated data.
+	if err := dr.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if status = dr.Status(); status.DataFileSHA256 != updatedHash {
+		t.Errorf("unexpected status after second rollback %+v", status)
+	}
+}
+
+func TestRestartAfterRollback(t *testing.T) {
+	dataFilePath := tmpDataFile(t)
+	original, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalSum := sha256.Sum256(original)
+	originalHash := hex.EncodeToString(originalSum[:])
+
+	lines := strings.SplitAfter(string(original), "\n")
+	updated := []byte(strings.Join(lines[:len(lines)-2], "") + lines[len(lines)-1])
+	watchedDir := tmpDir(t)
+	if err := ioutil.WriteFile(filepath.Join(watchedDir, "PS_LibreAcces_Personne_activite_202010170000.txt"), updated, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		NGramSize:            3,
+		MaxUserQueryLength:   100,
+		MaxConcurrentQueries: 10,
+		MaxQueryDuration:     time.Second,
+		MinSimilarity:        0.3,
+		UpdateSource:         NewDirectorySource(watchedDir),
+	}
+
+	dr := New(dataFilePath, config)
+	waitForStatus(t, dr, func(s Status) bool { return s.NumRecords != 0 })
+	dr.TriggerUpdate()
+	status := waitForStatus(t, dr, func(s Status) bool { return !s.LastUpdateAttempt.IsZero() })
+	if status.DataFileSHA256 == originalHash {
+		t.Fatalf("data file was not updated %+v", status)
+	}
+	if err := dr.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart, the file of the watched directory is the previous data file, so it must
+	// not be used again.
+	config.UpdateSource = NewDirectorySource(watchedDir)
+	dr = New(dataFilePath, config)
+	waitForStatus(t, dr, func(s Status) bool { return s.NumRecords != 0 })
+	dr.TriggerUpdate()
+	status = waitForStatus(t, dr, func(s Status) bool { return !s.LastUpdateAttempt.IsZero() })
+	if status.LastUpdateError != "" || status.DataFileSHA256 != originalHash || !status.CanRollback {
+		t.Errorf("unexpected status after restart %+v", status)
+	}
+	previous, err := ioutil.ReadFile(previousDataFilePath(dataFilePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(previous) != string(updated) {
+		t.Errorf("previous data file was replaced after restart")
+	}
+}
+
+func TestRejectedUpdate(t *testing.T) {
+	dataFilePath := tmpDataFile(t)
+	original, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalSum := sha256.Sum256(original)
+	originalHash := hex.EncodeToString(originalSum[:])
+	lines := strings.SplitAfter(string(original), "\n")
+
+	watchedDir := tmpDir(t)
+	dr := New(dataFilePath, Config{
+		NGramSize:             3,
+		MaxUserQueryLength:    100,
+		MaxConcurrentQueries:  10,
+		MaxQueryDuration:      time.Second,
+		MinSimilarity:         0.3,
+		UpdateSource:          NewDirectorySource(watchedDir),
+		UpdateMinRecordsRatio: 0.9,
+	})
+	waitForStatus(t, dr, func(s Status) bool { return s.NumRecords != 0 })
+
+	updates := []struct {
+		name    string
+		content string
+		reason  string
+	}{
+		{
+			name:    "truncated",
+			content: strings.Join(lines[:6], ""),
+			reason:  "records instead of 9",
+		},
+		{
+			name:    "renamed column",
+			content: strings.Replace(string(original), "Nom d'exercice", "Nom", 1),
+			reason:  "missing columns 'Nom d'exercice'",
+		},
+		{
+			name:    "inconsistent header",
+			content: strings.Replace(string(original), "Code civilité|", "", 1),
+			reason:  "line has 53 columns instead of 52",
+		},
+	}
+	modTime := time.Now()
+	for i, update := range updates {
+		updatePath := filepath.Join(watchedDir, "PS_LibreAcces_Personne_activite_202010170000.txt")
+		if err := ioutil.WriteFile(updatePath, []byte(update.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(updatePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		previousAttempt := dr.Status().LastUpdateAttempt
+		dr.TriggerUpdate()
+		status := waitForStatus(t, dr, func(s Status) bool { return s.LastUpdateAttempt != previousAttempt })
+		if !strings.Contains(status.LastUpdateError, ErrRejectedUpdate.Error()) ||
+			!strings.Contains(status.LastUpdateError, update.reason) {
+			t.Errorf("%s update: unexpected error '%s'", update.name, status.LastUpdateError)
+		}
+		if status.RejectedUpdates != i+1 || status.DataFileSHA256 != originalHash || status.NumRecords != 9 || status.CanRollback {
+			t.Errorf("%s update: unexpected status %+v", update.name, status)
+		}
+	}
+
+	content, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(original) {
+		t.Error("data file was replaced by a rejected update")
+	}
+}
+
+func TestReplaceDataFileFailure(t *testing.T) {
+	dataFilePath := tmpDataFile(t)
+	original, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dr := &drSearcher{dataFilePath: dataFilePath}
+	if err := dr.replaceDataFile(filepath.Join(filepath.Dir(dataFilePath), "missing.txt")); err == nil {
+		t.Fatal("replacing the data file with a missing file did not fail")
+	}
+	// The data file in use is put back.
+	b, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(original) {
+		t.Errorf("data file was not restored")
+	}
+}
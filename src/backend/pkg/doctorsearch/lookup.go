@@ -0,0 +1,50 @@
+package doctorsearch
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// LookupRPPS returns the doctor with the given RPPS number, or nil if no such doctor is indexed.
+func LookupRPPS(ctx context.Context, searcher DoctorSearcher, rpps string) (*DoctorRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, searcher.QueryTimeout())
+	defer cancel()
+
+	// RPPS numbers are matched exactly, so the first result is the only one which may match.
+	results, err := searcher.Query(ctx, rpps, 1, QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 || results[0].RPPSNumber != rpps {
+		return nil, nil
+	}
+	return &results[0], nil
+}
+
+// nameWords returns the lowercase words of name, without accents.
+func nameWords(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(removeAccents(name)), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+}
+
+// HasName tells whether name designates the doctor: it must contain all the words of the last
+// name of the doctor, whatever their case and accents. The first name is not required, so that
+// e.g. "Dr Curie" is the name of Marie Curie.
+func (r *DoctorRecord) HasName(name string) bool {
+	words := make(map[string]bool)
+	for _, word := range nameWords(name) {
+		words[word] = true
+	}
+	lastNameWords := nameWords(r.LastName)
+	if len(lastNameWords) == 0 {
+		return false
+	}
+	for _, word := range lastNameWords {
+		if !words[word] {
+			return false
+		}
+	}
+	return true
+}
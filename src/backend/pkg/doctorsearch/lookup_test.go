@@ -0,0 +1,46 @@
+package doctorsearch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLookupRPPS(t *testing.T) {
+	dr := New(tmpDataFile(t), Config{
+		NGramSize:            3,
+		MaxUserQueryLength:   100,
+		MaxConcurrentQueries: 10,
+		MaxQueryDuration:     time.Second,
+		MinSimilarity:        0.3,
+	})
+	waitForStatus(t, dr, func(s Status) bool { return s.NumRecords != 0 })
+
+	doctor, err := LookupRPPS(context.Background(), dr, "10000000006")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doctor == nil || doctor.LastName != "Dupont" {
+		t.Fatalf("unexpected doctor %+v", doctor)
+	}
+	for name, expected := range map[string]bool{
+		"Hélène Dupont":  true,
+		"Dr DUPONT":      true,
+		"dupont-helene ": true,
+		"Hélène Dupond":  false,
+		"":               false,
+	} {
+		if doctor.HasName(name) != expected {
+			t.Errorf("HasName('%s') = %t, expected %t", name, !expected, expected)
+		}
+	}
+
+	// A similar, but unknown, RPPS number.
+	doctor, err = LookupRPPS(context.Background(), dr, "10000000099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doctor != nil {
+		t.Errorf("found doctor %+v for an unknown RPPS number", doctor)
+	}
+}
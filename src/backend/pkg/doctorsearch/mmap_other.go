@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package doctorsearch
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads the whole file in memory, as memory-mapping it is not supported on this platform.
+func mapFile(f *os.File) ([]byte, func() error, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
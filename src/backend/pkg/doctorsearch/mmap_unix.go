@@ -0,0 +1,27 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package doctorsearch
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the whole file in memory, read-only.
+// The mapping stays valid after the file is closed, until the returned function is called.
+func mapFile(f *os.File) ([]byte, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() == 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
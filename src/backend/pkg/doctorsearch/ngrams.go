@@ -3,20 +3,23 @@ package doctorsearch
 import (
 	"bufio"
 	"context"
-	"errors"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
 	"github.com/rs/zerolog/log"
 )
 
-type ReadSeekerCloser interface {
+// RecordsFile is the data file of an index. Its records are read with ReadAt, which may be
+// called concurrently by queries.
+type RecordsFile interface {
 	io.Reader
-	io.Seeker
+	io.ReaderAt
 	io.Closer
 }
 
@@ -25,46 +28,103 @@ type queryOrderableRecordReadWish struct {
 	Count  int
 }
 
-type readWishResult struct {
-	record *rawPersonActivityRecord
-	err    error
+type nGramsIndex struct {
+	nGramSize int
+	// tables point into the index data, which is usually a memory-mapped index file.
+	// The ngrams table maps ngrams to the records containing them, the locations table
+	// maps postal codes and commune words to the records located there,
+	// the rpps table allows exact lookups of records by their RPPS number, the scopes
+	// table maps professions and specialties to their records, and the (optional) phonetics
+	// table maps the phonetic keys of names to the records with such names.
+	tables      indexTables
+	header      indexFileHeader
+	columns     columnLayout
+	releaseData func() error
+	recordsData RecordsFile
+	// cache holds the indexed records when they are kept in memory, and is nil otherwise.
+	cache      *recordCache
+	closeOnce  sync.Once
+	numRecords int
+	// loaded tells whether the index was loaded from an existing index file, see verifyIndex.
+	loaded bool
 }
 
-type readRecordsCom struct {
-	readWishes         []queryOrderableRecordReadWish
-	readRecordsChan    chan *rawPersonActivityRecord
-	readRecordsErrChan chan error
+// newNGramsIndex scans all records of r to create an index, held in memory.
+func newNGramsIndex(r RecordsFile, options indexOptions) (*nGramsIndex, error) {
+	builder, header, err := scanRecords(r, options)
+	if err != nil {
+		return nil, err
+	}
+	header.createdAt = time.Now()
+	data := encodeIndex(header, builder)
+	return newNGramsIndexFromData(r, data, func() error { return nil }, options.cacheRecords)
 }
 
-type nGramsIndex struct {
-	nGramSize        int
-	underlyingIndex  map[string][]DatabaseFileOffsetsRecord // TODO: use [NGramSize]rune for key instead ?
-	recordsData      ReadSeekerCloser
-	submitReadsQueue chan readRecordsCom
-	done             chan struct{} //
-	numRecords       int
+// newNGramsIndexFromData returns an index using the given index data, for the records of r.
+// releaseData is called once the index is closed. When cacheRecords is set, the indexed
+// records are read once and kept in memory.
+func newNGramsIndexFromData(r RecordsFile, data []byte, releaseData func() error, cacheRecords bool) (*nGramsIndex, error) {
+	header, tables, err := decodeIndex(data)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := readColumnLayout(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cache *recordCache
+	if cacheRecords {
+		cache, err = newRecordCache(r, columns, tables.rpps)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &nGramsIndex{
+		nGramSize:   header.nGramSize,
+		tables:      tables,
+		header:      header,
+		columns:     columns,
+		releaseData: releaseData,
+		recordsData: r,
+		cache:       cache,
+		numRecords:  header.numRecords,
+	}, nil
 }
 
-func newNGramsIndex(r ReadSeekerCloser, nGramSize int) (*nGramsIndex, error) {
-	scanner := bufio.NewScanner(r)
+// scanRecords reads all records of r, and returns the index tables of those that should be indexed.
+// The returned header holds the number of indexed records and the hash of the data.
+func scanRecords(r io.Reader, options indexOptions) (*indexTablesBuilder, indexFileHeader, error) {
+	hash := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(r, hash))
 
 	index := make(map[string][]DatabaseFileOffsetsRecord, 0)
+	rppsIndex := make(map[string][]DatabaseFileOffsetsRecord)
+	locationIndex := make(map[string][]DatabaseFileOffsetsRecord)
+	scopeIndex := make(map[string][]DatabaseFileOffsetsRecord)
+	phoneticIndex := make(map[string][]DatabaseFileOffsetsRecord)
 	var (
 		offset      int64 = 0
 		lastAdvance int64 = 0
 	)
-	// Store the used RPPS among query results as the file contains duplicates
-	usedRPPSMap := make(map[string]bool)
-
+	var columns columnLayout
 	split := func() bufio.SplitFunc {
 		hasReadHeader := false
 
 		return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 			if hasReadHeader == false {
-				advanceHeader, _, errHeader := bufio.ScanLines(data, atEOF)
+				advanceHeader, header, errHeader := bufio.ScanLines(data, atEOF)
 				if errHeader != nil {
 					return advanceHeader, nil, errHeader
 				}
+				if header == nil && !atEOF {
+					// Request more data to read the whole header line.
+					return 0, nil, nil
+				}
+				if columns, errHeader = parseColumnLayout(string(header)); errHeader != nil {
+					return advanceHeader, nil, errHeader
+				}
 				hasReadHeader = true
 				lastAdvance = int64(advanceHeader)
 				offset += lastAdvance
@@ -73,7 +133,7 @@ func newNGramsIndex(r ReadSeekerCloser, nGramSize int) (*nGramsIndex, error) {
 
 			advance, token, err = bufio.ScanLines(data, atEOF)
 			if err == nil && token != nil {
-				_, err = parseRecordFromLine(string(token))
+				_, err = columns.parseRecord(string(token))
 			}
 			lastAdvance = int64(advance)
 			offset += lastAdvance
@@ -83,104 +143,355 @@ func newNGramsIndex(r ReadSeekerCloser, nGramSize int) (*nGramsIndex, error) {
 	// Set the split function for the scanning operation.
 	scanner.Split(split)
 
-	var numRecords int
+	// The file contains a line for each activity site of a person, so sites are grouped by RPPS number.
+	people := make(map[string]*personSites)
 	for scanner.Scan() {
 		line := scanner.Text()
 
-		record, err := parseRecordFromLine(line)
+		record, err := columns.parseRecord(line)
 		if err != nil {
-			return nil, err
+			return nil, indexFileHeader{}, err
 		}
-		if record.shouldBeIndexed() == false {
+		if record.shouldBeIndexed(options.professions) == false {
 			continue
 		}
+
+		// `offset` is the current offset after reading the record, so we substract
+		// the number of bytes that were just read (`lastAdvance`).
+		site := activitySite{
+			offset: DatabaseFileOffsetsRecord{
+				StartOffset: offset - lastAdvance,
+				Length:      uint32(len(line)),
+			},
+			rank: record.siteRank(),
+		}
+
 		rpps := record.RPPS()
-		if _, alreadyPresent := usedRPPSMap[rpps]; alreadyPresent {
-			// TODO: be smarter about which record we keep out of the ones with the same RPPS ?
-			continue
+		person, alreadyPresent := people[rpps]
+		if !alreadyPresent {
+			person = &personSites{
+				ngrams: record.computeAllNGrams(options.nGramSize),
+			}
+			if options.phonetic {
+				person.phoneticKeys = record.phoneticKeys()
+			}
+			people[rpps] = person
 		}
-		usedRPPSMap[rpps] = true
+		person.sites = append(person.sites, site)
+		person.locationTokens = append(person.locationTokens, record.locationTokens()...)
+		person.scopeKeys = append(person.scopeKeys, record.scopeKeys()...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, indexFileHeader{}, err
+	}
 
-		ngrams := record.computeAllNGrams(nGramSize)
-		for _, ngram := range ngrams {
+	// Records are indexed by the offset of their default site, in file order so that
+	// appending keeps the offsets sorted.
+	sortedPeople := make([]string, 0, len(people))
+	for rpps, person := range people {
+		sort.SliceStable(person.sites, func(i, j int) bool { return person.sites[i].rank < person.sites[j].rank })
+		sortedPeople = append(sortedPeople, rpps)
+	}
+	sort.Slice(sortedPeople, func(i, j int) bool {
+		return people[sortedPeople[i]].sites[0].offset.StartOffset < people[sortedPeople[j]].sites[0].offset.StartOffset
+	})
+
+	for _, rpps := range sortedPeople {
+		person := people[rpps]
+		recordOffset := person.sites[0].offset
+
+		for _, ngram := range person.ngrams {
 			existingOffsets, ok := index[ngram]
 			if !ok {
 				existingOffsets = make([]DatabaseFileOffsetsRecord, 0)
 			}
-			// `offset` is the current offset after reading the record, so we substract
-			// the number of bytes that were just read (`lastAdvance`).
-			actualOffset := offset - lastAdvance
-
-			index[ngram] = insertOffset(DatabaseFileOffsetsRecord{
-				StartOffset: actualOffset,
-				Length:      uint32(len(line)),
-			}, existingOffsets)
+			index[ngram] = insertOffset(recordOffset, existingOffsets)
+		}
+		siteOffsets := make([]DatabaseFileOffsetsRecord, len(person.sites))
+		for i, site := range person.sites {
+			siteOffsets[i] = site.offset
+		}
+		rppsIndex[rpps] = siteOffsets
+		for _, locationToken := range person.locationTokens {
+			offsets := locationIndex[locationToken]
+			if n := len(offsets); n > 0 && offsets[n-1] == recordOffset {
+				// e.g. the second "saint" in "Saint-Martin-de-Saint-Maixent",
+				// or the commune of two sites.
+				continue
+			}
+			locationIndex[locationToken] = append(offsets, recordOffset)
+		}
+		for _, scopeKey := range person.scopeKeys {
+			offsets := scopeIndex[scopeKey]
+			if n := len(offsets); n > 0 && offsets[n-1] == recordOffset {
+				continue
+			}
+			scopeIndex[scopeKey] = append(offsets, recordOffset)
+		}
+		for _, phoneticKey := range person.phoneticKeys {
+			offsets := phoneticIndex[phoneticKey]
+			if n := len(offsets); n > 0 && offsets[n-1] == recordOffset {
+				continue
+			}
+			phoneticIndex[phoneticKey] = append(offsets, recordOffset)
 		}
-		numRecords += 1
 	}
+	numRecords := len(people)
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	header := indexFileHeader{
+		nGramSize:       options.nGramSize,
+		optionsChecksum: options.checksum(),
+		numRecords:      numRecords,
 	}
+	copy(header.dataFileSHA256[:], hash.Sum(nil))
+	return &indexTablesBuilder{
+		ngrams:    index,
+		locations: locationIndex,
+		rpps:      rppsIndex,
+		scopes:    scopeIndex,
+		phonetics: phoneticIndex,
+	}, header, nil
+}
 
-	newGramsIndex := &nGramsIndex{
-		nGramSize:        nGramSize,
-		underlyingIndex:  index,
-		recordsData:      r,
-		submitReadsQueue: make(chan readRecordsCom),
-		done:             make(chan struct{}, 1),
-		numRecords:       numRecords,
-	}
-	go newGramsIndex.readServiceWorker()
-	return newGramsIndex, nil
+// activitySite is a data file line of a person with several lines, i.e. activity sites.
+type activitySite struct {
+	offset DatabaseFileOffsetsRecord
+	rank   int
+}
+
+// personSites holds the index entries of a person while their data file lines are scanned.
+type personSites struct {
+	// sites are ordered by rank once all lines are scanned, the first one being the default site.
+	sites          []activitySite
+	ngrams         []string
+	locationTokens []string
+	scopeKeys      []string
+	phoneticKeys   []string
 }
 
 type byHitCount []queryOrderableRecordReadWish
 
-func (a byHitCount) Len() int           { return len(a) }
-func (a byHitCount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byHitCount) Less(i, j int) bool { return a[i].Count > a[j].Count }
+func (a byHitCount) Len() int      { return len(a) }
+func (a byHitCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byHitCount) Less(i, j int) bool {
+	if a[i].Count != a[j].Count {
+		return a[i].Count > a[j].Count
+	}
+	// Keep the order of results deterministic, the file order is as good as any.
+	return a[i].Offset.StartOffset < a[j].Offset.StartOffset
+}
+
+// maxReRankedRecords bounds the number of records read from the file to re-rank ex-aequo results.
+const maxReRankedRecords = 50
 
 type queryResult struct {
 	orderedRecords []rawPersonActivityRecord
+	// matches holds the fields which matched the query, for each of orderedRecords.
+	matches []matchedFields
+	// sites holds all activity sites of the person, for each of orderedRecords.
+	// The record itself is the first one, i.e. the default site.
+	sites [][]rawPersonActivityRecord
+}
+
+// matchedFields is a set of record fields which matched a query.
+type matchedFields uint8
+
+const (
+	matchedName matchedFields = 1 << iota
+	matchedRPPS
+	matchedPostalCode
+	matchedCommune
+)
+
+// Names returns the names of the matched fields, as exposed to users.
+func (m matchedFields) Names() []string {
+	names := make([]string, 0, 4)
+	for _, field := range []struct {
+		flag matchedFields
+		name string
+	}{
+		{matchedRPPS, "rpps"},
+		{matchedName, "name"},
+		{matchedPostalCode, "postal_code"},
+		{matchedCommune, "commune"},
+	} {
+		if m&field.flag != 0 {
+			names = append(names, field.name)
+		}
+	}
+	return names
 }
 
 // query returns the records
-func (ngi *nGramsIndex) query(ctx context.Context, query string, maxNumberResults int) (queryResult, error) {
+func (ngi *nGramsIndex) query(ctx context.Context, query string, maxNumberResults int, minSimilarity float32, options QueryOptions) (queryResult, error) {
+	// Queries may be restricted to a profession or specialty.
+	var scopePostings []postings
+	for _, scopeKey := range options.scopeKeys() {
+		scopePostings = append(scopePostings, ngi.tables.scopes.lookup(scopeKey))
+	}
+	inScope := func(offset int64) bool {
+		for _, offsets := range scopePostings {
+			if !offsets.contains(offset) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// An RPPS number is an exact lookup, which does not need any ranking.
+	if rpps := strings.Join(strings.Fields(query), ""); isRPPSNumber(rpps) {
+		return ngi.queryRPPS(ctx, rpps, inScope)
+	}
+
 	// For user queries, compute the union of ngrams of all (space-padded) words in the query,
 	// e.g. for query "dorier marina", use the union of ngrams from " dorier " and " marina ".
-	queryTokens := strings.Split(query, " ")
+	// Words are split like names are, e.g. "jean-pierre" is made of "jean" and "pierre".
+	queryTokens := nameTokens(query)
 
 	queryNgrams := make(map[string]bool)
+	tokenNgrams := make(map[string][]string, len(queryTokens))
+	// In prefix mode, the last token is not padded at its end as it is still being typed,
+	// e.g. "mart" should match " martin ".
+	isPrefix := func(i int) bool {
+		return options.Prefix && i == len(queryTokens)-1
+	}
 	// 1. divide query into all possible ngrams, of length N.
-	for _, queryToken := range queryTokens {
-		ngms := ngrams(fmt.Sprintf(" %s ", strings.ToLower(queryToken)), ngi.nGramSize)
+	for i, queryToken := range queryTokens {
+		paddedToken := fmt.Sprintf(" %s ", queryToken)
+		if isPrefix(i) {
+			paddedToken = " " + queryToken
+		}
+		ngms := ngrams(paddedToken, ngi.nGramSize)
+		tokenNgrams[queryToken] = ngms
 		for _, ngm := range ngms {
 			queryNgrams[ngm] = true
 		}
 	}
+	if len(queryNgrams) == 0 {
+		return queryResult{orderedRecords: []rawPersonActivityRecord{}}, nil
+	}
+
+	// Query tokens may also be a postal code or part of a commune name,
+	// e.g. for query "martin lyon" or "martin 69003".
+	locationPostings := make(map[string]postings)
+	for _, queryToken := range queryTokens {
+		if offsets := ngi.tables.locations.lookup(queryToken); offsets.Len() > 0 {
+			locationPostings[queryToken] = offsets
+		}
+	}
 
 	// 2. for each above ngram, get possible record offsets
 	resultsCount := make(map[int64]int)
 	resultsValues := make(map[int64]DatabaseFileOffsetsRecord)
+	ngramPostings := make(map[string]postings, len(queryNgrams))
 	for queryNgram := range queryNgrams {
-		offsets := ngi.underlyingIndex[queryNgram]
+		offsets := ngi.tables.ngrams.lookup(queryNgram)
+		ngramPostings[queryNgram] = offsets
 
-		for _, offset := range offsets {
+		for i := 0; i < offsets.Len(); i++ {
+			offset := offsets.At(i)
 			resultsCount[offset.StartOffset] = resultsCount[offset.StartOffset] + 1
 			resultsValues[offset.StartOffset] = offset
 		}
 	}
+	// Records with names which sound like query tokens are candidates too, e.g. "philippe" for "filipe".
+	phoneticPostings := make(map[string]postings)
+	for i, queryToken := range queryTokens {
+		if _, isLocation := locationPostings[queryToken]; isLocation || isPrefix(i) {
+			continue
+		}
+		key := phoneticKey(queryToken)
+		if len(key) < minPhoneticKeyLength {
+			continue
+		}
+		offsets := ngi.tables.phonetics.lookup(key)
+		if offsets.Len() == 0 {
+			continue
+		}
+		phoneticPostings[queryToken] = offsets
+		for i := 0; i < offsets.Len(); i++ {
+			offset := offsets.At(i)
+			if _, ok := resultsCount[offset.StartOffset]; !ok {
+				resultsCount[offset.StartOffset] = 0
+				resultsValues[offset.StartOffset] = offset
+			}
+		}
+	}
+	// Only keep the records of the queried profession or specialty.
+	if len(scopePostings) != 0 {
+		for offset := range resultsCount {
+			if !inScope(offset) {
+				delete(resultsCount, offset)
+			}
+		}
+	}
 
-	// 3. construct an ordered list of: (offset, count / Nq )
-	results := make([]queryOrderableRecordReadWish, len(resultsCount))
-	var i int
+	// 2bis. boost the records with names which sound like the query, and those located where
+	// the query says: the ngrams of a matching
+	// location token count as hits, as if they were part of the record's name.
+	// Only records which are similar enough to the rest of the query get boosted,
+	// so that the location alone does not make for a match.
+	Nq := float32(len(queryNgrams))
+	resultsMatches := make(map[int64]matchedFields, len(resultsCount))
 	for offset, count := range resultsCount {
-		results[i] = queryOrderableRecordReadWish{
+		// Records with names sounding like a query token get half of the token's ngrams they miss,
+		// as sounding alike is not as good as being spelled alike.
+		for queryToken, phoneticOffsets := range phoneticPostings {
+			if !phoneticOffsets.contains(offset) {
+				continue
+			}
+			var missing int
+			for _, ngm := range tokenNgrams[queryToken] {
+				if !ngramPostings[ngm].contains(offset) {
+					missing += 1
+				}
+			}
+			count += (missing + 1) / 2
+		}
+		resultsCount[offset] = count
+
+		matches := matchedName
+		locationNgrams := make(map[string]bool)
+		var credit int
+		for locationToken, locationOffsets := range locationPostings {
+			if !locationOffsets.contains(offset) {
+				continue
+			}
+			if isPostalCode(locationToken) {
+				matches |= matchedPostalCode
+			} else {
+				matches |= matchedCommune
+			}
+			for _, ngm := range ngrams(fmt.Sprintf(" %s ", locationToken), ngi.nGramSize) {
+				if locationNgrams[ngm] {
+					continue
+				}
+				locationNgrams[ngm] = true
+				if !ngramPostings[ngm].contains(offset) {
+					credit += 1
+				}
+			}
+		}
+		if nameNq := Nq - float32(len(locationNgrams)); nameNq > 0 && float32(count)/nameNq < minSimilarity {
+			resultsMatches[offset] = matchedName
+			continue
+		}
+		resultsCount[offset] = count + credit
+		resultsMatches[offset] = matches
+	}
+
+	// 3. construct an ordered list of: (offset, count / Nq ), only keeping records
+	// which contain a minimum share of the query's ngrams.
+	results := make([]queryOrderableRecordReadWish, 0, len(resultsCount))
+	for offset, count := range resultsCount {
+		if float32(count)/Nq < minSimilarity {
+			continue
+		}
+		results = append(results, queryOrderableRecordReadWish{
 			Offset: resultsValues[offset],
 			Count:  count,
-		}
-		i++
+		})
 	}
 	sort.Sort(byHitCount(results))
 
@@ -193,115 +504,173 @@ func (ngi *nGramsIndex) query(ctx context.Context, query string, maxNumberResult
 
 	// 4. Grab the top N (at most) ranked records by seeking in the file to the offset
 	// and reading off all the necessary data.
-	if len(results) > maxNumberResults {
-		results = results[:maxNumberResults]
+	// Records which are ex-aequo with the last one are also read, as they may rank better
+	// once re-ranked below.
+	numToRead := len(results)
+	if numToRead > maxNumberResults {
+		numToRead = maxNumberResults
+		for numToRead < len(results) && results[numToRead].Count == results[maxNumberResults-1].Count {
+			numToRead += 1
+		}
+		if numToRead > maxReRankedRecords {
+			numToRead = maxInt(maxReRankedRecords, maxNumberResults)
+		}
 	}
+	results = results[:numToRead]
 	records, err := ngi.readRecords(ctx, results)
 	if err != nil {
 		return queryResult{}, err
 	}
 
-	// 5. Possibly limit the top ranked records by requiring them to have a minimum probability (0.3 coming from postgresql could be a good start ?) or maybe use an edit distance calculation to prune the results further after this ??
+	// 5. Re-rank any ex-aequo records by using the edit distance between query and record values.
+	// To go around name/lastname issues, all pairings of (query token, lastname | name) are tried
+	// and the best scoring one is kept.
+	distances := make([]int, len(records))
+	for i := range records {
+		distances[i] = nameDistance(queryTokens, records[i].Nom, records[i].Prenom, options.Prefix)
+	}
+	reRanked := make([]int, len(records))
+	for i := range reRanked {
+		reRanked[i] = i
+	}
+	sort.SliceStable(reRanked, func(i, j int) bool {
+		a, b := reRanked[i], reRanked[j]
+		if results[a].Count != results[b].Count {
+			return results[a].Count > results[b].Count
+		}
+		return distances[a] < distances[b]
+	})
 
-	// 6. Possibly re-rank any ex-aequo records by using edit distance between query and record values ?
-	// To go around name/lastname issues, perhaps try all edit distances between the 4 pairs of (query token, lastname | name )
-	// and pick the best scoring pairing ?
+	if len(reRanked) > maxNumberResults {
+		reRanked = reRanked[:maxNumberResults]
+	}
+	orderedRecords := make([]rawPersonActivityRecord, len(reRanked))
+	matches := make([]matchedFields, len(reRanked))
+	for i, recordIndex := range reRanked {
+		orderedRecords[i] = records[recordIndex]
+		matches[i] = resultsMatches[results[recordIndex].Offset.StartOffset]
+	}
+	sites, err := ngi.readSites(ctx, orderedRecords)
+	if err != nil {
+		return queryResult{}, err
+	}
 	return queryResult{
-		orderedRecords: records,
+		orderedRecords: orderedRecords,
+		matches:        matches,
+		sites:          sites,
 	}, nil
 }
 
-func (ngi *nGramsIndex) Close() {
-	ngi.done <- struct{}{}
+// queryRPPS returns the record with the given RPPS number, if it is indexed and in scope.
+func (ngi *nGramsIndex) queryRPPS(ctx context.Context, rpps string, inScope func(int64) bool) (queryResult, error) {
+	offsets := ngi.tables.rpps.lookup(rpps)
+	if offsets.Len() == 0 || !inScope(offsets.At(0).StartOffset) {
+		return queryResult{orderedRecords: []rawPersonActivityRecord{}}, nil
+	}
+	records, err := ngi.readRecords(ctx, []queryOrderableRecordReadWish{{Offset: offsets.At(0)}})
+	if err != nil {
+		return queryResult{}, err
+	}
+	sites, err := ngi.readSites(ctx, records)
+	if err != nil {
+		return queryResult{}, err
+	}
+	return queryResult{
+		orderedRecords: records,
+		matches:        []matchedFields{matchedRPPS},
+		sites:          sites,
+	}, nil
 }
 
-var EmptyReadsError = errors.New("index worker recieved empty read request")
-
-func (ngi *nGramsIndex) readServiceWorker() {
-	defer ngi.recordsData.Close()
-
-	// 2kB should be fine for most records.
-	const BufferSize = 2 * 1024
-	b := make([]byte, BufferSize)
-
-	for {
-		select {
-		case <-ngi.done:
-			return
-		case com := <-ngi.submitReadsQueue:
-			// A new wish for reads has come in.
-			// First check if a programming mistake was made and the reads slice is actually empty !
-			if len(com.readWishes) == 0 {
-				com.readRecordsErrChan <- EmptyReadsError
-			}
-			// Loop over them and seek to the correct position to read out the data.
-			for _, readWish := range com.readWishes {
-				_, err := ngi.recordsData.Seek(readWish.Offset.StartOffset, io.SeekStart)
-				// If an error occurs, stop immediately as we want all records or none.
-				if err != nil {
-					com.readRecordsErrChan <- err
-					break
-				}
-
-				// Avoid allocating a buffer each time and reuse the one we have.
-				if uint32(cap(b)) >= readWish.Offset.Length {
-					b = b[:readWish.Offset.Length]
-				} else {
-					b = make([]byte, readWish.Offset.Length)
-				}
+// readSites returns the activity sites of each of the records, which are their default site.
+func (ngi *nGramsIndex) readSites(ctx context.Context, records []rawPersonActivityRecord) ([][]rawPersonActivityRecord, error) {
+	sites := make([][]rawPersonActivityRecord, len(records))
+	for i := range records {
+		offsets := ngi.tables.rpps.lookup(records[i].RPPS())
+		if offsets.Len() <= 1 {
+			sites[i] = records[i : i+1]
+			continue
+		}
+		readWishes := make([]queryOrderableRecordReadWish, offsets.Len()-1)
+		for j := range readWishes {
+			readWishes[j] = queryOrderableRecordReadWish{Offset: offsets.At(j + 1)}
+		}
+		otherSites, err := ngi.readRecords(ctx, readWishes)
+		if err != nil {
+			return nil, err
+		}
+		sites[i] = append([]rawPersonActivityRecord{records[i]}, otherSites...)
+	}
+	return sites, nil
+}
 
-				_, err = io.ReadFull(ngi.recordsData, b)
-				if err != nil {
-					com.readRecordsErrChan <- err
-					break
-				}
+// isRPPSNumber returns whether s looks like an RPPS number, i.e. it is made of 11 digits.
+func isRPPSNumber(s string) bool {
+	return len(s) == 11 && isDigits(s)
+}
 
-				line := string(b)
-				record, err := parseRecordFromLine(line)
-				if err != nil {
-					com.readRecordsErrChan <- err
-					break
-				}
+func isPostalCode(s string) bool {
+	return len(s) == 5 && isDigits(s)
+}
 
-				com.readRecordsChan <- record
-			}
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
 		}
 	}
+	return true
 }
 
+// Close releases the index data and closes the data file. It must only be called once no
+// queries are using the index.
+func (ngi *nGramsIndex) Close() {
+	ngi.closeOnce.Do(func() {
+		ngi.recordsData.Close()
+		ngi.releaseData()
+	})
+}
+
+// readRecords returns the records of readWishes, in the same order.
+//
+// Records are read from the cache when there is one, and with ReadAt otherwise, so that
+// concurrent queries do not wait on each other to read the data file.
 func (ngi *nGramsIndex) readRecords(ctx context.Context, readWishes []queryOrderableRecordReadWish) ([]rawPersonActivityRecord, error) {
-	if len(readWishes) == 0 {
-		return []rawPersonActivityRecord{}, nil
-	}
 	records := make([]rawPersonActivityRecord, len(readWishes))
+	var b []byte
+	for i, readWish := range readWishes {
+		if ngi.cache != nil {
+			if record, ok := ngi.cache.record(readWish.Offset.StartOffset); ok {
+				records[i] = record
+				continue
+			}
+		}
+		// Stop reading if the query was cancelled in the meantime, as we want all records or none.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-	// It's important for these channels to have sufficient buffering to avoid
-	// blocking the worker which will be servicing these channels.
-	readResultsChan := make(chan *rawPersonActivityRecord, len(readWishes))
-	readResultsErrChan := make(chan error, 1)
-	com := readRecordsCom{
-		readWishes:         readWishes,
-		readRecordsChan:    readResultsChan,
-		readRecordsErrChan: readResultsErrChan,
-	}
-
-	var successfullyRead int
-	for {
-		select {
-		case ngi.submitReadsQueue <- com:
-			// This is the first operation that should succeed, allowing the records to be read.
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case err := <-readResultsErrChan:
+		if err := checkPosting(readWish.Offset); err != nil {
 			return nil, err
-		case record := <-readResultsChan:
-			records[successfullyRead] = *record
-			successfullyRead += 1
-			if successfullyRead >= len(readWishes) {
-				return records, nil
-			}
 		}
+		// Avoid allocating a buffer for each record and reuse the one we have.
+		if uint32(cap(b)) >= readWish.Offset.Length {
+			b = b[:readWish.Offset.Length]
+		} else {
+			b = make([]byte, readWish.Offset.Length)
+		}
+		// ReadAt may return io.EOF along with a full read of the last record of the file.
+		if n, err := ngi.recordsData.ReadAt(b, readWish.Offset.StartOffset); n < len(b) {
+			return nil, err
+		}
+
+		record, err := ngi.columns.parseRecord(string(b))
+		if err != nil {
+			return nil, err
+		}
+		records[i] = *record
 	}
+	return records, nil
 }
 
 // Returns a list of ngrams of the given UTF-8 string.
@@ -373,55 +742,156 @@ func insertOffset(offset DatabaseFileOffsetsRecord, sortedOffsets []DatabaseFile
 	}
 }
 
+// rawPersonActivityRecord holds the used columns of a data file line, see recordColumns.
 type rawPersonActivityRecord struct {
-	PPIdType                     uint8  // 0 e.g. "8" for an RPPS ID
-	PPId                         string // 1 e.g. "10101236759"
-	Nom                          string // 7
-	Prenom                       string // 8
-	CodeProfession               string // 9  e.g. "10" for a doctor
-	LibelleProfession            string // 10 e.g. "Medecin"
-	CodeCategorieProfessionnelle string // 11 e.g. "M" for "Militaire" or "C" for "Civil"
-	CodeSavoirFaire              string // 15
-	CodeModeExercice             string // 17 e.g. "L" for "Liberal" or "S" for "Salarié"
-	NumeroVoie                   string // 28 e.g. "68"
-	IndiceRepetitionVoie         string // 29 e.g. "bis"
-	LibelleTypeDeVoie            string // 31 e.g. "rue" or "avenue"
-	LibelleVoie                  string // 32 e.g. "des Lilas"
-	CodePostal                   string // 35 e.g. "75016"
-	LibelleCommune               string // 37 e.g. "Paris"
-}
-
-func (rec *rawPersonActivityRecord) shouldBeIndexed() bool {
-	// Check that our ID is of type "RPPS" (i.e 8), that the profession is "Doctor" (i.e 10)
-	if rec.PPIdType == 8 && rec.CodeProfession == "10" {
-		// Eliminate military.
-		if rec.CodeCategorieProfessionnelle == "M" {
-			return false
-		}
+	PPIdType                     uint8  // e.g. "8" for an RPPS ID
+	PPId                         string // e.g. "10101236759"
+	LibelleCiviliteExercice      string // e.g. "Docteur"
+	Nom                          string
+	Prenom                       string
+	CodeProfession               string // e.g. "10" for a doctor
+	LibelleProfession            string // e.g. "Medecin"
+	CodeCategorieProfessionnelle string // e.g. "M" for "Militaire" or "C" for "Civil"
+	CodeSavoirFaire              string // e.g. "SM54"
+	LibelleSavoirFaire           string // e.g. "Médecine Générale (SM54)"
+	CodeModeExercice             string // e.g. "L" for "Liberal" or "S" for "Salarié"
+	NumeroVoie                   string // e.g. "68"
+	IndiceRepetitionVoie         string // e.g. "bis"
+	LibelleTypeDeVoie            string // e.g. "rue" or "avenue"
+	LibelleVoie                  string // e.g. "des Lilas"
+	CodePostal                   string // e.g. "75016"
+	LibelleCommune               string // e.g. "Paris"
+}
 
-		// // see https://www.legifrance.gouv.fr/affichTexte.do?cidTexte=JORFTEXT000028339198
-		// // see https://mos.esante.gouv.fr/NOS/TRE_R38-SpecialiteOrdinale/TRE_R38-SpecialiteOrdinale.pdf
-		// // see https://esante.gouv.fr/sites/default/files/media_entity/documents/TableauReglesEnregistrementPS_RPPS_0.pdf
-		if rec.CodeSavoirFaire != "SM26" && rec.CodeSavoirFaire != "SM53" && rec.CodeSavoirFaire != "SM54" {
-			return false
-		}
+// numRecordStringFields is the number of string fields of a rawPersonActivityRecord.
+const numRecordStringFields = 16
+
+// stringFields returns pointers to the string fields of rec, always in the same order.
+func (rec *rawPersonActivityRecord) stringFields() [numRecordStringFields]*string {
+	return [numRecordStringFields]*string{
+		&rec.PPId, &rec.LibelleCiviliteExercice, &rec.Nom, &rec.Prenom,
+		&rec.CodeProfession, &rec.LibelleProfession, &rec.CodeCategorieProfessionnelle,
+		&rec.CodeSavoirFaire, &rec.LibelleSavoirFaire, &rec.CodeModeExercice,
+		&rec.NumeroVoie, &rec.IndiceRepetitionVoie, &rec.LibelleTypeDeVoie, &rec.LibelleVoie,
+		&rec.CodePostal, &rec.LibelleCommune,
+	}
+}
 
-		// We're quite trusting on the other fields, but check that at least the name is valid UTF-8.
-		if utf8.ValidString(rec.Nom) && utf8.ValidString(rec.Prenom) {
-			return true
+func (rec *rawPersonActivityRecord) shouldBeIndexed(professions []ProfessionFilter) bool {
+	// Check that our ID is of type "RPPS" (i.e 8).
+	if rec.PPIdType != 8 {
+		return false
+	}
+	// Eliminate military.
+	if rec.CodeCategorieProfessionnelle == "M" {
+		return false
+	}
+
+	// // see https://www.legifrance.gouv.fr/affichTexte.do?cidTexte=JORFTEXT000028339198
+	// // see https://mos.esante.gouv.fr/NOS/TRE_R38-SpecialiteOrdinale/TRE_R38-SpecialiteOrdinale.pdf
+	// // see https://esante.gouv.fr/sites/default/files/media_entity/documents/TableauReglesEnregistrementPS_RPPS_0.pdf
+	matchesProfession := false
+	for _, filter := range professions {
+		if filter.matches(rec) {
+			matchesProfession = true
+			break
 		}
 	}
-	return false
+	if !matchesProfession {
+		return false
+	}
+
+	// We're quite trusting on the other fields, but check that at least the name is valid UTF-8.
+	return utf8.ValidString(rec.Nom) && utf8.ValidString(rec.Prenom)
+}
+
+// scopeKeys returns the keys of the scopes table the record is part of,
+// i.e. its profession and specialty.
+func (rec *rawPersonActivityRecord) scopeKeys() []string {
+	keys := []string{professionScopeKey(rec.CodeProfession)}
+	if rec.CodeSavoirFaire != "" {
+		keys = append(keys, specialtyScopeKey(rec.CodeSavoirFaire))
+	}
+	return keys
+}
+
+// siteRank orders the activity sites of a person, the lowest rank being the best default site:
+// liberal practice comes first, then sites with an address.
+func (rec *rawPersonActivityRecord) siteRank() int {
+	rank := 0
+	switch strings.TrimSpace(rec.CodeModeExercice) {
+	case "L":
+	case "S":
+		rank += 2
+	case "B":
+		rank += 4
+	default:
+		rank += 6
+	}
+	if rec.Address() == "" {
+		rank += 1
+	}
+	return rank
+}
+
+// Profession returns the label of the person's profession, e.g. "Médecin".
+func (rec *rawPersonActivityRecord) Profession() string {
+	return strings.TrimSpace(rec.LibelleProfession)
 }
 
 func (rec *rawPersonActivityRecord) RPPS() string {
 	return rec.PPId
 }
 
+func (rec *rawPersonActivityRecord) FirstName() string {
+	return strings.Title(strings.ToLower(strings.TrimSpace(rec.Prenom)))
+}
+
+func (rec *rawPersonActivityRecord) LastName() string {
+	return strings.Title(strings.ToLower(strings.TrimSpace(rec.Nom)))
+}
+
 func (rec *rawPersonActivityRecord) FullName() string {
-	firstName := strings.Title(strings.ToLower(rec.Prenom))
-	lastName := strings.Title(strings.ToLower(rec.Nom))
-	return fmt.Sprintf("%s %s", firstName, lastName)
+	return fmt.Sprintf("%s %s", rec.FirstName(), rec.LastName())
+}
+
+// Title returns the honorific used by the person for their practice, e.g. "Docteur".
+func (rec *rawPersonActivityRecord) Title() string {
+	return strings.TrimSpace(rec.LibelleCiviliteExercice)
+}
+
+// Specialty returns the label of the person's specialty, without the code that usually ends it,
+// e.g. "Médecine Générale" for "Médecine Générale (SM54)".
+func (rec *rawPersonActivityRecord) Specialty() string {
+	label := strings.TrimSpace(rec.LibelleSavoirFaire)
+	codeSuffix := fmt.Sprintf("(%s)", strings.TrimSpace(rec.CodeSavoirFaire))
+	if codeSuffix != "()" && strings.HasSuffix(label, codeSuffix) {
+		label = strings.TrimSpace(strings.TrimSuffix(label, codeSuffix))
+	}
+	return label
+}
+
+// ExerciseMode returns how the person practices, i.e. "libéral", "salarié" or "bénévole",
+// and an empty string if it is unknown.
+func (rec *rawPersonActivityRecord) ExerciseMode() string {
+	switch strings.TrimSpace(rec.CodeModeExercice) {
+	case "L":
+		return "libéral"
+	case "S":
+		return "salarié"
+	case "B":
+		return "bénévole"
+	default:
+		return ""
+	}
+}
+
+func (rec *rawPersonActivityRecord) PostalCode() string {
+	return strings.TrimSpace(rec.CodePostal)
+}
+
+func (rec *rawPersonActivityRecord) Commune() string {
+	return strings.ToUpper(strings.TrimSpace(rec.LibelleCommune))
 }
 
 func (rec *rawPersonActivityRecord) Address() string {
@@ -469,36 +939,40 @@ func (rec *rawPersonActivityRecord) Address() string {
 }
 
 func (rec *rawPersonActivityRecord) computeAllNGrams(N int) []string {
-	gramsFirst := ngrams(fmt.Sprintf(" %s ", strings.ToLower(rec.Prenom)), N)
-	gramsLast := ngrams(fmt.Sprintf(" %s ", strings.ToLower(rec.Nom)), N)
-	return append(gramsFirst, gramsLast...)
+	var grams []string
+	for _, token := range append(nameTokens(rec.Prenom), nameTokens(rec.Nom)...) {
+		grams = append(grams, ngrams(fmt.Sprintf(" %s ", token), N)...)
+	}
+	return grams
 }
 
-func parseRecordFromLine(line string) (*rawPersonActivityRecord, error) {
-	cols := strings.Split(line, "|")
-	if len(cols) != 53 {
-		return nil, fmt.Errorf("unexpected number of columns (%d)", len(cols))
-	}
-	ppIdType, err := strconv.ParseUint(cols[0], 10, 8)
-	if err != nil {
-		return nil, err
+// phoneticKeys returns the phonetic keys of the words of the record's names.
+func (rec *rawPersonActivityRecord) phoneticKeys() []string {
+	var keys []string
+	for _, token := range append(nameTokens(rec.Prenom), nameTokens(rec.Nom)...) {
+		if key := phoneticKey(token); len(key) >= minPhoneticKeyLength {
+			keys = append(keys, key)
+		}
 	}
+	return keys
+}
 
-	return &rawPersonActivityRecord{
-		PPIdType:                     uint8(ppIdType),
-		PPId:                         cols[1],
-		Nom:                          cols[7],
-		Prenom:                       cols[8],
-		CodeProfession:               cols[9],
-		LibelleProfession:            cols[10],
-		CodeCategorieProfessionnelle: cols[11],
-		CodeSavoirFaire:              cols[15],
-		CodeModeExercice:             cols[17],
-		NumeroVoie:                   cols[28],
-		IndiceRepetitionVoie:         cols[29],
-		LibelleTypeDeVoie:            cols[31],
-		LibelleVoie:                  cols[32],
-		CodePostal:                   cols[35],
-		LibelleCommune:               cols[37],
-	}, nil
+// locationTokens returns the normalized postal code and commune words of the record,
+// which can be used in queries to look for doctors in a given place.
+func (rec *rawPersonActivityRecord) locationTokens() []string {
+	var tokens []string
+	if codePostal := strings.TrimSpace(rec.CodePostal); codePostal != "" {
+		tokens = append(tokens, codePostal)
+	}
+	commune := strings.ToLower(removeAccents(rec.LibelleCommune))
+	communeWords := strings.FieldsFunc(commune, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '\''
+	})
+	for _, word := range communeWords {
+		// Skip short words such as "le" or "en", which would match too much.
+		if utf8.RuneCountInString(word) >= 3 {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
 }
@@ -0,0 +1,360 @@
+package doctorsearch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"autocontract/pkg/doctorsearch/synthetic"
+
+	"github.com/rs/zerolog"
+)
+
+const fixtureFilePath = "testdata/PS_LibreAcces_Personne_activite_fixture.txt"
+
+var fixtureIndexOptions = indexOptions{nGramSize: 3, professions: DefaultProfessionFilters}
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+func newFixtureIndex(t *testing.T) *nGramsIndex {
+	f, err := os.Open(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := newNGramsIndex(f, fixtureIndexOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(index.Close)
+	return index
+}
+
+func queryRPPS(t *testing.T, index *nGramsIndex, query string, maxNumberResults int, minSimilarity float32) []string {
+	res, err := index.query(context.Background(), query, maxNumberResults, minSimilarity, QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpps := make([]string, len(res.orderedRecords))
+	for i, rec := range res.orderedRecords {
+		rpps[i] = rec.RPPS()
+	}
+	return rpps
+}
+
+func expectRPPS(t *testing.T, query string, got []string, expected ...string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Errorf("query '%s' returned %v, expected %v", query, got, expected)
+		return
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("query '%s' returned %v, expected %v", query, got, expected)
+			return
+		}
+	}
+}
+
+func TestIndexSkipsRecords(t *testing.T) {
+	index := newFixtureIndex(t)
+
+	// Pharmacists, dentists, midwives, military, other specialties and ADELI IDs are left out,
+	// and the same RPPS is only indexed once.
+	if index.numRecords != 9 {
+		t.Errorf("indexed %d records, expected 9", index.numRecords)
+	}
+	for _, query := range []string{"marc durand", "julie moreau", "fontaine", "garnier", "bernard", "adeli"} {
+		expectRPPS(t, query, queryRPPS(t, index, query, 5, 0.3))
+	}
+	expectRPPS(t, "dupont", queryRPPS(t, index, "dupont", 5, 0.3), "10000000006")
+}
+
+func TestQueryReRanksExAequoRecords(t *testing.T) {
+	index := newFixtureIndex(t)
+
+	// LEFEBVRE and LEFEVRIER share as many ngrams with the query,
+	// but LEFEBVRE is closer in edit distance.
+	expectRPPS(t, "lefevre", queryRPPS(t, index, "lefevre", 5, 0.3),
+		"10000000014", "10000000005", "10000000004")
+
+	// The re-ranking also happens past the maximum number of results.
+	expectRPPS(t, "lefevre", queryRPPS(t, index, "lefevre", 2, 0.3),
+		"10000000014", "10000000005")
+
+	// First and last names can be given in any order.
+	for _, query := range []string{"pierre martin", "martin pierre", "Martin  PIERRE"} {
+		expectRPPS(t, query, queryRPPS(t, index, query, 3, 0.3),
+			"10000000001", "10000000002", "10000000003")
+	}
+}
+
+func TestQueryMinSimilarity(t *testing.T) {
+	index := newFixtureIndex(t)
+
+	// Only the "lef" ngram matches, which is too little.
+	expectRPPS(t, "zzzlef", queryRPPS(t, index, "zzzlef", 5, 0.3))
+
+	if got := queryRPPS(t, index, "zzzlef", 5, 0); len(got) != 3 {
+		t.Errorf("query 'zzzlef' without minimum similarity returned %v, expected 3 records", got)
+	}
+
+	expectRPPS(t, "", queryRPPS(t, index, "  ", 5, 0))
+}
+
+func TestQueryRPPS(t *testing.T) {
+	index := newFixtureIndex(t)
+
+	for _, query := range []string{"10000000006", " 100 000 000 06 "} {
+		res, err := index.query(context.Background(), query, 5, 0.3, QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.orderedRecords) != 1 || res.orderedRecords[0].Nom != "DUPONT" {
+			t.Fatalf("query '%s' returned %v, expected DUPONT", query, res.orderedRecords)
+		}
+		if names := res.matches[0].Names(); len(names) != 1 || names[0] != "rpps" {
+			t.Errorf("query '%s' matched %v, expected rpps", query, names)
+		}
+	}
+
+	// Records which are not indexed can't be looked up either.
+	expectRPPS(t, "10000000007", queryRPPS(t, index, "10000000007", 5, 0.3))
+}
+
+func TestQueryLocation(t *testing.T) {
+	index := newFixtureIndex(t)
+
+	tests := []struct {
+		query         string
+		expectedRPPS  []string
+		expectedMatch []string
+	}{
+		{"martin", []string{"10000000001", "10000000003", "10000000002"}, []string{"name"}},
+		{"martin bordeaux", []string{"10000000003", "10000000001", "10000000002"}, []string{"name", "commune"}},
+		{"martin 75002", []string{"10000000001", "10000000003", "10000000002"}, []string{"name", "postal_code"}},
+		{"Lyon Pierre", []string{"10000000002", "10000000001", "10000000003"}, []string{"name", "commune"}},
+	}
+	for _, test := range tests {
+		res, err := index.query(context.Background(), test.query, 5, 0.3, QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(res.orderedRecords))
+		for i, rec := range res.orderedRecords {
+			got[i] = rec.RPPS()
+		}
+		expectRPPS(t, test.query, got, test.expectedRPPS...)
+
+		if len(res.matches) == 0 {
+			continue
+		}
+		names := res.matches[0].Names()
+		if len(names) != len(test.expectedMatch) {
+			t.Errorf("query '%s' matched %v, expected %v", test.query, names, test.expectedMatch)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expectedMatch[i] {
+				t.Errorf("query '%s' matched %v, expected %v", test.query, names, test.expectedMatch)
+				break
+			}
+		}
+	}
+}
+
+func TestRecordFields(t *testing.T) {
+	index := newFixtureIndex(t)
+
+	res, err := index.query(context.Background(), "jean lefebvre", 1, 0.3, QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.orderedRecords) != 1 {
+		t.Fatalf("expected a single record, got %v", res.orderedRecords)
+	}
+	rec := res.orderedRecords[0]
+	for _, field := range []struct{ name, value, expected string }{
+		{"first name", rec.FirstName(), "Jean"},
+		{"last name", rec.LastName(), "Lefebvre"},
+		{"title", rec.Title(), "Docteur"},
+		{"specialty", rec.Specialty(), "Spécialiste en Médecine Générale"},
+		{"exercise mode", rec.ExerciseMode(), "libéral"},
+		{"postal code", rec.PostalCode(), "59000"},
+		{"commune", rec.Commune(), "LILLE"},
+	} {
+		if field.value != field.expected {
+			t.Errorf("%s = '%s', expected '%s'", field.name, field.value, field.expected)
+		}
+	}
+}
+
+func TestQuerySites(t *testing.T) {
+	index := newFixtureIndex(t)
+
+	// Philippe Lefevre's salaried site comes first in the file, but the liberal one is the default,
+	// and he can be found by the location of either.
+	for _, query := range []string{"philippe lefevre", "philippe lefevre 35400", "10000000014"} {
+		res, err := index.query(context.Background(), query, 1, 0.3, QueryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.orderedRecords) != 1 || res.orderedRecords[0].RPPS() != "10000000014" {
+			t.Fatalf("query '%s' returned %v", query, res.orderedRecords)
+		}
+		sites := doctorSites(res.sites[0])
+		expected := []DoctorSite{
+			{Address: "31 rue Jean Jaurès, 35000 RENNES", ExerciseMode: "libéral", PostalCode: "35000", Commune: "RENNES"},
+			{Address: "1 rue De La Marne, 35400 SAINT-MALO", ExerciseMode: "salarié", PostalCode: "35400", Commune: "SAINT-MALO"},
+		}
+		if !reflect.DeepEqual(sites, expected) {
+			t.Errorf("query '%s' returned sites %+v, expected %+v", query, sites, expected)
+		}
+	}
+
+	// Hélène Dupont's salaried site has no address.
+	res, err := index.query(context.Background(), "10000000006", 1, 0.3, QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.sites[0]) != 2 || res.sites[0][0].ExerciseMode() != "libéral" {
+		t.Errorf("unexpected sites %+v", res.sites[0])
+	}
+	if sites := doctorSites(res.sites[0]); len(sites) != 1 {
+		t.Errorf("unexpected sites %+v", sites)
+	}
+}
+
+func TestQueryPrefix(t *testing.T) {
+	index := newFixtureIndex(t)
+	prefix := func(query string, maxNumberResults int) []string {
+		res, err := index.query(context.Background(), query, maxNumberResults, 0.3, QueryOptions{Prefix: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpps := make([]string, len(res.orderedRecords))
+		for i, rec := range res.orderedRecords {
+			rpps[i] = rec.RPPS()
+		}
+		return rpps
+	}
+
+	expectRPPS(t, "mar", prefix("mar", 5), "10000000001", "10000000002", "10000000003")
+	expectRPPS(t, "lefe", prefix("lefe", 5), "10000000004", "10000000005", "10000000014")
+	// Results stay the same as users type, until the name tells them apart.
+	for _, query := range []string{"pierre ma", "pierre mar", "pierre mart", "pierre marti", "pierre martin"} {
+		expectRPPS(t, query, prefix(query, 2), "10000000001", "10000000002")
+	}
+	expectRPPS(t, "pierre martine", prefix("pierre martine", 2), "10000000002", "10000000001")
+
+	// Short queries are allowed in prefix mode, unless the last word is complete.
+	dr := New(filepath.Join(tmpDir(t), "missing.txt"), Config{
+		NGramSize:            3,
+		MaxUserQueryLength:   100,
+		MaxConcurrentQueries: 10,
+		MaxQueryDuration:     time.Second,
+		MinSimilarity:        0.3,
+	})
+	for _, test := range []struct {
+		query    string
+		prefix   bool
+		expected error
+	}{
+		{"ma", false, ErrInvalidUserQuery},
+		{"ma", true, ErrTemporarilyUnavailable},
+		{"ma ", true, ErrInvalidUserQuery},
+		{"m", true, ErrInvalidUserQuery},
+	} {
+		_, err := dr.Query(context.Background(), test.query, 5, QueryOptions{Prefix: test.prefix})
+		if !errors.Is(err, test.expected) {
+			t.Errorf("query '%s' (prefix %t) returned error %v, expected %v", test.query, test.prefix, err, test.expected)
+		}
+	}
+}
+
+func TestSyntheticData(t *testing.T) {
+	dataFilePath, people := writeBenchmarkDataFile(t, 2000)
+	f, err := os.Open(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := newNGramsIndex(f, fixtureIndexOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	var expected []synthetic.Person
+	for _, person := range people {
+		rec := rawPersonActivityRecord{PPIdType: 8, CodeProfession: person.ProfessionCode, CodeSavoirFaire: person.Specialty, CodeCategorieProfessionnelle: "C"}
+		if person.IDType == "8" && !person.Military && rec.shouldBeIndexed(DefaultProfessionFilters) {
+			expected = append(expected, person)
+		}
+	}
+	if index.numRecords != len(expected) {
+		t.Errorf("%d records indexed instead of %d", index.numRecords, len(expected))
+	}
+	for _, person := range expected[:10] {
+		rec := queryRecord(t, index, person.ID)
+		if rec.Nom != person.LastName || rec.Prenom != person.FirstName {
+			t.Errorf("got record %+v for %+v", rec, person)
+		}
+	}
+}
+
+func BenchmarkNewNGramsIndex(b *testing.B) {
+	dataFilePath, _ := writeBenchmarkDataFile(b, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(dataFilePath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		index, err := newNGramsIndex(f, fixtureIndexOptions)
+		if err != nil {
+			b.Fatal(err)
+		}
+		index.Close()
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	dataFilePath, _ := writeBenchmarkDataFile(b, 20000)
+	f, err := os.Open(dataFilePath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	index, err := newNGramsIndex(f, fixtureIndexOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer index.Close()
+
+	benchmarks := []struct {
+		name    string
+		query   string
+		options QueryOptions
+	}{
+		{"name", "pierre martin", QueryOptions{}},
+		{"typo", "piere martn", QueryOptions{}},
+		{"common name", "martin", QueryOptions{}},
+		{"location", "martin 75016", QueryOptions{}},
+		{"prefix", "pierre mar", QueryOptions{Prefix: true}},
+		{"rpps", "10000001234", QueryOptions{}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := index.query(context.Background(), bm.query, 5, 0.3, bm.options); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package doctorsearch
+
+import (
+	"strings"
+)
+
+// nameTokens splits a name into lowercase words without accents, e.g. "Jean-Pierre" into
+// "jean" and "pierre". Words with an apostrophe are also kept whole, e.g. "D'Artagnan"
+// gives "d", "artagnan" and "dartagnan".
+func nameTokens(name string) []string {
+	name = strings.ToLower(removeAccents(name))
+	var tokens []string
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == ' ' || r == '-' }) {
+		parts := strings.FieldsFunc(word, isApostrophe)
+		tokens = append(tokens, parts...)
+		if len(parts) > 1 {
+			tokens = append(tokens, strings.Join(parts, ""))
+		}
+	}
+	return tokens
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’'
+}
+
+const (
+	// maxPhoneticKeyLength bounds the length of phonetic keys, as with most Soundex variants.
+	maxPhoneticKeyLength = 4
+	// minPhoneticKeyLength avoids indexing keys matching too many names, e.g. "R" for "Roy".
+	minPhoneticKeyLength = 2
+)
+
+var (
+	// Letter groups which sound the same, replaced first.
+	phoneticGroups = strings.NewReplacer(
+		"GUI", "KI", "GUE", "KE", "GA", "KA", "GO", "KO", "GU", "K",
+		"CA", "KA", "CO", "KO", "CU", "KU", "Q", "K", "CC", "K", "CK", "K",
+		// e.g. "Philippe" and "Filipe", or "Lefebvre" and "Lefèvre".
+		"PH", "F", "BV", "V",
+	)
+	phoneticPrefixes = []struct{ prefix, replacement string }{
+		{"KN", "NN"}, {"PF", "FF"}, {"SCH", "SSS"}, {"MAC", "MCC"},
+	}
+)
+
+// phoneticKey returns a key for a word such that French words which sound alike,
+// e.g. "Philippe" and "Filipe", have the same key.
+//
+// This is a variant of the "Soundex2" algorithm by Frédéric Brouard, an adaptation
+// of Soundex to the French language.
+func phoneticKey(word string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(removeAccents(word)) {
+		if r >= 'A' && r <= 'Z' {
+			sb.WriteRune(r)
+		}
+	}
+	s := sb.String()
+	if s == "" {
+		return ""
+	}
+
+	s = phoneticGroups.Replace(s)
+
+	// Vowels other than the first letter all sound alike.
+	b := []byte(s)
+	for i := 1; i < len(b); i++ {
+		switch b[i] {
+		case 'E', 'I', 'O', 'U':
+			b[i] = 'A'
+		}
+	}
+	s = string(b)
+
+	for _, p := range phoneticPrefixes {
+		if strings.HasPrefix(s, p.prefix) {
+			s = p.replacement + s[len(p.prefix):]
+			break
+		}
+	}
+	// An S between two vowels sounds like a Z.
+	s = strings.ReplaceAll(s, "ASA", "AZA")
+
+	// Silent letters: H unless it follows C or S, Y unless it follows A,
+	// and a final A, D, T or S.
+	b = b[:0]
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == 'H' && i != 0 && s[i-1] != 'C' && s[i-1] != 'S' {
+			continue
+		}
+		if c == 'Y' && i != 0 && s[i-1] != 'A' {
+			continue
+		}
+		b = append(b, c)
+	}
+	if n := len(b); n > 1 {
+		switch b[n-1] {
+		case 'A', 'D', 'T', 'S':
+			b = b[:n-1]
+		}
+	}
+
+	// Drop vowels apart from the first letter, and repeated letters.
+	key := []byte{b[0]}
+	for _, c := range b[1:] {
+		if c == 'A' || c == key[len(key)-1] {
+			continue
+		}
+		key = append(key, c)
+		if len(key) == maxPhoneticKeyLength {
+			break
+		}
+	}
+	return string(key)
+}
@@ -0,0 +1,80 @@
+package doctorsearch
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNameTokens(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected []string
+	}{
+		{"Jean-Pierre", []string{"jean", "pierre"}},
+		{"D'ARTAGNAN", []string{"d", "artagnan", "dartagnan"}},
+		{"Hélène  Le Bœuf", []string{"helene", "le", "bœuf"}},
+		{"N’Diaye", []string{"n", "diaye", "ndiaye"}},
+	} {
+		if tokens := nameTokens(test.name); !reflect.DeepEqual(tokens, test.expected) {
+			t.Errorf("nameTokens(%s) = %v, expected %v", test.name, tokens, test.expected)
+		}
+	}
+}
+
+func TestPhoneticKey(t *testing.T) {
+	for _, alike := range [][]string{
+		{"Philippe", "Filipe"},
+		{"Lefebvre", "Lefèvre", "LEFEVRE"},
+		{"Catherine", "Kathrine"},
+		{"Dupont", "Dupond"},
+		{"Thomas", "Tomas"},
+	} {
+		key := phoneticKey(alike[0])
+		for _, word := range alike[1:] {
+			if phoneticKey(word) != key {
+				t.Errorf("'%s' has key '%s', expected '%s' like '%s'", word, phoneticKey(word), key, alike[0])
+			}
+		}
+	}
+	for _, different := range [][2]string{
+		{"Martin", "Bernard"},
+		{"Pierre", "Pierrette"},
+	} {
+		if phoneticKey(different[0]) == phoneticKey(different[1]) {
+			t.Errorf("'%s' and '%s' have the same key", different[0], different[1])
+		}
+	}
+}
+
+func TestQueryPhonetic(t *testing.T) {
+	newIndex := func(phonetic bool) *nGramsIndex {
+		f, err := os.Open(fixtureFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options := fixtureIndexOptions
+		options.phonetic = phonetic
+		index, err := newNGramsIndex(f, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(index.Close)
+		return index
+	}
+	index := newIndex(true)
+
+	// Accents, hyphens and apostrophes don't matter.
+	expectRPPS(t, "helene dupont", queryRPPS(t, index, "helene dupont", 1, 0.3), "10000000006")
+	expectRPPS(t, "hélène du-pont", queryRPPS(t, index, "hélène du-pont", 1, 0.3), "10000000006")
+
+	// Names which sound alike rank better, but not as well as names spelled alike.
+	query := "pierre dupond"
+	expectRPPS(t, query, queryRPPS(t, newIndex(false), query, 5, 0.3), "10000000001", "10000000002", "10000000003", "10000000006")
+	expectRPPS(t, query, queryRPPS(t, index, query, 5, 0.3), "10000000001", "10000000002", "10000000006", "10000000003")
+
+	// Names which sound alike can be enough to match.
+	query = "filip martan"
+	expectRPPS(t, query, queryRPPS(t, newIndex(false), query, 5, 0.3))
+	expectRPPS(t, query, queryRPPS(t, index, query, 5, 0.3), "10000000001", "10000000002", "10000000003", "10000000014")
+}
@@ -0,0 +1,137 @@
+package doctorsearch
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// ProfessionFilter selects records of a profession to be indexed.
+//
+// Profession and specialty codes are those of the RPPS, see
+// https://mos.esante.gouv.fr/NOS/TRE_G15-ProfessionSante/TRE_G15-ProfessionSante.pdf and
+// https://mos.esante.gouv.fr/NOS/TRE_R38-SpecialiteOrdinale/TRE_R38-SpecialiteOrdinale.pdf
+type ProfessionFilter struct {
+	// Code is the profession code, e.g. "10" for doctors or "40" for dentists.
+	Code string
+	// Specialties lists the specialty (savoir-faire) codes to index, e.g. "SM54" for general practice.
+	// When empty, all records of the profession are indexed.
+	Specialties []string
+}
+
+// DefaultProfessionFilters selects general practitioners.
+var DefaultProfessionFilters = []ProfessionFilter{
+	{Code: "10", Specialties: []string{"SM26", "SM53", "SM54"}},
+}
+
+// ParseProfessionFilters parses filters separated by semicolons, each of them being a profession
+// code optionally followed by a colon and comma-separated specialty codes,
+// e.g. "10:SM26,SM53,SM54;40" for general practitioners and dentists.
+func ParseProfessionFilters(s string) ([]ProfessionFilter, error) {
+	var filters []ProfessionFilter
+	for _, f := range strings.Split(s, ";") {
+		code, specialties := f, ""
+		if i := strings.Index(f, ":"); i != -1 {
+			code, specialties = f[:i], f[i+1:]
+		}
+		code = strings.TrimSpace(code)
+		if code == "" || !isDigits(code) {
+			return nil, fmt.Errorf("invalid profession code '%s'", code)
+		}
+
+		filter := ProfessionFilter{Code: code}
+		for _, specialty := range strings.Split(specialties, ",") {
+			if specialty = strings.TrimSpace(specialty); specialty != "" {
+				filter.Specialties = append(filter.Specialties, specialty)
+			}
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+func (f ProfessionFilter) String() string {
+	if len(f.Specialties) == 0 {
+		return f.Code
+	}
+	return f.Code + ":" + strings.Join(f.Specialties, ",")
+}
+
+func (f ProfessionFilter) matches(rec *rawPersonActivityRecord) bool {
+	return f.Matches(rec.CodeProfession, rec.CodeSavoirFaire)
+}
+
+// Matches returns whether the filter selects the given profession and specialty codes.
+func (f ProfessionFilter) Matches(professionCode, specialtyCode string) bool {
+	if professionCode != f.Code {
+		return false
+	}
+	if len(f.Specialties) == 0 {
+		return true
+	}
+	for _, specialty := range f.Specialties {
+		if specialtyCode == specialty {
+			return true
+		}
+	}
+	return false
+}
+
+// indexOptions are the settings used to create an index.
+type indexOptions struct {
+	nGramSize   int
+	professions []ProfessionFilter
+	// phonetic is whether the phonetic keys of names are indexed.
+	phonetic bool
+	// cacheRecords is whether the indexed records are kept in memory. It does not change
+	// the index data, and so is not part of the checksum.
+	cacheRecords bool
+}
+
+// checksum identifies the options, apart from the ngram size, that an index was created with,
+// so that index files created with other options are not used.
+func (o indexOptions) checksum() uint32 {
+	filters := make([]string, len(o.professions))
+	for i, filter := range o.professions {
+		filters[i] = filter.String()
+	}
+	description := strings.Join(filters, ";")
+	if o.phonetic {
+		description += "|phonetic"
+	}
+	return crc32.Checksum([]byte(description), crc32cTable)
+}
+
+// QueryOptions narrow down the records a query is run against, and how it is matched.
+type QueryOptions struct {
+	// Profession is a profession code, e.g. "40" for dentists. When empty, all indexed
+	// professions are searched.
+	Profession string
+	// Specialty is a specialty code, e.g. "SM40" for pediatrics. When empty, all indexed
+	// specialties are searched.
+	Specialty string
+	// Prefix matches the last word of the query as the start of a name, e.g. "mart" matches
+	// "Martin", for queries made as users type. A query ending with a space is matched as usual,
+	// as its last word is complete.
+	Prefix bool
+}
+
+// scopeKeys returns the keys of the scopes table that a query with these options is restricted to.
+func (o QueryOptions) scopeKeys() []string {
+	var keys []string
+	if o.Profession != "" {
+		keys = append(keys, professionScopeKey(o.Profession))
+	}
+	if o.Specialty != "" {
+		keys = append(keys, specialtyScopeKey(o.Specialty))
+	}
+	return keys
+}
+
+func professionScopeKey(code string) string {
+	return "profession/" + code
+}
+
+func specialtyScopeKey(code string) string {
+	return "specialty/" + code
+}
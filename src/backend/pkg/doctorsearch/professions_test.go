@@ -0,0 +1,75 @@
+package doctorsearch
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseProfessionFilters(t *testing.T) {
+	filters, err := ParseProfessionFilters("10:SM26,SM53, SM54;40; 50:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ProfessionFilter{
+		{Code: "10", Specialties: []string{"SM26", "SM53", "SM54"}},
+		{Code: "40"},
+		{Code: "50"},
+	}
+	if !reflect.DeepEqual(filters, expected) {
+		t.Errorf("got filters %+v, expected %+v", filters, expected)
+	}
+
+	for _, invalid := range []string{"", "10;", "doctors", ":SM54"} {
+		if _, err := ParseProfessionFilters(invalid); err == nil {
+			t.Errorf("expected an error for '%s'", invalid)
+		}
+	}
+}
+
+func TestQueryScopes(t *testing.T) {
+	f, err := os.Open(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	professions, err := ParseProfessionFilters("10:SM26,SM53,SM54,SM40;40;50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := newNGramsIndex(f, indexOptions{nGramSize: 3, professions: professions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// The pediatrician, dentist and midwife are now indexed, but not the pharmacist.
+	if index.numRecords != 12 {
+		t.Errorf("%d records indexed instead of 12", index.numRecords)
+	}
+
+	tests := []struct {
+		query    string
+		options  QueryOptions
+		expected []string
+	}{
+		{"julie moreau", QueryOptions{}, []string{"10000000012"}},
+		{"julie moreau", QueryOptions{Profession: "40"}, []string{"10000000012"}},
+		{"julie moreau", QueryOptions{Profession: "10"}, []string{}},
+		{"sophie bernard", QueryOptions{Profession: "10", Specialty: "SM40"}, []string{"10000000009"}},
+		{"sophie bernard", QueryOptions{Specialty: "SM54"}, []string{}},
+		{"10000000013", QueryOptions{Profession: "50"}, []string{"10000000013"}},
+		{"10000000013", QueryOptions{Profession: "40"}, []string{}},
+	}
+	for _, test := range tests {
+		res, err := index.query(context.Background(), test.query, 5, 0.3, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpps := make([]string, len(res.orderedRecords))
+		for i, rec := range res.orderedRecords {
+			rpps[i] = rec.RPPS()
+		}
+		expectRPPS(t, test.query, rpps, test.expected...)
+	}
+}
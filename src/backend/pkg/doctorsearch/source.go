@@ -0,0 +1,284 @@
+package doctorsearch
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ASIPDataURL is where the public extractions of the "Annuaire Santé" are published.
+	ASIPDataURL = "https://service.annuaire.sante.fr/annuaire-sante-webservices/V300/services/extraction/PS_LibreAcces"
+	// dataFileNamePrefix is the prefix of the data file's name, inside the published ZIP file.
+	dataFileNamePrefix = "PS_LibreAcces_Personne_activite_"
+)
+
+var (
+	// ErrNoNewData is returned by an UpdateSource which has nothing newer than what it last provided.
+	ErrNoNewData = errors.New("no new doctor data available")
+
+	errUnexpectedZIP = errors.New("ZIP file did not contain expected data file")
+)
+
+// An UpdateSource provides new versions of the doctor data file.
+type UpdateSource interface {
+	// Fetch writes a new data file in the directory dir, and returns its path.
+	// The directory is owned by the caller, who is responsible for cleaning it up.
+	Fetch(ctx context.Context, dir string) (string, error)
+}
+
+// ASIPRootCAs returns a pool holding the "ASIP Sante" root certificate,
+// which issues the certificate of ASIPDataURL.
+// See http://igc-sante.esante.gouv.fr/PC/
+func ASIPRootCAs() *x509.CertPool {
+	const ASIPRootCertPEM = `
+-----BEGIN CERTIFICATE-----
+MIIGKDCCBBCgAwIBAgISESDOGfk0b5RW/ycAI9hSkDe1MA0GCSqGSIb3DQEBCwUA
+MHkxCzAJBgNVBAYTAkZSMRMwEQYDVQQKDApBU0lQLVNBTlRFMRcwFQYDVQQLDA4w
+MDAyIDE4NzUxMjc1MTESMBAGA1UECwwJSUdDLVNBTlRFMSgwJgYDVQQDDB9BQyBS
+QUNJTkUgSUdDLVNBTlRFIEVMRU1FTlRBSVJFMB4XDTEzMDYyNTAwMDAwMFoXDTMz
+MDYyNTAwMDAwMFoweTELMAkGA1UEBhMCRlIxEzARBgNVBAoMCkFTSVAtU0FOVEUx
+FzAVBgNVBAsMDjAwMDIgMTg3NTEyNzUxMRIwEAYDVQQLDAlJR0MtU0FOVEUxKDAm
+BgNVBAMMH0FDIFJBQ0lORSBJR0MtU0FOVEUgRUxFTUVOVEFJUkUwggIiMA0GCSqG
+SIb3DQEBAQUAA4ICDwAwggIKAoICAQDNo99sZJlo3F6n4X67RF+xqBT3yGmA6LLd
+HIvTfDBCQ1l442eEOPHGXkyRkMHBI+q38Jily25liY7AjYElGpege2NbIyPQRTJS
+hF+ENJKccUDpJnv85OhSd+0NamF07GWd5Mi5AXyXprLxCOs+93rh18lTN8M0JoFQ
+mTNLhZTUZsobLMd0hYGShgC6BiNbHTAQpps11jYqWMpvTTRq1SFHHvrR3WMbUZDT
+Lj25f2DxIcy4x/ulfqmE/5x9uRC40+yG6ExxjkVU/7lkipGpvp0XxufQDIr9jntx
+VYszzu9Ti5jV1cDnlG8KfnAV1GZhX5WgY+1/QDnxq/A/JNW7H0YMkx9BZcQQ75JP
+fUU/HYX3GFrAx8YiW46E+SspGkBUFz4Qr2xKIch9akf+GbXlDPIy3L26Au05/dcf
+ZlDLIa3RsDUrby/m9EHK8P5uVVQG/KIUgnqr1Go/psMWztO2F+BCjau5pKg0a9k6
+kQFp0oETPKlYxo8Qsrq1iju7HuEPtHKn+UcpKddDjTGW6aAQS5qVVsqPFv2lCPBK
+71037VrjaJ0XV+jqqN9SUCEEZSFvPmIzv0UdOEd29igJSlXYH+RGTn/RMZ+iIB7C
+CAhIQy+tFw9VRFWyCGeOrFg+8fBsosmOffQ80rkOGts4SpTkEI038djuwYMEbu9O
+p6Pntk58dwIDAQABo4GpMIGmMA8GA1UdEwEB/wQFMAMBAf8wDgYDVR0PAQH/BAQD
+AgEGMEMGA1UdIAQ8MDowOAYEVR0gADAwMC4GCCsGAQUFBwIBFiJodHRwOi8vaWdj
+LXNhbnRlLmVzYW50ZS5nb3V2LmZyL1BDMB0GA1UdDgQWBBSMb+rVi4L6+b6H3HMO
+JxUHR8SeLzAfBgNVHSMEGDAWgBSMb+rVi4L6+b6H3HMOJxUHR8SeLzANBgkqhkiG
+9w0BAQsFAAOCAgEALPVMH5yLBZgbwYXbkLdmkB44GzANJ39ibwmhWqlbOfZZmpQh
+NC71ftzfluSTUTb4QF/zAPylpRRmzJRtmUdOlYZToE3gWtxnNOcbLFtGDp0uvGYb
++FqrzghOICWgM3JWstPNGW681fQgmWH6OJQs5eWIZpkpl/wSWhbq0GuPXZXnYDGi
+I4wtxHgwbKE7rokqHO/HPK/GJ5yn7oWBp2cy96hYIw9O9NUKzhZYD+EXXrmdrX1W
+LjxhAICs1CIaFuIuXLnaSrV52kWUcmDJ3+oRqbRIXTB1nBcUL1jDV2cugLCJV+GQ
+wb16yAAHz8B2lH4H6j6RTWr9wIuQZcSw9E/YqY8vRnSws0KmRM5mwwU/QAgINdH4
+iDFyeFJjLEvV0ny7wiP0if+Mzjil3r6oghQ1SOv3AN33nkK5wWtOVksIQhBaTSMq
+xxiwSfb2/QX6S8hZ3k85bMsWPDGE3MHlZjDUB4EhxaRASyGFR1/3mqzPX5sJaCAL
+2iF3qDDs2WGmwoBBHySFdsEEPBZm5OelN5uTgZ7ub7LM/s1BTU1RFQsO4CEYL/op
+zss8O6vlDwDNCyt/09yS2RvQZV+E7/5cCi0gumwnhKE0uRjLs36jm055En2LQX95
+fE/rZpnSMWBDwCpNvgXLoejYigfVJPFzSPen5mo1uPPwMkEwXggooIu5diM=
+-----END CERTIFICATE-----`
+
+	rootCA := x509.NewCertPool()
+	ok := rootCA.AppendCertsFromPEM([]byte(ASIPRootCertPEM))
+	if !ok {
+		log.Fatal().Msg("Error adding ASIP SANTE certificate to cert pool")
+	}
+	return rootCA
+}
+
+type httpSource struct {
+	url        string
+	httpClient *http.Client
+}
+
+// NewASIPSource returns an UpdateSource downloading the data published by the ASIP,
+// only trusting their root certificate.
+func NewASIPSource() UpdateSource {
+	return newHTTPSource(ASIPDataURL, ASIPRootCAs())
+}
+
+// NewHTTPSource returns an UpdateSource downloading a ZIP file, similar to the ones published by the ASIP,
+// from url (e.g. a local mirror).
+//
+// caBundlePEM holds the PEM encoded root certificates to trust. When empty, the system's root certificates are used.
+func NewHTTPSource(url string, caBundlePEM []byte) (UpdateSource, error) {
+	var rootCAs *x509.CertPool
+	if len(caBundlePEM) != 0 {
+		rootCAs = x509.NewCertPool()
+		if ok := rootCAs.AppendCertsFromPEM(caBundlePEM); !ok {
+			return nil, errors.New("no certificate found in CA bundle")
+		}
+	}
+	return newHTTPSource(url, rootCAs), nil
+}
+
+func newHTTPSource(url string, rootCAs *x509.CertPool) *httpSource {
+	tr := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+		}).DialContext,
+		DisableKeepAlives:     true,
+		ExpectContinueTimeout: 2 * time.Second,
+		TLSHandshakeTimeout:   15 * time.Second,
+		TLSClientConfig: &tls.Config{
+			RootCAs: rootCAs,
+		},
+	}
+	return &httpSource{
+		url:        url,
+		httpClient: &http.Client{Transport: tr},
+	}
+}
+
+func (hs *httpSource) Fetch(ctx context.Context, dir string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hs.url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := hs.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status %d downloading data file", resp.StatusCode)
+	}
+	log.Trace().
+		Int64("http_content_length", resp.ContentLength).
+		Msg("downloading data file")
+
+	tmpFile, err := ioutil.TempFile(dir, "*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	_, err = io.Copy(tmpFile, resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return extractDataFile(tmpFile, dir)
+}
+
+// extractDataFile extracts the data file out of the ZIP file f, into the directory dir.
+func extractDataFile(f *os.File, dir string) (string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	zipr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return "", err
+	}
+
+	var zipFile *zip.File
+	for _, f := range zipr.File {
+		if strings.HasPrefix(f.Name, dataFileNamePrefix) {
+			zipFile = f
+			break
+		}
+	}
+	if zipFile == nil {
+		return "", errUnexpectedZIP
+	}
+
+	zipFileReader, err := zipFile.Open()
+	if err != nil {
+		return "", err
+	}
+	defer zipFileReader.Close()
+
+	return copyToDataFile(zipFileReader, dir)
+}
+
+func copyToDataFile(r io.Reader, dir string) (string, error) {
+	tmpDataFile, err := ioutil.TempFile(dir, "data-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer tmpDataFile.Close()
+
+	_, err = io.Copy(tmpDataFile, r)
+	if err != nil {
+		return "", err
+	}
+	return tmpDataFile.Name(), nil
+}
+
+// directorySource watches a directory in which new data files are dropped,
+// either as is or as the ZIP files published by the ASIP.
+type directorySource struct {
+	dirPath string
+
+	mu sync.Mutex
+	// lastModTime is the modification time of the last file provided.
+	lastModTime time.Time
+}
+
+// NewDirectorySource returns an UpdateSource providing the most recent file in the directory dirPath,
+// as long as it is newer than the last one it provided. The first file it provides, e.g. after
+// a restart, may well be known data: updates ignore data which is in use or was replaced.
+//
+// Files are expected to be named like the data file, e.g. "PS_LibreAcces_Personne_activite_202005090902.txt",
+// or to be ZIP files (with a ".zip" extension) containing such a file.
+func NewDirectorySource(dirPath string) UpdateSource {
+	return &directorySource{
+		dirPath: filepath.Clean(dirPath),
+	}
+}
+
+func (ds *directorySource) Fetch(ctx context.Context, dir string) (string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	fileInfos, err := ioutil.ReadDir(ds.dirPath)
+	if err != nil {
+		return "", err
+	}
+	var newest os.FileInfo
+	for _, fi := range fileInfos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if !strings.HasPrefix(fi.Name(), dataFileNamePrefix) && filepath.Ext(fi.Name()) != ".zip" {
+			continue
+		}
+		if newest == nil || fi.ModTime().After(newest.ModTime()) {
+			newest = fi
+		}
+	}
+	if newest == nil || !newest.ModTime().After(ds.lastModTime) {
+		return "", ErrNoNewData
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(filepath.Join(ds.dirPath, newest.Name()))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var dataFilePath string
+	if filepath.Ext(newest.Name()) == ".zip" {
+		dataFilePath, err = extractDataFile(f, dir)
+	} else {
+		dataFilePath, err = copyToDataFile(f, dir)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Debug().
+		Str("file", newest.Name()).
+		Msg("found new data file in directory")
+	ds.lastModTime = newest.ModTime()
+	return dataFilePath, nil
+}
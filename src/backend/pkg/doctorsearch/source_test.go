@@ -0,0 +1,191 @@
+package doctorsearch
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tmpDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "doctorsearch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// fixtureZIP returns a ZIP file laid out like the ones published by the ASIP.
+func fixtureZIP(t *testing.T) []byte {
+	data, err := ioutil.ReadFile(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string][]byte{
+		"PS_LibreAcces_Dipl_AutExerc_202010170000.txt":     []byte("unrelated"),
+		"PS_LibreAcces_Personne_activite_202010170000.txt": data,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newFixtureServer(t *testing.T) (*httptest.Server, []byte) {
+	zipData := fixtureZIP(t)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(zipData)
+	}))
+	t.Cleanup(srv.Close)
+
+	caBundlePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	return srv, caBundlePEM
+}
+
+func expectFixtureContent(t *testing.T, dataFilePath string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(dataFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("data file does not have the expected content")
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	srv, caBundlePEM := newFixtureServer(t)
+
+	source, err := NewHTTPSource(srv.URL, caBundlePEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFilePath, err := source.Fetch(context.Background(), tmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFixtureContent(t, dataFilePath)
+
+	// The server is not trusted without the CA bundle.
+	source, err = NewHTTPSource(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Fetch(context.Background(), tmpDir(t)); err == nil {
+		t.Errorf("expected an error with an untrusted server")
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	watchedDir := tmpDir(t)
+	source := NewDirectorySource(watchedDir)
+
+	if _, err := source.Fetch(context.Background(), tmpDir(t)); !errors.Is(err, ErrNoNewData) {
+		t.Errorf("empty directory: got error %v, expected %v", err, ErrNoNewData)
+	}
+
+	data, err := ioutil.ReadFile(fixtureFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txtPath := filepath.Join(watchedDir, "PS_LibreAcces_Personne_activite_202010170000.txt")
+	if err := ioutil.WriteFile(txtPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dataFilePath, err := source.Fetch(context.Background(), tmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFixtureContent(t, dataFilePath)
+
+	if _, err := source.Fetch(context.Background(), tmpDir(t)); !errors.Is(err, ErrNoNewData) {
+		t.Errorf("no new file: got error %v, expected %v", err, ErrNoNewData)
+	}
+
+	zipPath := filepath.Join(watchedDir, "extraction.zip")
+	if err := ioutil.WriteFile(zipPath, fixtureZIP(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(zipPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	dataFilePath, err = source.Fetch(context.Background(), tmpDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFixtureContent(t, dataFilePath)
+}
+
+func TestTriggerUpdate(t *testing.T) {
+	srv, caBundlePEM := newFixtureServer(t)
+	source, err := NewHTTPSource(srv.URL, caBundlePEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataFilePath := filepath.Join(tmpDir(t), "data.txt")
+	dr := New(dataFilePath, Config{
+		NGramSize:            3,
+		MaxUserQueryLength:   100,
+		MaxConcurrentQueries: 10,
+		MaxQueryDuration:     time.Second,
+		MinSimilarity:        0.3,
+		UpdateSource:         source,
+	})
+
+	// There is no data file to begin with, and updates are only made when triggered.
+	time.Sleep(50 * time.Millisecond)
+	if _, err := dr.Query(context.Background(), "martin", 5, QueryOptions{}); !errors.Is(err, ErrTemporarilyUnavailable) {
+		t.Fatalf("got error %v, expected %v", err, ErrTemporarilyUnavailable)
+	}
+
+	dr.TriggerUpdate()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		results, err := dr.Query(context.Background(), "martin", 5, QueryOptions{})
+		if err == nil {
+			if len(results) != 3 {
+				t.Errorf("got %d results, expected 3", len(results))
+			}
+			break
+		} else if !errors.Is(err, ErrTemporarilyUnavailable) || time.Now().After(deadline) {
+			t.Fatalf("query failed after update: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The new files are moved in place right after the new index is in use.
+	for {
+		if _, err := os.Stat(indexFilePath(dataFilePath)); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("index file was not moved next to the data file: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectFixtureContent(t, dataFilePath)
+}
@@ -0,0 +1,223 @@
+// Package synthetic generates data files laid out like the PS_LibreAcces extractions of the
+// ASIP, with made up health professionals, to benchmark and load test doctor searches.
+package synthetic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+// Header is the header line of the current PS_LibreAcces_Personne_activite extractions.
+const Header = "Type d'identifiant PP|Identifiant PP|Identification nationale PP|Code civilité d'exercice|Libellé civilité d'exercice|Code civilité|Libellé civilité|Nom d'exercice|Prénom d'exercice|Code profession|Libellé profession|Code catégorie professionnelle|Libellé catégorie professionnelle|Code type savoir-faire|Libellé type savoir-faire|Code savoir-faire|Libellé savoir-faire|Code mode exercice|Libellé mode exercice|Numéro SIRET site|Numéro SIREN site|Numéro FINESS site|Numéro FINESS établissement juridique|Identifiant technique de la structure|Raison sociale site|Enseigne commerciale site|Complément destinataire (coord. structure)|Complément point géographique (coord. structure)|Numéro Voie (coord. structure)|Indice répétition voie (coord. structure)|Code type de voie (coord. structure)|Libellé type de voie (coord. structure)|Libellé Voie (coord. structure)|Mention distribution (coord. structure)|Bureau cedex (coord. structure)|Code postal (coord. structure)|Code commune (coord. structure)|Libellé commune (coord. structure)|Code pays (coord. structure)|Libellé pays (coord. structure)|Téléphone (coord. structure)|Téléphone 2 (coord. structure)|Télécopie (coord. structure)|Adresse e-mail (coord. structure)|Code Département (structure)|Libellé Département (structure)|Ancien identifiant de la structure|Autorité d'enregistrement|Code secteur d'activité|Libellé secteur d'activité|Code section tableau pharmaciens|Libellé section tableau pharmaciens"
+
+// Person is a generated health professional.
+type Person struct {
+	// IDType is "8" for an RPPS number, and "0" for an older ADELI number.
+	IDType    string
+	ID        string
+	LastName  string
+	FirstName string
+	// ProfessionCode is e.g. "10" for a doctor, and Specialty e.g. "SM54". Only doctors have
+	// a specialty.
+	ProfessionCode string
+	Specialty      string
+	Military       bool
+	// Sites has an element for each line of the person in the data file.
+	Sites []Site
+}
+
+// Site is where a Person practices.
+type Site struct {
+	PostalCode string
+	Commune    string
+}
+
+// Config describes the data to generate.
+type Config struct {
+	NumPeople int
+	// Seed makes the generated data reproducible: the same seed always gives the same data.
+	Seed int64
+}
+
+var (
+	lastNames = []string{
+		"MARTIN", "BERNARD", "DUBOIS", "THOMAS", "ROBERT", "RICHARD", "PETIT", "DURAND", "LEROY", "MOREAU",
+		"SIMON", "LAURENT", "LEFEBVRE", "MICHEL", "GARCIA", "DAVID", "BERTRAND", "ROUX", "VINCENT", "FOURNIER",
+		"MOREL", "GIRARD", "ANDRE", "LEFEVRE", "MERCIER", "DUPONT", "LAMBERT", "BONNET", "FRANCOIS", "MARTINEZ",
+		"LEGRAND", "GARNIER", "FAURE", "ROUSSEAU", "BLANC", "GUERIN", "MULLER", "HENRY", "ROUSSEL", "NICOLAS",
+		"PERRIN", "MORIN", "MATHIEU", "CLEMENT", "GAUTHIER", "DUMONT", "LOPEZ", "FONTAINE", "CHEVALIER", "ROBIN",
+	}
+	// Suffixes give more distinct last names, which sound like French names.
+	lastNameSuffixes = []string{"", "", "", "EAU", "ET", "IN", "ON", "IER", "ARD", "OT", "Y", "AUD"}
+	// Particles are sometimes put in front of last names, e.g. "D'ARTAGNAN" or "LE GOFF".
+	particles  = []string{"D'", "LE ", "DE ", "LA ", "DU "}
+	firstNames = []string{
+		"Pierre", "Marie", "Jean", "Sophie", "Philippe", "Isabelle", "Michel", "Catherine", "Alain", "Nathalie",
+		"Nicolas", "Hélène", "François", "Valérie", "Éric", "Sandrine", "Laurent", "Céline", "Stéphane", "Julie",
+		"Christophe", "Anne", "Olivier", "Claire", "Thierry", "Émilie", "Patrick", "Camille", "Frédéric", "Élodie",
+	}
+	professions = []struct {
+		code, label string
+		// weight is the share of generated people with this profession, out of 100.
+		weight int
+	}{
+		{"10", "Médecin", 55},
+		{"21", "Pharmacien", 20},
+		{"40", "Chirurgien-Dentiste", 15},
+		{"50", "Sage-Femme", 10},
+	}
+	specialties = []struct{ code, label string }{
+		{"SM54", "Médecine Générale (SM54)"},
+		{"SM54", "Médecine Générale (SM54)"},
+		{"SM54", "Médecine Générale (SM54)"},
+		{"SM26", "Qualifié en Médecine Générale (SM26)"},
+		{"SM53", "Spécialiste en Médecine Générale (SM53)"},
+		{"SM40", "Pédiatrie (SM40)"},
+		{"SM04", "Cardiologie et maladies vasculaires (SM04)"},
+	}
+	streetTypes = []string{"rue", "rue", "rue", "avenue", "boulevard", "place", "chemin", "impasse"}
+	streetNames = []string{
+		"de la Paix", "Victor Hugo", "Jean Jaurès", "des Lilas", "du Port", "Nationale", "Pasteur", "de la Gare",
+		"Thiers", "de la République", "Gambetta", "du Général de Gaulle", "des Écoles", "Carnot", "de l'Église",
+	}
+	communes = []struct{ postalCode, name string }{
+		{"75002", "Paris"}, {"75016", "Paris"}, {"69003", "Lyon"}, {"13002", "Marseille"}, {"33000", "Bordeaux"},
+		{"59000", "Lille"}, {"31000", "Toulouse"}, {"44000", "Nantes"}, {"67000", "Strasbourg"}, {"35000", "Rennes"},
+		{"35400", "Saint-Malo"}, {"06000", "Nice"}, {"29200", "Brest"}, {"83000", "Toulon"}, {"21000", "Dijon"},
+	}
+)
+
+// Write writes a data file with the header line and the records of config.NumPeople people to w,
+// and returns the generated people.
+func Write(w io.Writer, config Config) ([]Person, error) {
+	rng := rand.New(rand.NewSource(config.Seed))
+	columns := make(map[string]int)
+	for i, name := range strings.Split(Header, "|") {
+		columns[name] = i
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(Header + "\n"); err != nil {
+		return nil, err
+	}
+
+	people := make([]Person, config.NumPeople)
+	cols := make([]string, len(columns))
+	for i := range people {
+		person := newPerson(rng, i)
+		people[i] = person
+
+		for j := range cols {
+			cols[j] = ""
+		}
+		set := func(name, value string) {
+			cols[columns[name]] = value
+		}
+		set("Type d'identifiant PP", person.IDType)
+		set("Identifiant PP", person.ID)
+		set("Identification nationale PP", person.IDType+person.ID)
+		set("Code civilité", "M")
+		set("Libellé civilité", "Monsieur")
+		set("Nom d'exercice", person.LastName)
+		set("Prénom d'exercice", person.FirstName)
+		for _, profession := range professions {
+			if profession.code == person.ProfessionCode {
+				set("Code profession", profession.code)
+				set("Libellé profession", profession.label)
+			}
+		}
+		if person.Military {
+			set("Code catégorie professionnelle", "M")
+			set("Libellé catégorie professionnelle", "Militaire")
+		} else {
+			set("Code catégorie professionnelle", "C")
+			set("Libellé catégorie professionnelle", "Civil")
+		}
+		if person.Specialty != "" {
+			set("Code civilité d'exercice", "DR")
+			set("Libellé civilité d'exercice", "Docteur")
+			set("Code type savoir-faire", "S")
+			set("Libellé type savoir-faire", "Spécialité ordinale")
+			set("Code savoir-faire", person.Specialty)
+			for _, specialty := range specialties {
+				if specialty.code == person.Specialty {
+					set("Libellé savoir-faire", specialty.label)
+				}
+			}
+		}
+		set("Autorité d'enregistrement", "CNOM")
+
+		for j, site := range person.Sites {
+			if j == 0 || rng.Intn(2) == 0 {
+				set("Code mode exercice", "L")
+				set("Libellé mode exercice", "Libéral, indépendant, artisan, commerçant")
+			} else {
+				set("Code mode exercice", "S")
+				set("Libellé mode exercice", "Salarié")
+			}
+			set("Numéro Voie (coord. structure)", fmt.Sprint(1+rng.Intn(150)))
+			set("Libellé type de voie (coord. structure)", streetTypes[rng.Intn(len(streetTypes))])
+			set("Libellé Voie (coord. structure)", streetNames[rng.Intn(len(streetNames))])
+			set("Code postal (coord. structure)", site.PostalCode)
+			set("Libellé commune (coord. structure)", site.Commune)
+			set("Code pays (coord. structure)", "99000")
+			set("Libellé pays (coord. structure)", "France")
+			set("Code Département (structure)", site.PostalCode[:2])
+			if _, err := bw.WriteString(strings.Join(cols, "|") + "\n"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return people, bw.Flush()
+}
+
+// newPerson returns the i-th generated person, whose ID is unique.
+func newPerson(rng *rand.Rand, i int) Person {
+	person := Person{
+		IDType: "8",
+		ID:     fmt.Sprintf("1%010d", i),
+	}
+	// A few people still have an ADELI number.
+	if rng.Intn(50) == 0 {
+		person.IDType = "0"
+		person.ID = fmt.Sprintf("%010d", i)
+	}
+
+	person.LastName = lastNames[rng.Intn(len(lastNames))] + lastNameSuffixes[rng.Intn(len(lastNameSuffixes))]
+	switch n := rng.Intn(20); {
+	case n == 0:
+		person.LastName = particles[rng.Intn(len(particles))] + person.LastName
+	case n == 1:
+		person.LastName += "-" + lastNames[rng.Intn(len(lastNames))]
+	}
+	person.FirstName = firstNames[rng.Intn(len(firstNames))]
+	if rng.Intn(15) == 0 {
+		person.FirstName += "-" + firstNames[rng.Intn(len(firstNames))]
+	}
+
+	weight := rng.Intn(100)
+	for _, profession := range professions {
+		if weight < profession.weight {
+			person.ProfessionCode = profession.code
+			break
+		}
+		weight -= profession.weight
+	}
+	if person.ProfessionCode == "10" {
+		person.Specialty = specialties[rng.Intn(len(specialties))].code
+	}
+	person.Military = rng.Intn(100) == 0
+
+	numSites := 1
+	if rng.Intn(10) == 0 {
+		numSites += 1 + rng.Intn(2)
+	}
+	for i := 0; i < numSites; i++ {
+		commune := communes[rng.Intn(len(communes))]
+		person.Sites = append(person.Sites, Site{PostalCode: commune.postalCode, Commune: commune.name})
+	}
+	return person
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"autocontract/pkg/datamap"
+	"autocontract/pkg/doctorsearch"
 	"autocontract/pkg/validation"
 
 	"github.com/rs/zerolog/log"
@@ -22,11 +23,22 @@ const (
 	MaxGenericLength = 400
 
 	MaxSignatureSizeBytes = 300 * 1024
+
+	MaxPeriods = 30
+	// Periods must be within this many years around the date the contract is established, so
+	// that contracts can be made a while after, or long before, replacements.
+	MaxPeriodYearsBefore = 1
+	MaxPeriodYearsAfter  = 2
 )
 
 type FormProcessingManner struct {
 	TimeLayout   string
 	TimeLocation *time.Location
+	// LookupDoctor, if not nil, is used to check that the RPPS numbers of doctors are known, and
+	// match their names. Mismatches are warnings, which don't prevent making the contract.
+	LookupDoctor func(rpps string) (*doctorsearch.DoctorRecord, error)
+	// Now, if not nil, returns the time contracts are established at, instead of time.Now.
+	Now func() time.Time
 }
 
 type validationFunc func(string) (string, error)
@@ -70,37 +82,143 @@ func maxLength(length int) validationFunc {
 	}
 }
 
-func validateField(name string, r *http.Request, issues validation.ValidationIssues, validators []validationFunc) string {
-	var value string = r.PostFormValue(name)
+func integer(min, max int) validationFunc {
+	return func(value string) (s string, err error) {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("%w, %s", validation.ParseError, err)
+		}
+		if i < min || i > max {
+			return "", fmt.Errorf("%w, %d is not between %d and %d", validation.ParseError, i, min, max)
+		}
+		return value, nil
+	}
+}
+
+func digits(value string) (string, error) {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("%w, '%s' is not only made of digits", validation.InvalidNumber, value)
+		}
+	}
+	return value, nil
+}
+
+// luhnSum returns the sum of the digits of number, every second digit from the right being
+// doubled (and its digits summed), as in the Luhn algorithm. number must only be made of digits.
+func luhnSum(number string) int {
+	sum := 0
+	for i := 0; i < len(number); i++ {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum
+}
+
+// rppsCheckDigit checks the last digit of an RPPS number, which is a Luhn check digit.
+func rppsCheckDigit(value string) (string, error) {
+	if luhnSum(value)%10 != 0 {
+		return "", fmt.Errorf("%w, wrong check digit in RPPS number '%s'", validation.InvalidNumber, value)
+	}
+	return value, nil
+}
+
+// laPosteSIREN is the SIREN number of La Poste. It has so many establishments that their NIC
+// (the last 5 digits of a SIRET number) can't all make a valid Luhn checksum: the sum of the
+// digits of their SIRET number is a multiple of 5 instead.
+const laPosteSIREN = "356000000"
+
+// siretCheckDigit checks the Luhn checksums of a SIRET number, and of its SIREN number (its
+// first 9 digits).
+func siretCheckDigit(value string) (string, error) {
+	siren := value[:len(value)-5]
+	if luhnSum(siren)%10 != 0 {
+		return "", fmt.Errorf("%w, wrong check digit in SIREN number '%s'", validation.InvalidNumber, siren)
+	}
+
+	if siren == laPosteSIREN {
+		sum := 0
+		for _, r := range value {
+			sum += int(r - '0')
+		}
+		if sum%5 != 0 {
+			return "", fmt.Errorf("%w, digits of La Poste SIRET number '%s' don't add up to a multiple of 5", validation.InvalidNumber, value)
+		}
+		return value, nil
+	}
+	if luhnSum(value)%10 != 0 {
+		return "", fmt.Errorf("%w, wrong check digit in SIRET number '%s'", validation.InvalidNumber, value)
+	}
+	return value, nil
+}
+
+// contractFields gives the raw values of a contract request, whatever its format, by the
+// names of the form fields.
+type contractFields struct {
+	value        func(name string) string
+	periodStarts []string
+	periodEnds   []string
+	// issueKey returns the key that issues with a field are reported under. index is the
+	// index of the period for period fields, and -1 otherwise.
+	issueKey func(name string, index int) string
+}
+
+// validateField returns the value of field, once validated. Issues are added to issues.
+func (f contractFields) validateField(field Field, issues validation.ValidationIssues) string {
+	var value string = f.value(field.Name)
 	var err error
 
-	for _, validationF := range validators {
-		value, err = validationF(value)
+	if field.Optional {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return ""
+		}
+	} else if value, err = requiredField(value); err != nil {
+		issues.Set(f.issueKey(field.Name, -1), err)
+		return ""
+	}
+
+	for _, validator := range field.Validators {
+		value, err = validator.validate(value)
 		if err != nil {
-			issues.Set(name, err)
+			issues.Set(f.issueKey(field.Name, -1), err)
 			break
 		}
 	}
 	return value
 }
 
-var (
-	NameValidators = []validationFunc{
-		requiredField, maxLength(MaxNameLength),
-	}
-	RPPSValidators = []validationFunc{
-		requiredField, maxLength(RPPSLength), minLength(RPPSLength),
+// verifyDoctor looks the doctor up by RPPS number, and adds a warning to issues when no doctor
+// has this number, or when its name does not match. Invalid fields are not verified.
+func verifyDoctor(fields contractFields, lookupDoctor func(string) (*doctorsearch.DoctorRecord, error), rppsField string, nameField string, issues validation.ValidationIssues) {
+	rppsKey, nameKey := fields.issueKey(rppsField, -1), fields.issueKey(nameField, -1)
+	all := issues.GetAll()
+	if _, ok := all[rppsKey]; ok {
+		return
 	}
-	SIRETValidators = []validationFunc{
-		requiredField, maxLength(SIRETLength), minLength(SIRETLength),
+	if _, ok := all[nameKey]; ok {
+		return
 	}
-	TitleValidators = []validationFunc{
-		requiredField, maxLength(MaxTitleLength), oneOf([]string{datamap.Docteur, datamap.Madame, datamap.Monsieur}),
+
+	rpps := strings.TrimSpace(fields.value(rppsField))
+	doctor, err := lookupDoctor(rpps)
+	if err != nil {
+		// The directory of doctors may be unavailable, e.g. while it is being indexed.
+		log.Debug().Msgf("could not look up doctor: %s", err)
+		return
 	}
-	GenericMaxLength = []validationFunc{
-		requiredField, maxLength(MaxGenericLength),
+	if doctor == nil {
+		issues.SetWarning(rppsKey, fmt.Errorf("%w '%s'", validation.UnknownRPPS, rpps))
+	} else if !doctor.HasName(fields.value(nameField)) {
+		issues.SetWarning(nameKey, fmt.Errorf("%w '%s'", validation.NameMismatch, rpps))
 	}
-)
+}
 
 func sanitizeSignature(rawData string) (string, error) {
 	signatureSize := len(rawData)
@@ -133,47 +251,101 @@ func sanitizeSignature(rawData string) (string, error) {
 	return safeDataURL.String(), nil
 }
 
-func sanitizePeriods(periods []datamap.Period) ([]datamap.Period, validation.ValidationIssues) {
-	const MaxPeriods = 30
+// setPeriodIssue adds an issue with the period at index to issues. The index is recorded in
+// issues, unless the issue key already tells it.
+func setPeriodIssue(issues validation.ValidationIssues, issueKey func(name string, index int) string, name string, index int, err error) {
+	key := issueKey(name, index)
+	if key == issueKey(name, -1) {
+		issues.SetAt(key, index, err)
+	} else {
+		issues.Set(key, err)
+	}
+}
+
+// sanitizePeriods checks that periods don't end before they start, don't overlap each other,
+// and are around the date the contract is established. It returns the periods in chronological
+// order, adjacent periods being merged.
+func sanitizePeriods(periods []datamap.Period, established time.Time, issueKey func(name string, index int) string) ([]datamap.Period, validation.ValidationIssues) {
 	issues := validation.EmptyIssues()
 	if len(periods) > MaxPeriods {
 		// return fmt.Errorf("maximum number of periods is %d (input contains %d)", MaxPeriods, len(periods))
-		issues.Set("period-start", validation.TooMany)
-		issues.Set("period-end", validation.TooMany)
+		issues.Set(issueKey("period-start", -1), validation.TooMany)
+		issues.Set(issueKey("period-end", -1), validation.TooMany)
+		return periods, issues
+	}
+
+	// Dates of periods are days, so bounds are too.
+	year, month, day := established.Date()
+	established = time.Date(year, month, day, 0, 0, 0, 0, established.Location())
+	earliest := established.AddDate(-MaxPeriodYearsBefore, 0, 0)
+	latest := established.AddDate(MaxPeriodYearsAfter, 0, 0)
+	for index, p := range periods {
+		if p.Start.Before(earliest) || p.Start.After(latest) {
+			setPeriodIssue(issues, issueKey, "period-start", index, fmt.Errorf("%w, %s is not between %s and %s", validation.OutOfRange, p.Start, earliest, latest))
+		}
+		if p.End.Before(earliest) || p.End.After(latest) {
+			setPeriodIssue(issues, issueKey, "period-end", index, fmt.Errorf("%w, %s is not between %s and %s", validation.OutOfRange, p.End, earliest, latest))
+		}
+		if p.End.Before(p.Start) {
+			setPeriodIssue(issues, issueKey, "period-end", index, validation.ReversedPeriod)
+		}
 	}
-	return periods, issues
+	if issues.Error() != nil {
+		return periods, issues
+	}
+
+	merged, overlapping := datamap.MergePeriods(periods)
+	for _, index := range overlapping {
+		setPeriodIssue(issues, issueKey, "period-start", index, validation.OverlappingPeriods)
+	}
+	return merged, issues
+}
+
+// formIssueKey reports issues under the names of the form fields.
+func formIssueKey(name string, index int) string {
+	return name
 }
 
+// Process validates the contract form of r, which must already be parsed.
 func Process(r *http.Request, manner FormProcessingManner) (datamap.SafeUserData, error) {
+	return process(contractFields{
+		value:        r.PostFormValue,
+		periodStarts: r.PostForm["period-start"],
+		periodEnds:   r.PostForm["period-end"],
+		issueKey:     formIssueKey,
+	}, manner)
+}
+
+func process(fields contractFields, manner FormProcessingManner) (datamap.SafeUserData, error) {
 	validationIssues := validation.EmptyIssues()
 
 	var periods []datamap.Period
-	periodStartsStr := r.PostForm["period-start"]
-	periodEndsStr := r.PostForm["period-end"]
+	periodStartsStr := fields.periodStarts
+	periodEndsStr := fields.periodEnds
 	if len(periodStartsStr) == 0 {
-		validationIssues.Set("period-start", validation.MissingRequired)
+		validationIssues.Set(fields.issueKey("period-start", -1), validation.MissingRequired)
 	}
 	if len(periodEndsStr) == 0 {
-		validationIssues.Set("period-end", validation.MissingRequired)
+		validationIssues.Set(fields.issueKey("period-end", -1), validation.MissingRequired)
 	}
 
 	for index, periodStartStr := range periodStartsStr {
 		periodStart, err := time.Parse(manner.TimeLayout, periodStartStr)
 		if err != nil {
-			validationIssues.Set("period-start", validation.ParseError)
+			setPeriodIssue(validationIssues, fields.issueKey, "period-start", index, validation.ParseError)
 			break
 		}
 
 		if index >= len(periodEndsStr) {
 			log.Trace().Msgf("invalid periods (%d starts, %d ends)", len(periodStartsStr), len(periodEndsStr))
-			validationIssues.Set("period-start", validation.TooMany)
+			validationIssues.Set(fields.issueKey("period-start", -1), validation.TooMany)
 			break
 		}
 
 		periodEndStr := periodEndsStr[index]
 		periodEnd, err := time.Parse(manner.TimeLayout, periodEndStr)
 		if err != nil {
-			validationIssues.Set("period-end", validation.ParseError)
+			setPeriodIssue(validationIssues, fields.issueKey, "period-end", index, validation.ParseError)
 			break
 		}
 
@@ -182,80 +354,48 @@ func Process(r *http.Request, manner FormProcessingManner) (datamap.SafeUserData
 			End:   periodEnd.In(manner.TimeLocation),
 		})
 	}
-	periods, issues := sanitizePeriods(periods)
-	validationIssues.Merge(issues)
-
-	regularName := validateField("regular-name", r, validationIssues, NameValidators)
-	regularRPPS := validateField("regular-rpps", r, validationIssues, RPPSValidators)
-
-	safeRegularSignature, err := sanitizeSignature(r.PostFormValue("regular-signature"))
-	if err != nil {
-		validationIssues.Set("regular-signature", err)
-	}
-
-	regularDoctor := datamap.Person{
-		Name:             regularName,
-		HonorificTitle:   datamap.Docteur,
-		NumberRPPS:       regularRPPS,
-		Address:          validateField("regular-address", r, validationIssues, GenericMaxLength),
-		SignatureImgHtml: safeRegularSignature,
-	}
-
-	substituteName := validateField("substitute-name", r, validationIssues, NameValidators)
-	substituteTitle := validateField("substitute-title", r, validationIssues, TitleValidators)
-	substituteRPPS := validateField("substitute-rpps", r, validationIssues, RPPSValidators)
-	substituteSIRET := validateField("substitute-siret", r, validationIssues, SIRETValidators)
-
-	safeSubstituteSignature, err := sanitizeSignature(r.PostFormValue("substitute-signature"))
-	if err != nil {
-		validationIssues.Set("substitute-signature", err)
-	}
-
-	substituting := datamap.Person{
-		Name:                 substituteName,
-		HonorificTitle:       substituteTitle,
-		NumberRPPS:           substituteRPPS,
-		NumberSIRET:          substituteSIRET,
-		NumberSubstitutingID: validateField("substitute-substitutingID", r, validationIssues, GenericMaxLength),
-		Address:              validateField("substitute-address", r, validationIssues, GenericMaxLength),
-		SignatureImgHtml:     safeSubstituteSignature,
+	now := time.Now
+	if manner.Now != nil {
+		now = manner.Now
 	}
+	established := now().In(manner.TimeLocation)
+	periods, issues := sanitizePeriods(periods, established, fields.issueKey)
+	validationIssues.Merge(issues)
 
-	retrocessionPercStr := validateField("financials-retrocession", r, validationIssues, []validationFunc{
-		requiredField,
-	})
-	retrocessionPerc, err := strconv.Atoi(retrocessionPercStr)
-	if err != nil {
-		validationIssues.Set("financials-retrocession", validation.ParseError)
+	var userData datamap.UserData
+	for _, field := range Schema {
+		if field.Type == DateField {
+			// Periods were handled above.
+			continue
+		}
+		value := fields.validateField(field, validationIssues)
+		if value == "" {
+			continue
+		}
+		if err := field.set(&userData, value); err != nil {
+			validationIssues.Set(fields.issueKey(field.Name, -1), err)
+		}
 	}
 
-	nightShiftRetrocessionPerc := retrocessionPerc
-	nightShiftRetrocessionPercStr := strings.TrimSpace(r.PostFormValue("financials-nightShiftRetrocession"))
-	if nightShiftRetrocessionPercStr != "" {
-		nightShiftRetrocessionPerc, err = strconv.Atoi(nightShiftRetrocessionPercStr)
-		if err != nil {
-			validationIssues.Set("financials-nightShiftRetrocession", validation.ParseError)
-		}
+	if manner.LookupDoctor != nil {
+		verifyDoctor(fields, manner.LookupDoctor, "regular-rpps", "regular-name", validationIssues)
+		verifyDoctor(fields, manner.LookupDoctor, "substitute-rpps", "substitute-name", validationIssues)
+		userData.Warnings = validationIssues.WarningMessages()
 	}
 
-	retrocessionsDiffer := retrocessionPerc != nightShiftRetrocessionPerc
-	financials := datamap.Financials{
-		HonorairesPercentage: retrocessionPerc,
-		Gardes: datamap.GardesFinancials{
-			Differs:              retrocessionsDiffer,
-			HonorairesPercentage: nightShiftRetrocessionPerc,
-		},
+	userData.Periods = periods
+	userData.Regular.HonorificTitle = datamap.Docteur
+	userData.DateContractEstablished = established
+	// Night shifts are paid back like other days, unless stated otherwise.
+	financials := &userData.Financials
+	if strings.TrimSpace(fields.value("financials-nightShiftRetrocession")) == "" {
+		financials.Gardes.HonorairesPercentage = financials.HonorairesPercentage
 	}
+	financials.Gardes.Differs = financials.Gardes.HonorairesPercentage != financials.HonorairesPercentage
 
 	if err := validationIssues.Error(); err != nil {
 		return nil, err
 	}
 
-	return datamap.MarkSafe(datamap.UserData{
-		Regular:                 regularDoctor,
-		Substituting:            substituting,
-		Periods:                 periods,
-		Financials:              financials,
-		DateContractEstablished: time.Now().In(manner.TimeLocation),
-	}), nil
+	return datamap.MarkSafe(userData), nil
 }
@@ -0,0 +1,132 @@
+package form
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"autocontract/pkg/datamap"
+	"autocontract/pkg/validation"
+)
+
+func validate(validators []Validator, value string) error {
+	var err error
+	for _, validator := range validators {
+		if value, err = validator.validate(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestIdentificationNumbers(t *testing.T) {
+	for _, test := range []struct {
+		validators []Validator
+		value      string
+		expected   error
+	}{
+		{RPPSValidators, "10101010105", nil},
+		{RPPSValidators, "10101010101", validation.InvalidNumber},
+		{RPPSValidators, "1010101010A", validation.InvalidNumber},
+		{RPPSValidators, "1010101010", validation.LengthError},
+		{SIRETValidators, "73282932000009", nil},
+		{SIRETValidators, "73282932000001", validation.InvalidNumber},
+		{SIRETValidators, "7328293200000 ", validation.InvalidNumber},
+		// Valid SIRET checksum, but the SIREN checksum is wrong.
+		{SIRETValidators, "73282933000008", validation.InvalidNumber},
+		// La Poste SIRET numbers only need their digits to add up to a multiple of 5.
+		{SIRETValidators, "35600000052135", nil},
+		{SIRETValidators, "35600000052136", validation.InvalidNumber},
+		{SIRETValidators, "3560000005213", validation.LengthError},
+	} {
+		err := validate(test.validators, test.value)
+		if test.expected == nil && err != nil {
+			t.Errorf("'%s': unexpected error %s", test.value, err)
+		} else if !errors.Is(err, test.expected) {
+			t.Errorf("'%s': got error %v, expected %s", test.value, err, test.expected)
+		}
+	}
+}
+
+func day(month time.Month, d int) time.Time {
+	return time.Date(2020, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func period(start, end time.Time) datamap.Period {
+	return datamap.Period{Start: start, End: end}
+}
+
+func TestSanitizePeriods(t *testing.T) {
+	established := time.Date(2020, time.May, 15, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		title    string
+		periods  []datamap.Period
+		expected []datamap.Period
+		// expectedIssues are the form issues, and the indexes of their periods.
+		expectedIssues map[string][]int
+		// expectedJSONIssues are the issues of JSON requests.
+		expectedJSONIssues map[string]error
+	}{
+		{
+			title:    "adjacent periods, out of order",
+			periods:  []datamap.Period{period(day(time.June, 6), day(time.June, 8)), period(day(time.June, 1), day(time.June, 5)), period(day(time.June, 10), day(time.June, 10))},
+			expected: []datamap.Period{period(day(time.June, 1), day(time.June, 8)), period(day(time.June, 10), day(time.June, 10))},
+		},
+		{
+			title:              "reversed period",
+			periods:            []datamap.Period{period(day(time.June, 1), day(time.June, 5)), period(day(time.June, 12), day(time.June, 10))},
+			expectedIssues:     map[string][]int{"period-end": {1}},
+			expectedJSONIssues: map[string]error{"/periods/1/end": validation.ReversedPeriod},
+		},
+		{
+			title:              "overlapping periods",
+			periods:            []datamap.Period{period(day(time.June, 3), day(time.June, 7)), period(day(time.June, 20), day(time.June, 22)), period(day(time.June, 1), day(time.June, 3))},
+			expectedIssues:     map[string][]int{"period-start": {0}},
+			expectedJSONIssues: map[string]error{"/periods/0/start": validation.OverlappingPeriods},
+		},
+		{
+			title:    "dates at the bounds, whatever the time the contract is established",
+			periods:  []datamap.Period{period(time.Date(2019, time.May, 15, 0, 0, 0, 0, time.UTC), time.Date(2022, time.May, 15, 0, 0, 0, 0, time.UTC))},
+			expected: []datamap.Period{period(time.Date(2019, time.May, 15, 0, 0, 0, 0, time.UTC), time.Date(2022, time.May, 15, 0, 0, 0, 0, time.UTC))},
+		},
+		{
+			title:              "dates out of range",
+			periods:            []datamap.Period{period(day(time.June, 1), day(time.June, 5)), period(time.Date(1900, time.June, 1, 0, 0, 0, 0, time.UTC), day(time.June, 5)), period(day(time.June, 1), time.Date(2030, time.June, 1, 0, 0, 0, 0, time.UTC))},
+			expectedIssues:     map[string][]int{"period-start": {1}, "period-end": {2}},
+			expectedJSONIssues: map[string]error{"/periods/1/start": validation.OutOfRange, "/periods/2/end": validation.OutOfRange},
+		},
+	} {
+		periods, issues := sanitizePeriods(test.periods, established, formIssueKey)
+		if test.expectedIssues == nil {
+			if err := issues.Error(); err != nil {
+				t.Errorf("'%s': unexpected issues %s", test.title, err)
+			}
+			if !reflect.DeepEqual(periods, test.expected) {
+				t.Errorf("'%s': got periods %v, expected %v", test.title, periods, test.expected)
+			}
+			continue
+		}
+
+		all := issues.GetAll()
+		if len(all) != len(test.expectedIssues) {
+			t.Errorf("'%s': got issues %v, expected issues with %v", test.title, all, test.expectedIssues)
+		}
+		for key, indexes := range test.expectedIssues {
+			if got := issues.Indexes(key); !reflect.DeepEqual(got, indexes) {
+				t.Errorf("'%s': got indexes %v for '%s', expected %v", test.title, got, key, indexes)
+			}
+		}
+
+		_, issues = sanitizePeriods(test.periods, established, jsonIssueKey)
+		all = issues.GetAll()
+		if len(all) != len(test.expectedJSONIssues) {
+			t.Errorf("'%s': got JSON issues %v, expected %v", test.title, all, test.expectedJSONIssues)
+		}
+		for key, expected := range test.expectedJSONIssues {
+			if !errors.Is(all[key], expected) {
+				t.Errorf("'%s': got issue %v for '%s', expected %s", test.title, all[key], key, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package form
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"autocontract/pkg/datamap"
+	"autocontract/pkg/validation"
+)
+
+// ContractRequest is the JSON equivalent of the contract form, e.g.
+//
+//	{
+//	  "periods": [{"start": "2020-06-01", "end": "2020-06-05"}],
+//	  "regular": {"name": "Marie Curie", "rpps": "10101010105", "address": "1 rue des Lilas, 75016 PARIS"},
+//	  "substitute": {
+//	    "name": "Pierre Curie", "title": "Docteur", "rpps": "10202020201", "siret": "73282932000009",
+//	    "substituting_id": "1234", "address": "2 rue des Lilas, 75016 PARIS"
+//	  },
+//	  "financials": {"retrocession": 70, "night_shift_retrocession": 80}
+//	}
+//
+// Fields are validated like the fields of the form, and issues are reported under the
+// JSON pointer of the field, e.g. "/regular/rpps" or "/periods/0/end".
+type ContractRequest struct {
+	Periods    []ContractPeriod   `json:"periods"`
+	Regular    ContractRegular    `json:"regular"`
+	Substitute ContractSubstitute `json:"substitute"`
+	Financials ContractFinancials `json:"financials"`
+}
+
+// ContractPeriod has dates formatted like in the form, e.g. "2020-06-01".
+type ContractPeriod struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// ContractRegular describes the regular doctor, who is always a "Docteur".
+type ContractRegular struct {
+	Name    string `json:"name"`
+	RPPS    string `json:"rpps"`
+	Address string `json:"address"`
+	// Signature is an optional SVG image, as a data URL.
+	Signature string `json:"signature,omitempty"`
+}
+
+// ContractSubstitute describes the substitute doctor.
+type ContractSubstitute struct {
+	Name           string `json:"name"`
+	Title          string `json:"title"`
+	RPPS           string `json:"rpps"`
+	SIRET          string `json:"siret"`
+	SubstitutingID string `json:"substituting_id"`
+	Address        string `json:"address"`
+	// Signature is an optional SVG image, as a data URL.
+	Signature string `json:"signature,omitempty"`
+}
+
+// ContractFinancials holds percentages. NightShiftRetrocession defaults to Retrocession.
+type ContractFinancials struct {
+	Retrocession           *int `json:"retrocession"`
+	NightShiftRetrocession *int `json:"night_shift_retrocession,omitempty"`
+}
+
+// jsonIssueKey reports issues under the JSON pointers of the fields.
+func jsonIssueKey(name string, index int) string {
+	field, ok := schemaField(name)
+	if !ok {
+		return name
+	}
+	if field.Type == DateField {
+		if index < 0 {
+			return "/periods"
+		}
+		return strings.Replace(field.JSONPointer, "{i}", strconv.Itoa(index), 1)
+	}
+	return field.JSONPointer
+}
+
+func formatPercentage(p *int) string {
+	if p == nil {
+		return ""
+	}
+	return strconv.Itoa(*p)
+}
+
+// ProcessJSON validates a ContractRequest read from r. Malformed JSON, JSON with unknown
+// fields or trailing data, is rejected with a validation.RequestError.
+func ProcessJSON(r io.Reader, manner FormProcessingManner) (datamap.SafeUserData, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var req ContractRequest
+	if err := decoder.Decode(&req); err != nil {
+		return nil, validation.RequestError{Err: fmt.Errorf("invalid JSON contract request: %w", err)}
+	}
+	// A single contract request is expected, without anything after it.
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, validation.RequestError{Err: errors.New("invalid JSON contract request: unexpected data after the request")}
+	}
+
+	values := map[string]string{
+		"regular-name":                      req.Regular.Name,
+		"regular-rpps":                      req.Regular.RPPS,
+		"regular-address":                   req.Regular.Address,
+		"regular-signature":                 req.Regular.Signature,
+		"substitute-name":                   req.Substitute.Name,
+		"substitute-title":                  req.Substitute.Title,
+		"substitute-rpps":                   req.Substitute.RPPS,
+		"substitute-siret":                  req.Substitute.SIRET,
+		"substitute-substitutingID":         req.Substitute.SubstitutingID,
+		"substitute-address":                req.Substitute.Address,
+		"substitute-signature":              req.Substitute.Signature,
+		"financials-retrocession":           formatPercentage(req.Financials.Retrocession),
+		"financials-nightShiftRetrocession": formatPercentage(req.Financials.NightShiftRetrocession),
+	}
+	fields := contractFields{
+		value:    func(name string) string { return values[name] },
+		issueKey: jsonIssueKey,
+	}
+	for _, period := range req.Periods {
+		fields.periodStarts = append(fields.periodStarts, period.Start)
+		fields.periodEnds = append(fields.periodEnds, period.End)
+	}
+	return process(fields, manner)
+}
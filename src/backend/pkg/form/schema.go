@@ -0,0 +1,174 @@
+package form
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"autocontract/pkg/datamap"
+	"autocontract/pkg/validation"
+)
+
+// FieldType is the type of the value of a contract field.
+type FieldType string
+
+const (
+	TextField FieldType = "text"
+	// ChoiceField values are one of the values of their OneOf validator.
+	ChoiceField FieldType = "choice"
+	// IntegerField values are written in base 10.
+	IntegerField FieldType = "integer"
+	// DateField values are formatted like FormProcessingManner.TimeLayout. Date fields are
+	// repeated, a start and an end for each period.
+	DateField FieldType = "date"
+	// SignatureField values are SVG images, as data URLs.
+	SignatureField FieldType = "signature"
+)
+
+// Validator is a validation rule of a field, described so that browsers can apply it too.
+type Validator struct {
+	// Kind is one of "minLength", "maxLength", "oneOf", "integer", "digits", "rppsCheckDigit",
+	// "siretCheckDigit" or "signature".
+	Kind string `json:"kind"`
+	// Length is the parameter of "minLength" and "maxLength" validators, in characters.
+	Length int `json:"length,omitempty"`
+	// Values are the accepted values of "oneOf" validators.
+	Values []string `json:"values,omitempty"`
+	// Min and Max bound the values of "integer" validators.
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+
+	validate validationFunc
+}
+
+func MinLength(length int) Validator {
+	return Validator{Kind: "minLength", Length: length, validate: minLength(length)}
+}
+
+func MaxLength(length int) Validator {
+	return Validator{Kind: "maxLength", Length: length, validate: maxLength(length)}
+}
+
+func OneOf(values ...string) Validator {
+	return Validator{Kind: "oneOf", Values: values, validate: oneOf(values)}
+}
+
+func Integer(min, max int) Validator {
+	return Validator{Kind: "integer", Min: &min, Max: &max, validate: integer(min, max)}
+}
+
+func Digits() Validator {
+	return Validator{Kind: "digits", validate: digits}
+}
+
+// RPPSCheckDigit checks the Luhn checksum of an RPPS number. It must follow Digits.
+func RPPSCheckDigit() Validator {
+	return Validator{Kind: "rppsCheckDigit", validate: rppsCheckDigit}
+}
+
+// SIRETCheckDigit checks the Luhn checksums of a SIRET number and of its SIREN number, with the
+// exception of La Poste. It must follow Digits and the length validators.
+func SIRETCheckDigit() Validator {
+	return Validator{Kind: "siretCheckDigit", validate: siretCheckDigit}
+}
+
+// Signature makes sure the value is an SVG image which is safe to display.
+func Signature() Validator {
+	return Validator{Kind: "signature", validate: sanitizeSignature}
+}
+
+// Field describes a field of the contract form.
+type Field struct {
+	// Name is the name of the form field.
+	Name string    `json:"name"`
+	Type FieldType `json:"type"`
+	// Optional fields may be left empty, other fields are trimmed and must not be empty.
+	Optional bool `json:"optional"`
+	// Validators are run in order, on non-empty values.
+	Validators []Validator `json:"validators"`
+	// Path is where the value goes in datamap.UserData, e.g. "Regular.NumberRPPS".
+	Path string `json:"path"`
+	// JSONPointer is the pointer of the field in a ContractRequest. "{i}" stands for the
+	// index of the period in the pointers of date fields.
+	JSONPointer string `json:"json_pointer"`
+}
+
+var (
+	NameValidators = []Validator{
+		MaxLength(MaxNameLength),
+	}
+	RPPSValidators = []Validator{
+		Digits(), MaxLength(RPPSLength), MinLength(RPPSLength), RPPSCheckDigit(),
+	}
+	SIRETValidators = []Validator{
+		Digits(), MaxLength(SIRETLength), MinLength(SIRETLength), SIRETCheckDigit(),
+	}
+	TitleValidators = []Validator{
+		MaxLength(MaxTitleLength), OneOf(datamap.Docteur, datamap.Madame, datamap.Monsieur),
+	}
+	GenericMaxLength = []Validator{
+		MaxLength(MaxGenericLength),
+	}
+	PercentageValidators = []Validator{
+		Integer(0, 100),
+	}
+)
+
+// Schema describes all the fields of the contract form, and drives their processing.
+var Schema = []Field{
+	{Name: "period-start", Type: DateField, Path: "Periods.Start", JSONPointer: "/periods/{i}/start"},
+	{Name: "period-end", Type: DateField, Path: "Periods.End", JSONPointer: "/periods/{i}/end"},
+
+	{Name: "regular-name", Type: TextField, Validators: NameValidators, Path: "Regular.Name", JSONPointer: "/regular/name"},
+	{Name: "regular-rpps", Type: TextField, Validators: RPPSValidators, Path: "Regular.NumberRPPS", JSONPointer: "/regular/rpps"},
+	{Name: "regular-address", Type: TextField, Validators: GenericMaxLength, Path: "Regular.Address", JSONPointer: "/regular/address"},
+	{Name: "regular-signature", Type: SignatureField, Optional: true, Validators: []Validator{Signature()}, Path: "Regular.SignatureImgHtml", JSONPointer: "/regular/signature"},
+
+	{Name: "substitute-name", Type: TextField, Validators: NameValidators, Path: "Substituting.Name", JSONPointer: "/substitute/name"},
+	{Name: "substitute-title", Type: ChoiceField, Validators: TitleValidators, Path: "Substituting.HonorificTitle", JSONPointer: "/substitute/title"},
+	{Name: "substitute-rpps", Type: TextField, Validators: RPPSValidators, Path: "Substituting.NumberRPPS", JSONPointer: "/substitute/rpps"},
+	{Name: "substitute-siret", Type: TextField, Validators: SIRETValidators, Path: "Substituting.NumberSIRET", JSONPointer: "/substitute/siret"},
+	{Name: "substitute-substitutingID", Type: TextField, Validators: GenericMaxLength, Path: "Substituting.NumberSubstitutingID", JSONPointer: "/substitute/substituting_id"},
+	{Name: "substitute-address", Type: TextField, Validators: GenericMaxLength, Path: "Substituting.Address", JSONPointer: "/substitute/address"},
+	{Name: "substitute-signature", Type: SignatureField, Optional: true, Validators: []Validator{Signature()}, Path: "Substituting.SignatureImgHtml", JSONPointer: "/substitute/signature"},
+
+	{Name: "financials-retrocession", Type: IntegerField, Validators: PercentageValidators, Path: "Financials.HonorairesPercentage", JSONPointer: "/financials/retrocession"},
+	// Defaults to the retrocession of other days.
+	{Name: "financials-nightShiftRetrocession", Type: IntegerField, Optional: true, Validators: PercentageValidators, Path: "Financials.Gardes.HonorairesPercentage", JSONPointer: "/financials/night_shift_retrocession"},
+}
+
+// schemaField returns the field of the schema with the given name.
+func schemaField(name string) (Field, bool) {
+	for _, field := range Schema {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// set sets the validated value of the field in userData, at the field's path.
+func (field Field) set(userData *datamap.UserData, value string) error {
+	v := reflect.ValueOf(userData).Elem()
+	for _, name := range strings.Split(field.Path, ".") {
+		v = v.FieldByName(name)
+		if !v.IsValid() {
+			return fmt.Errorf("no field '%s' in path '%s'", name, field.Path)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%w, %s", validation.ParseError, err)
+		}
+		v.SetInt(int64(i))
+	default:
+		return fmt.Errorf("can not set field of kind %s at path '%s'", v.Kind(), field.Path)
+	}
+	return nil
+}
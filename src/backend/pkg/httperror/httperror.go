@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 
 	"autocontract/pkg/validation"
@@ -22,6 +23,42 @@ type genericJSONError struct {
 	Message string `json:"error"`
 }
 
+// ErrBodyTooLarge is the error of reading more than allowed from a body limited by MaxBytesReader.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+type maxBytesReader struct {
+	r     io.ReadCloser
+	limit int64
+	read  int64
+}
+
+// MaxBytesReader is like http.MaxBytesReader, but reading past the limit fails with ErrBodyTooLarge.
+func MaxBytesReader(w http.ResponseWriter, r io.ReadCloser, n int64) io.ReadCloser {
+	return &maxBytesReader{r: http.MaxBytesReader(w, r, n), limit: n}
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	// http.MaxBytesReader only fails with a read error once the limit is reached.
+	if err != nil && err != io.EOF && l.read >= l.limit {
+		err = ErrBodyTooLarge
+	}
+	return n, err
+}
+
+func (l *maxBytesReader) Close() error {
+	return l.r.Close()
+}
+
+// requestErrorStatus tells apart requests which are too large from otherwise malformed ones.
+func requestErrorStatus(err validation.RequestError) int {
+	if errors.Is(err, ErrBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
 func writeError(w http.ResponseWriter, mediaType string, err error) {
 	// TODO: log details on server-side
 	if mediaType == NotAcceptable {
@@ -39,9 +76,15 @@ func writeError(w http.ResponseWriter, mediaType string, err error) {
 			encoder := json.NewEncoder(w)
 
 			var perr validation.UserError
+			var rerr validation.RequestError
 			if errors.As(err, &perr) {
 				w.WriteHeader(http.StatusUnprocessableEntity)
 				encoder.Encode(perr.Issues)
+			} else if errors.As(err, &rerr) {
+				w.WriteHeader(requestErrorStatus(rerr))
+				encoder.Encode(genericJSONError{
+					Message: rerr.Error(),
+				})
 			} else {
 				w.WriteHeader(http.StatusBadRequest)
 				encoder.Encode(genericJSONError{
@@ -72,6 +115,11 @@ func writeError(w http.ResponseWriter, mediaType string, err error) {
 	}
 }
 
+// JSONError writes err as JSON, whatever the media types accepted by the client.
+func JSONError(w http.ResponseWriter, err error) {
+	writeError(w, ApplicationJson, err)
+}
+
 func RichError(w http.ResponseWriter, r *http.Request, err error) {
 	availableTypes := []string{ApplicationJson, TextPlain, TextHtml}
 	const defaultOffer = NotAcceptable
@@ -0,0 +1,322 @@
+package pdfgen
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"autocontract/pkg/csp"
+
+	"github.com/mafredri/cdp"
+	"github.com/mafredri/cdp/devtool"
+	"github.com/mafredri/cdp/protocol/fetch"
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/mafredri/cdp/protocol/page"
+	"github.com/mafredri/cdp/protocol/runtime"
+	"github.com/mafredri/cdp/rpcc"
+	"github.com/rs/zerolog/log"
+)
+
+// documentURL is the URL the page navigates to, to be handed the HTML document.
+// It is never actually requested over the network.
+const documentURL = "http://contract.invalid/"
+
+// PoolConfig describes the pool of browser targets (i.e. pages) used for PDF generation.
+type PoolConfig struct {
+	// Size is the maximum number of PDFs that can be generated concurrently.
+	Size int
+	// MaxRendersPerTarget is the number of PDFs a target generates before being closed
+	// and replaced by a fresh one. Zero means targets are never recycled.
+	MaxRendersPerTarget int
+}
+
+// target is a browser target of the pool, which renders PDFs one at a time.
+type target interface {
+	// isHealthy checks that the target still responds.
+	isHealthy(ctx context.Context) bool
+	render(ctx context.Context, html []byte) ([]byte, error)
+	close()
+}
+
+// pooledTarget is a target of the pool, with the number of PDFs it rendered.
+type pooledTarget struct {
+	target
+	numRenders int
+}
+
+type browserTarget struct {
+	devTools             *devtool.DevTools
+	devToolsConnTimeout  time.Duration
+	target               *devtool.Target
+	devToolsProtocolConn *rpcc.Conn
+	client               *cdp.Client
+}
+
+// cdpRenderer generates PDFs with a headless Chrome, controlled through the Chrome DevTools Protocol.
+type cdpRenderer struct {
+	devToolsConnTimeout time.Duration
+	maxRendersPerTarget int
+	newTarget           func(ctx context.Context) (target, error)
+	// targets holds the idle targets of the pool.
+	// A nil value is a free slot for which no target has been created yet.
+	targets chan *pooledTarget
+}
+
+// NewCDPRenderer returns a Renderer controlling the browser whose DevTools server is at url.
+func NewCDPRenderer(url string, connectionTimeout time.Duration, poolConfig PoolConfig) (Renderer, error) {
+	// Use the DevTools HTTP/JSON API to manage targets (e.g. pages, webworkers).
+	devTools := devtool.New(url)
+	pdfGen, err := newCDPRenderer(connectionTimeout, poolConfig, func(ctx context.Context) (target, error) {
+		bt, err := newBrowserTarget(ctx, devTools, connectionTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return bt, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdfGen.devToolsConnTimeout)
+	defer cancel()
+	// Try to connect right-away to the remote-controlled browser as an optimization,
+	// but ignore any error.
+	pt, err := pdfGen.acquireTarget(ctx)
+	if err == nil {
+		pdfGen.releaseTarget(pt, nil)
+	}
+
+	return pdfGen, nil
+}
+
+// newCDPRenderer returns a cdpRenderer with an empty pool, creating its targets with newTarget.
+func newCDPRenderer(connectionTimeout time.Duration, poolConfig PoolConfig, newTarget func(ctx context.Context) (target, error)) (*cdpRenderer, error) {
+	if poolConfig.Size < 1 {
+		return nil, fmt.Errorf("pool size must be at least 1 (is %d)", poolConfig.Size)
+	}
+
+	pdfGen := &cdpRenderer{
+		devToolsConnTimeout: connectionTimeout,
+		maxRendersPerTarget: poolConfig.MaxRendersPerTarget,
+		newTarget:           newTarget,
+		targets:             make(chan *pooledTarget, poolConfig.Size),
+	}
+	for i := 0; i < poolConfig.Size; i++ {
+		pdfGen.targets <- nil
+	}
+	return pdfGen, nil
+}
+
+func newBrowserTarget(ctx context.Context, devTools *devtool.DevTools, devToolsConnTimeout time.Duration) (*browserTarget, error) {
+	pt, err := devTools.Create(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initiate a new RPC connection to the Chrome DevTools Protocol target.
+	conn, err := rpcc.DialContext(ctx, pt.WebSocketDebuggerURL)
+	if err != nil {
+		devTools.Close(ctx, pt)
+		return nil, err
+	}
+
+	return &browserTarget{
+		devTools:             devTools,
+		devToolsConnTimeout:  devToolsConnTimeout,
+		target:               pt,
+		devToolsProtocolConn: conn,
+		client:               cdp.NewClient(conn),
+	}, nil
+}
+
+func (bt *browserTarget) close() {
+	// Leaving connections open will leak memory otherwise.
+	bt.devToolsProtocolConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), bt.devToolsConnTimeout)
+	defer cancel()
+	// The browser might be gone already, nothing more we can do in that case.
+	bt.devTools.Close(ctx, bt.target)
+}
+
+// isHealthy checks that the target still responds, with a cheap evaluation in the page.
+func (bt *browserTarget) isHealthy(ctx context.Context) bool {
+	_, err := bt.client.Runtime.Evaluate(ctx, runtime.NewEvaluateArgs("1"))
+	return err == nil
+}
+
+func (bt *browserTarget) render(ctx context.Context, html []byte) ([]byte, error) {
+	return pdfFromHTML(ctx, html, bt.client)
+}
+
+// acquireTarget waits for a target of the pool to be available and returns it, healthy.
+//
+// Goroutines blocked receiving on a channel are served in order, so callers are
+// handed targets on a first-come first-served basis.
+func (pdfGen *cdpRenderer) acquireTarget(ctx context.Context) (*pooledTarget, error) {
+	var pt *pooledTarget
+	select {
+	case pt = <-pdfGen.targets:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	setupCtx, cancel := context.WithTimeout(ctx, pdfGen.devToolsConnTimeout)
+	defer cancel()
+
+	if pt != nil && !pt.isHealthy(setupCtx) {
+		pt.close()
+		pt = nil
+	}
+	if pt == nil {
+		t, err := pdfGen.newTarget(setupCtx)
+		if err != nil {
+			// Give back the slot.
+			pdfGen.targets <- nil
+			return nil, err
+		}
+		pt = &pooledTarget{target: t}
+	}
+	return pt, nil
+}
+
+// releaseTarget gives back a target to the pool, recycling it if it failed or did enough renders.
+func (pdfGen *cdpRenderer) releaseTarget(pt *pooledTarget, renderErr error) {
+	if renderErr != nil || (pdfGen.maxRendersPerTarget > 0 && pt.numRenders >= pdfGen.maxRendersPerTarget) {
+		pt.close()
+		pt = nil
+	}
+	pdfGen.targets <- pt
+}
+
+func (pdfGen *cdpRenderer) Shutdown() {
+	for {
+		select {
+		case pt := <-pdfGen.targets:
+			if pt != nil {
+				pt.close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (pdfGen *cdpRenderer) Render(ctx context.Context, html []byte) ([]byte, error) {
+	pt, err := pdfGen.acquireTarget(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := pt.render(ctx, html)
+	pt.numRenders += 1
+	pdfGen.releaseTarget(pt, err)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// pdfFromHTML loads the HTML document in the page and prints it to PDF.
+//
+// The document is handed to the page by intercepting the navigation request to documentURL
+// and answering it ourselves. Every other request the page makes is failed, so nothing but
+// the document (and its inline data) can end up in the PDF.
+func pdfFromHTML(ctx context.Context, html []byte, c *cdp.Client) ([]byte, error) {
+	requestPausedClient, err := c.Fetch.RequestPaused(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer requestPausedClient.Close()
+
+	// Open a LoadEventFired client to buffer this event.
+	loadEventClient, err := c.Page.LoadEventFired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer loadEventClient.Close()
+
+	// Enable events on the Page domain, it's often preferrable to create
+	// event clients before enabling events so that we don't miss any.
+	if err = c.Page.Enable(ctx); err != nil {
+		return nil, err
+	}
+	if err = c.Fetch.Enable(ctx, fetch.NewEnableArgs()); err != nil {
+		return nil, err
+	}
+	defer c.Fetch.Disable(ctx)
+
+	interceptErrChan := make(chan error, 1)
+	go func() {
+		interceptErrChan <- serveDocument(ctx, html, c, requestPausedClient)
+	}()
+
+	navArgs := page.NewNavigateArgs(documentURL)
+	nav, err := c.Page.Navigate(ctx, navArgs)
+	if err != nil {
+		return nil, err
+	}
+	if nav.ErrorText != nil {
+		return nil, fmt.Errorf("navigation to document for PDF generation failed: %s", *nav.ErrorText)
+	}
+
+	// Wait until we have a LoadEventFired event.
+	if _, err = loadEventClient.Recv(); err != nil {
+		return nil, err
+	}
+
+	// footerTemplate := `<span class=pageNumber></span><span class=totalPages></span>`
+	pdfArgs := page.NewPrintToPDFArgs().
+		SetPreferCSSPageSize(true).
+		SetPrintBackground(true).
+		SetDisplayHeaderFooter(false)
+		// SetHeaderTemplate("").
+		// SetFooterTemplate(footerTemplate)
+	pdf, err := c.Page.PrintToPDF(ctx, pdfArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop intercepting, and check nothing went wrong while we were.
+	requestPausedClient.Close()
+	if err := <-interceptErrChan; err != nil {
+		return nil, err
+	}
+
+	return pdf.Data, nil
+}
+
+// serveDocument answers the intercepted request for documentURL with the HTML document,
+// and fails all other requests.
+// It returns when the RequestPausedClient is closed.
+func serveDocument(ctx context.Context, html []byte, c *cdp.Client, requestPausedClient fetch.RequestPausedClient) error {
+	body := base64.StdEncoding.EncodeToString(html)
+	for {
+		ev, err := requestPausedClient.Recv()
+		if err != nil {
+			// The client was closed, we're done.
+			return nil
+		}
+
+		if ev.Request.URL != documentURL {
+			log.Warn().Msgf("blocked request from PDF document to %s", ev.Request.URL)
+			err = c.Fetch.FailRequest(ctx, fetch.NewFailRequestArgs(ev.RequestID, network.ErrorReasonBlockedByClient))
+		} else {
+			fulfillArgs := fetch.NewFulfillRequestArgs(ev.RequestID, http.StatusOK).
+				SetResponseHeaders([]fetch.HeaderEntry{
+					{Name: "Content-Type", Value: "text/html; charset=utf-8"},
+					// As an extra paranoid step, use a CSP header for the document used for PDF generation.
+					// Go's html/template package is used for escaping user content so injections shouldn't be an issue,
+					// but defense in depth can't hurt.
+					{Name: csp.HeaderCSP, Value: csp.PdfDocumentCSPHeader},
+				}).
+				SetBody(body)
+			err = c.Fetch.FulfillRequest(ctx, fulfillArgs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
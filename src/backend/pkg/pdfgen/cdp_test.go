@@ -0,0 +1,150 @@
+package pdfgen
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFakeRender = errors.New("fake render failure")
+
+// fakeTarget renders the HTML document as is, or fails when failRender is set.
+type fakeTarget struct {
+	mutex      sync.Mutex
+	unhealthy  bool
+	failRender bool
+	renders    int
+	closed     bool
+}
+
+func (t *fakeTarget) isHealthy(ctx context.Context) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return !t.unhealthy
+}
+
+func (t *fakeTarget) render(ctx context.Context, html []byte) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.renders += 1
+	if t.failRender {
+		return nil, errFakeRender
+	}
+	return html, nil
+}
+
+func (t *fakeTarget) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+}
+
+// fakePool is a cdpRenderer whose targets are fakeTargets.
+type fakePool struct {
+	*cdpRenderer
+	targets []*fakeTarget
+}
+
+func newFakePool(t *testing.T, poolConfig PoolConfig) *fakePool {
+	pool := &fakePool{}
+	var err error
+	pool.cdpRenderer, err = newCDPRenderer(time.Second, poolConfig, func(ctx context.Context) (target, error) {
+		ft := &fakeTarget{}
+		pool.targets = append(pool.targets, ft)
+		return ft, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func (pool *fakePool) render(t *testing.T) error {
+	t.Helper()
+	pdf, err := pool.Render(context.Background(), []byte("contract"))
+	if err == nil && string(pdf) != "contract" {
+		t.Errorf("unexpected PDF '%s'", pdf)
+	}
+	return err
+}
+
+func TestTargetsAreReused(t *testing.T) {
+	pool := newFakePool(t, PoolConfig{Size: 1})
+	for i := 0; i < 3; i++ {
+		if err := pool.render(t); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(pool.targets) != 1 || pool.targets[0].renders != 3 {
+		t.Errorf("expected a single target for sequential renders, got %d", len(pool.targets))
+	}
+
+	// An unhealthy target is replaced when acquired.
+	pool.targets[0].unhealthy = true
+	if err := pool.render(t); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.targets) != 2 || !pool.targets[0].closed {
+		t.Errorf("unhealthy target was not replaced")
+	}
+}
+
+func TestTargetsAreRecycled(t *testing.T) {
+	pool := newFakePool(t, PoolConfig{Size: 1, MaxRendersPerTarget: 2})
+	for i := 0; i < 5; i++ {
+		if err := pool.render(t); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(pool.targets) != 3 {
+		t.Fatalf("got %d targets for 5 renders, expected 3", len(pool.targets))
+	}
+	for i, ft := range pool.targets {
+		if ft.closed != (i < 2) {
+			t.Errorf("target %d: closed = %t after %d renders", i, ft.closed, ft.renders)
+		}
+	}
+
+	// Targets which failed a render are replaced too.
+	pool.targets[2].failRender = true
+	if err := pool.render(t); err != errFakeRender {
+		t.Fatalf("got error %v, expected %s", err, errFakeRender)
+	}
+	if !pool.targets[2].closed {
+		t.Errorf("target was not closed after failing")
+	}
+	if err := pool.render(t); err != nil || len(pool.targets) != 4 {
+		t.Errorf("failed target was not replaced (error %v)", err)
+	}
+}
+
+func TestAcquireTargetIsCancellable(t *testing.T) {
+	pool := newFakePool(t, PoolConfig{Size: 1})
+	pt, err := pool.acquireTarget(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only target is in use.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Render(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, expected %s", err, context.DeadlineExceeded)
+	}
+
+	// Once released, the target serves waiting renders.
+	done := make(chan error)
+	go func() {
+		_, err := pool.Render(context.Background(), []byte("contract"))
+		done <- err
+	}()
+	pool.releaseTarget(pt, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.targets) != 1 {
+		t.Errorf("got %d targets, expected a single one", len(pool.targets))
+	}
+}
@@ -0,0 +1,130 @@
+package pdfgen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	fakePdfLinesPerPage = 50
+	fakePdfLineLength   = 95
+)
+
+var (
+	invisibleElementsRegexp = regexp.MustCompile(`(?is)<(style|script)[^>]*>.*?</(style|script)>`)
+	lineBreakingTagsRegexp  = regexp.MustCompile(`(?i)<br[^>]*>|</(p|div|h[1-6]|li|tr|title|section|header|footer)>`)
+	tagsRegexp              = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacesRegexp            = regexp.MustCompile(`\s+`)
+)
+
+// fakeRenderer outputs a plain PDF, containing only the text of the HTML document.
+//
+// It doesn't need a browser and is meant for tests and local development.
+type fakeRenderer struct{}
+
+// NewFakeRenderer returns a Renderer which does not depend on any external service.
+func NewFakeRenderer() Renderer {
+	return &fakeRenderer{}
+}
+
+func (f *fakeRenderer) Shutdown() {}
+
+func (f *fakeRenderer) Render(ctx context.Context, html []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return textPdf(htmlToTextLines(string(html)))
+}
+
+// htmlToTextLines does a rough conversion of an HTML document to lines of text.
+func htmlToTextLines(document string) []string {
+	s := invisibleElementsRegexp.ReplaceAllString(document, "")
+	s = lineBreakingTagsRegexp.ReplaceAllString(s, "\n")
+	s = tagsRegexp.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(spacesRegexp.ReplaceAllString(line, " "))
+		for len([]rune(line)) > fakePdfLineLength {
+			rs := []rune(line)
+			lines = append(lines, string(rs[:fakePdfLineLength]))
+			line = string(rs[fakePdfLineLength:])
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func escapePdfString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
+
+// textPdf writes a minimal PDF document with the lines of text, using a standard font.
+func textPdf(lines []string) ([]byte, error) {
+	// The standard PDF fonts only know about single byte encodings.
+	encoder := encoding.ReplaceUnsupported(charmap.Windows1252.NewEncoder())
+
+	var pages [][]string
+	for len(lines) > fakePdfLinesPerPage {
+		pages = append(pages, lines[:fakePdfLinesPerPage])
+		lines = lines[fakePdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects 1, 2 and 3 are the catalog, page tree and font,
+	// followed by a page object and its content stream for each page.
+	var objects []string
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+2*i))
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	)
+	for i, pageLines := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 11 Tf 14 TL 50 800 Td\n")
+		for _, line := range pageLines {
+			encodedLine, err := encoder.String(line)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&content, "(%s) '\n", escapePdfString(encodedLine))
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xrefOffset)
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package pdfgen
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFakeRendererOutputsDocumentText(t *testing.T) {
+	html := `<html><head><title>Contrat</title><style>body { color: red; }</style></head>
+<body><p>Docteur Marie Curie &amp; (associés)</p></body></html>`
+
+	r := NewFakeRenderer()
+	defer r.Shutdown()
+
+	pdf, err := r.Render(context.Background(), []byte(html))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Errorf("output does not look like a PDF")
+	}
+	if !bytes.Contains(pdf, []byte(`(Docteur Marie Curie & \(associ`+"\xe9"+`s\)) '`)) {
+		t.Errorf("output does not contain the document text:\n%s", pdf)
+	}
+	if bytes.Contains(pdf, []byte("color")) {
+		t.Errorf("output contains style element contents")
+	}
+}
+
+func TestFakeRendererSplitsPages(t *testing.T) {
+	lines := strings.Repeat("<p>line</p>", 2*fakePdfLinesPerPage+1)
+	pdf, err := textPdf(htmlToTextLines(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(pdf, []byte("/Count 3")) {
+		t.Errorf("expected 3 pages")
+	}
+}
+
+func TestFakeRendererStopsOnCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := NewFakeRenderer().Render(ctx, []byte("<p>contract</p>")); err == nil {
+		t.Errorf("expected an error for a cancelled context")
+	}
+}
@@ -0,0 +1,101 @@
+package pdfgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	errUnsupportedPdf = errors.New("unsupported PDF document structure")
+
+	startXrefRegexp    = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	trailerSizeRegexp  = regexp.MustCompile(`/Size\s+(\d+)`)
+	trailerRootRegexp  = regexp.MustCompile(`/Root\s+(\d+\s+\d+\s+R)`)
+	trailerInfoRegexp  = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	infoStringsPattern = `\s*(\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>)`
+)
+
+// pdfTextString encodes s as a PDF text string, in UTF-16 so that any character is kept.
+func pdfTextString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// withInfo appends an incremental update to the PDF document, setting the given entries
+// (e.g. "Subject" or "Keywords") of its document information dictionary.
+// The other entries of the existing dictionary, such as the producer, are kept.
+//
+// Only documents with a classic cross-reference table, as written by browsers and the fake renderer,
+// are supported.
+func withInfo(pdf []byte, entries map[string]string) ([]byte, error) {
+	m := startXrefRegexp.FindSubmatchIndex(pdf)
+	if m == nil {
+		return nil, errUnsupportedPdf
+	}
+	prevXref := string(pdf[m[2]:m[3]])
+	trailerStart := bytes.LastIndex(pdf[:m[0]], []byte("trailer"))
+	if trailerStart < 0 {
+		return nil, errUnsupportedPdf
+	}
+	trailer := pdf[trailerStart:m[0]]
+
+	sizeMatch := trailerSizeRegexp.FindSubmatch(trailer)
+	rootMatch := trailerRootRegexp.FindSubmatch(trailer)
+	if sizeMatch == nil || rootMatch == nil {
+		return nil, errUnsupportedPdf
+	}
+	size, err := strconv.Atoi(string(sizeMatch[1]))
+	if err != nil {
+		return nil, errUnsupportedPdf
+	}
+
+	var info string
+	if infoMatch := trailerInfoRegexp.FindSubmatch(trailer); infoMatch != nil {
+		info = existingInfo(pdf, string(infoMatch[1]), string(infoMatch[2]))
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		info = regexp.MustCompile(`\s*/`+regexp.QuoteMeta(key)+infoStringsPattern).ReplaceAllString(info, "")
+		info += fmt.Sprintf(" /%s %s", key, pdfTextString(entries[key]))
+	}
+
+	// The new information dictionary takes the next free object number.
+	var buf bytes.Buffer
+	buf.Write(pdf)
+	if !bytes.HasSuffix(pdf, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	infoOffset := buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n<<%s >>\nendobj\n", size, info)
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n%d 1\n%010d 00000 n \n", size, infoOffset)
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %s /Info %d 0 R /Prev %s >>\nstartxref\n%d\n%%%%EOF\n",
+		size+1, rootMatch[1], size, prevXref, xrefOffset)
+	return buf.Bytes(), nil
+}
+
+// existingInfo returns the entries of the last definition of the given information dictionary,
+// or an empty string if it can't be found.
+func existingInfo(pdf []byte, number, generation string) string {
+	objectRegexp := regexp.MustCompile(`(?s)(?:^|\s)` + number + `\s+` + generation + `\s+obj\s*<<(.*?)>>\s*endobj`)
+	matches := objectRegexp.FindAllSubmatch(pdf, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return " " + strings.TrimSpace(string(matches[len(matches)-1][1]))
+}
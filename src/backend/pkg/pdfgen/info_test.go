@@ -0,0 +1,57 @@
+package pdfgen
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// checkXref checks that the last cross-reference section of the document is where the trailer
+// says it is, and that the objects it lists are at their offsets.
+func checkXref(t *testing.T, pdf []byte) {
+	t.Helper()
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatalf("no startxref at the end of the document:\n%s", pdf)
+	}
+	xrefOffset, _ := strconv.Atoi(string(m[1]))
+	xref := regexp.MustCompile(`^xref\n(\d+) 1\n(\d{10}) 00000 n \n`).FindSubmatch(pdf[xrefOffset:])
+	if xref == nil {
+		t.Fatalf("no cross-reference section at offset %d", xrefOffset)
+	}
+	objectOffset, _ := strconv.Atoi(string(xref[2]))
+	if !bytes.HasPrefix(pdf[objectOffset:], append(xref[1], []byte(" 0 obj")...)) {
+		t.Errorf("object %s is not at offset %d", xref[1], objectOffset)
+	}
+}
+
+func TestWithInfo(t *testing.T) {
+	pdf, err := textPdf([]string{"Contrat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdf, err = withInfo(pdf, map[string]string{"Subject": "Contrat de remplacement", "Keywords": "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkXref(t, pdf)
+	if !bytes.Contains(pdf, []byte("/Size 7 /Root 1 0 R /Info 6 0 R /Prev ")) {
+		t.Errorf("unexpected trailer:\n%s", pdf)
+	}
+
+	// A second update keeps the other entries of the information dictionary.
+	pdf, err = withInfo(pdf, map[string]string{"Keywords": "é"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkXref(t, pdf)
+	if !bytes.Contains(pdf, []byte("7 0 obj\n<< /Subject "+pdfTextString("Contrat de remplacement")+" /Keywords <FEFF00E9> >>")) {
+		t.Errorf("unexpected information dictionary:\n%s", pdf)
+	}
+
+	if _, err := withInfo([]byte("%PDF-1.7\n"), map[string]string{"Keywords": "k"}); err != errUnsupportedPdf {
+		t.Errorf("got error %v for a truncated document, expected %s", err, errUnsupportedPdf)
+	}
+}
@@ -0,0 +1,248 @@
+package stats
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ContractID is the pseudonymous identifier of a contract, i.e. its censored identifier.
+//
+// Previous is the identifier censored with the secret that was in use before the current one.
+// It is nil when no key rotation is in progress.
+type ContractID struct {
+	Current  []byte
+	Previous []byte
+}
+
+type contractRecord struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int64     `json:"count"`
+	// Replaces is set when the record was moved over from an identifier
+	// censored with a previous secret.
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// contractStore keeps track of all the pseudonymous contract identifiers ever seen.
+//
+// It is stored as an append-only log of JSON records, where the line with the highest count for
+// an ID holds its current state. The log is compacted when opened, so that it has a line per
+// unique contract.
+//
+// Records are never pruned: once a key rotation is over, the records of contracts which were not
+// generated again during the rotation stay under identifiers censored with a key which is not
+// supported anymore. They can't be matched again, but still count as unique contracts.
+//
+// Lines are written by a goroutine of their own, so that callers don't wait for the disk.
+// They are queued by callers once they released their locks, so concurrent lines may be
+// written out of order.
+type contractStore struct {
+	filePath      string
+	records       map[string]*contractRecord
+	regenerations int64
+
+	// closeMutex makes sure no line is queued once the store is closed.
+	closeMutex sync.RWMutex
+	closed     bool
+	// lines are the records to append to the log.
+	lines chan []byte
+	// written receives the result of closing the log, once all lines are written.
+	written chan error
+}
+
+// contractStoreQueueLength is the number of records which may wait to be written to the log.
+const contractStoreQueueLength = 1024
+
+func openContractStore(filePath string) (*contractStore, error) {
+	cs := &contractStore{
+		filePath: filepath.Clean(filePath),
+		records:  make(map[string]*contractRecord),
+	}
+
+	numLines, err := cs.replay()
+	if err != nil {
+		return nil, err
+	}
+	if numLines > len(cs.records) {
+		if err := cs.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	file, err := os.OpenFile(cs.filePath, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	cs.lines = make(chan []byte, contractStoreQueueLength)
+	cs.written = make(chan error, 1)
+	go cs.writeLines(file)
+	return cs, nil
+}
+
+// writeLines appends the lines to the log until the store is closed.
+func (cs *contractStore) writeLines(file *os.File) {
+	w := bufio.NewWriter(file)
+	for line := range cs.lines {
+		if _, err := w.Write(line); err != nil {
+			log.Error().Err(err).Msg("could not record contract identifier")
+		}
+		// Lines coming in bursts are written at once.
+		if len(cs.lines) == 0 {
+			if err := w.Flush(); err != nil {
+				log.Error().Err(err).Msg("could not record contract identifier")
+			}
+		}
+	}
+
+	err := w.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	cs.written <- err
+}
+
+func (cs *contractStore) replay() (int, error) {
+	f, err := os.Open(cs.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var numLines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		b := scanner.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		numLines += 1
+
+		var rec contractRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return 0, err
+		}
+		if existing, found := cs.records[rec.ID]; found && existing.Count > rec.Count {
+			// The line of a concurrent contract was written before this one.
+			continue
+		}
+		if rec.Replaces != "" {
+			delete(cs.records, rec.Replaces)
+			rec.Replaces = ""
+		}
+		cs.records[rec.ID] = &rec
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, rec := range cs.records {
+		cs.regenerations += rec.Count - 1
+	}
+	return numLines, nil
+}
+
+// compact rewrites the log with a single line per record.
+func (cs *contractStore) compact() error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(cs.filePath), "contracts-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	w := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(w)
+	for _, rec := range cs.records {
+		if err := encoder.Encode(rec); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), cs.filePath)
+}
+
+// add records that the contract was generated at time t.
+// It returns true if the contract had never been seen before, and the line to write to the log
+// with write.
+func (cs *contractStore) add(contractID ContractID, t time.Time) (bool, []byte, error) {
+	t = t.UTC().Truncate(time.Second)
+	id := base64.URLEncoding.EncodeToString(contractID.Current)
+
+	rec, found := cs.records[id]
+	if !found && contractID.Previous != nil {
+		previousID := base64.URLEncoding.EncodeToString(contractID.Previous)
+		if previousRec, foundPrevious := cs.records[previousID]; foundPrevious {
+			// Move the record over to its identifier censored with the current secret.
+			delete(cs.records, previousID)
+			rec = previousRec
+			rec.ID = id
+			rec.Replaces = previousID
+			cs.records[id] = rec
+			found = true
+		}
+	}
+
+	if found {
+		rec.LastSeen = t
+		rec.Count += 1
+		cs.regenerations += 1
+	} else {
+		rec = &contractRecord{
+			ID:        id,
+			FirstSeen: t,
+			LastSeen:  t,
+			Count:     1,
+		}
+		cs.records[id] = rec
+	}
+
+	b, err := json.Marshal(rec)
+	rec.Replaces = ""
+	if err != nil {
+		return !found, nil, err
+	}
+	return !found, append(b, '\n'), nil
+}
+
+// write queues the line to be appended to the log, unless the store is closed.
+// It blocks only when the queue is full.
+func (cs *contractStore) write(line []byte) {
+	cs.closeMutex.RLock()
+	defer cs.closeMutex.RUnlock()
+	if cs.closed {
+		return
+	}
+	cs.lines <- line
+}
+
+func (cs *contractStore) unique() int64 {
+	return int64(len(cs.records))
+}
+
+// close waits for the pending lines to be written, and closes the log.
+func (cs *contractStore) close() error {
+	cs.closeMutex.Lock()
+	cs.closed = true
+	close(cs.lines)
+	cs.closeMutex.Unlock()
+	return <-cs.written
+}
@@ -0,0 +1,349 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	dayLayout = "2006-01-02"
+)
+
+// Upper bounds (inclusive) of the PDF generation latency histogram buckets.
+// An extra, unbounded, bucket collects everything above the last value.
+var PdfGenerationBucketBoundsMs = []int64{250, 500, 1000, 2000, 3000, 5000, 10000}
+
+type QueryOutcome int
+
+const (
+	QuerySucceeded QueryOutcome = iota
+	QueryInvalid
+	QueryUnavailable
+	QueryFailed
+)
+
+// Recorder records anonymous statistics about the service.
+//
+// None of its methods take personally identifiable data: only counts, durations
+// and pseudonymous contract identifiers are kept.
+type Recorder interface {
+	ContractGenerated(contractID ContractID, pdfGenDuration time.Duration)
+	ContractGenerationFailed()
+	DoctorSearchQueried(outcome QueryOutcome)
+	Snapshot() Snapshot
+	// Close persists the statistics one last time and releases the files.
+	// Anything recorded afterwards is ignored.
+	Close() error
+}
+
+type LatencyBucket struct {
+	// UpperBoundMs is nil for the last bucket, which has no upper bound.
+	UpperBoundMs *int64 `json:"le_ms"`
+	Count        int64  `json:"count"`
+}
+
+type Contracts struct {
+	Total    int64            `json:"total"`
+	Failures int64            `json:"failures"`
+	PerDay   map[string]int64 `json:"per_day"`
+	// Unique and Regenerations are computed from the contract store.
+	Unique        int64 `json:"unique"`
+	Regenerations int64 `json:"regenerations"`
+}
+
+type PdfGeneration struct {
+	Count     int64           `json:"count"`
+	SumMs     int64           `json:"sum_ms"`
+	LatencyMs []LatencyBucket `json:"latency_histogram"`
+}
+
+type DoctorSearch struct {
+	Queries     int64   `json:"queries"`
+	Invalid     int64   `json:"invalid"`
+	Unavailable int64   `json:"unavailable"`
+	Errors      int64   `json:"errors"`
+	ErrorRate   float64 `json:"error_rate"`
+}
+
+// Snapshot is a copy of all statistics at a point in time.
+// It is what gets persisted to disk and served publicly.
+type Snapshot struct {
+	Since         time.Time     `json:"since"`
+	Contracts     Contracts     `json:"contracts"`
+	PdfGeneration PdfGeneration `json:"pdf_generation"`
+	DoctorSearch  DoctorSearch  `json:"doctor_search"`
+}
+
+type recorder struct {
+	filePath string
+	location *time.Location
+
+	mutex     sync.Mutex
+	state     Snapshot
+	dirty     bool
+	closed    bool
+	contracts *contractStore
+
+	stop chan struct{}
+}
+
+// New returns a Recorder which persists its statistics to the file at filePath
+// every persistPeriod, and restores them from that same file if it already exists.
+//
+// Every pseudonymous contract identifier is recorded in the file at contractsFilePath,
+// so that unique contracts can be told apart from regenerated ones.
+//
+// Days are counted in the time-zone given by location.
+func New(filePath string, contractsFilePath string, location *time.Location, persistPeriod time.Duration) (Recorder, error) {
+	r := &recorder{
+		filePath: filepath.Clean(filePath),
+		location: location,
+		state:    emptySnapshot(time.Now()),
+		stop:     make(chan struct{}),
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	contracts, err := openContractStore(contractsFilePath)
+	if err != nil {
+		return nil, err
+	}
+	r.contracts = contracts
+
+	go func() {
+		ticker := time.NewTicker(persistPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.persist(); err != nil {
+					log.Error().Err(err).Msg("could not persist statistics")
+				}
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+func emptySnapshot(since time.Time) Snapshot {
+	buckets := make([]LatencyBucket, len(PdfGenerationBucketBoundsMs)+1)
+	for i := range PdfGenerationBucketBoundsMs {
+		buckets[i].UpperBoundMs = &PdfGenerationBucketBoundsMs[i]
+	}
+
+	return Snapshot{
+		Since: since.UTC(),
+		Contracts: Contracts{
+			PerDay: make(map[string]int64),
+		},
+		PdfGeneration: PdfGeneration{
+			LatencyMs: buckets,
+		},
+	}
+}
+
+func (r *recorder) load() error {
+	b, err := ioutil.ReadFile(r.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	if s.Contracts.PerDay == nil {
+		s.Contracts.PerDay = make(map[string]int64)
+	}
+	if !haveExpectedBounds(s.PdfGeneration.LatencyMs) {
+		// The bucket bounds changed since the file was written, previous values can't be reused.
+		log.Warn().Msg("statistics file has outdated latency histogram, resetting it")
+		s.PdfGeneration = emptySnapshot(s.Since).PdfGeneration
+	}
+
+	r.state = s
+	return nil
+}
+
+func haveExpectedBounds(buckets []LatencyBucket) bool {
+	if len(buckets) != len(PdfGenerationBucketBoundsMs)+1 {
+		return false
+	}
+	for i, bound := range PdfGenerationBucketBoundsMs {
+		if buckets[i].UpperBoundMs == nil || *buckets[i].UpperBoundMs != bound {
+			return false
+		}
+	}
+	return buckets[len(buckets)-1].UpperBoundMs == nil
+}
+
+// persist atomically writes the statistics to disk, if anything changed since the last write.
+func (r *recorder) persist() error {
+	r.mutex.Lock()
+	if !r.dirty {
+		r.mutex.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(r.state)
+	r.dirty = false
+	r.mutex.Unlock()
+
+	if err == nil {
+		err = r.write(b)
+	}
+	if err != nil {
+		// Try again next time.
+		r.mutex.Lock()
+		r.dirty = true
+		r.mutex.Unlock()
+	}
+	return err
+}
+
+func (r *recorder) write(b []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(r.filePath), "stats-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(b); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), r.filePath)
+}
+
+func (r *recorder) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mutex.Unlock()
+
+	close(r.stop)
+	err := r.persist()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if closeErr := r.contracts.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (r *recorder) ContractGenerated(contractID ContractID, pdfGenDuration time.Duration) {
+	now := time.Now()
+	day := now.In(r.location).Format(dayLayout)
+	ms := pdfGenDuration.Milliseconds()
+
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+
+	_, line, err := r.contracts.add(contractID, now)
+	if err != nil {
+		log.Error().Err(err).Msg("could not record contract identifier")
+	}
+
+	r.state.Contracts.Total += 1
+	r.state.Contracts.PerDay[day] += 1
+
+	r.state.PdfGeneration.Count += 1
+	r.state.PdfGeneration.SumMs += ms
+	buckets := r.state.PdfGeneration.LatencyMs
+	bucketIndex := len(buckets) - 1
+	for i, bound := range PdfGenerationBucketBoundsMs {
+		if ms <= bound {
+			bucketIndex = i
+			break
+		}
+	}
+	buckets[bucketIndex].Count += 1
+
+	r.dirty = true
+	r.mutex.Unlock()
+
+	// The log may be slow to write to, so it is done without holding the lock.
+	if line != nil {
+		r.contracts.write(line)
+	}
+}
+
+func (r *recorder) ContractGenerationFailed() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+
+	r.state.Contracts.Failures += 1
+	r.dirty = true
+}
+
+func (r *recorder) DoctorSearchQueried(outcome QueryOutcome) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+
+	ds := &r.state.DoctorSearch
+	ds.Queries += 1
+	switch outcome {
+	case QueryInvalid:
+		ds.Invalid += 1
+	case QueryUnavailable:
+		ds.Unavailable += 1
+	case QueryFailed:
+		ds.Errors += 1
+	}
+	r.dirty = true
+}
+
+func (r *recorder) Snapshot() Snapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := r.state
+	s.Contracts.PerDay = make(map[string]int64, len(r.state.Contracts.PerDay))
+	for day, count := range r.state.Contracts.PerDay {
+		s.Contracts.PerDay[day] = count
+	}
+	s.PdfGeneration.LatencyMs = make([]LatencyBucket, len(r.state.PdfGeneration.LatencyMs))
+	copy(s.PdfGeneration.LatencyMs, r.state.PdfGeneration.LatencyMs)
+
+	s.Contracts.Unique = r.contracts.unique()
+	s.Contracts.Regenerations = r.contracts.regenerations
+
+	// Invalid queries are the user's doing, so they don't count as errors.
+	if s.DoctorSearch.Queries > 0 {
+		s.DoctorSearch.ErrorRate = float64(s.DoctorSearch.Errors+s.DoctorSearch.Unavailable) / float64(s.DoctorSearch.Queries)
+	}
+	return s
+}
@@ -0,0 +1,240 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testFiles struct {
+	stats     string
+	contracts string
+}
+
+func tmpStatsFiles(t *testing.T) (testFiles, func()) {
+	dir, err := ioutil.TempDir("", "stats-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := testFiles{
+		stats:     filepath.Join(dir, "stats.json"),
+		contracts: filepath.Join(dir, "contracts.log"),
+	}
+	return files, func() { os.RemoveAll(dir) }
+}
+
+func newTestRecorder(t *testing.T, files testFiles) Recorder {
+	r, err := New(files.stats, files.contracts, time.UTC, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func contractID(s string) ContractID {
+	return ContractID{Current: []byte(s)}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	r := newTestRecorder(t, files)
+
+	r.ContractGenerated(contractID("a"), 100*time.Millisecond)
+	r.ContractGenerated(contractID("b"), 250*time.Millisecond)
+	r.ContractGenerated(contractID("c"), 1500*time.Millisecond)
+	r.ContractGenerated(contractID("d"), time.Minute)
+
+	s := r.Snapshot()
+	if s.Contracts.Total != 4 {
+		t.Errorf("total contracts = %d, expected 4", s.Contracts.Total)
+	}
+	buckets := s.PdfGeneration.LatencyMs
+	expected := map[int]int64{0: 2, 3: 1, len(buckets) - 1: 1}
+	for i, bucket := range buckets {
+		if bucket.Count != expected[i] {
+			t.Errorf("bucket %d has count %d, expected %d", i, bucket.Count, expected[i])
+		}
+	}
+}
+
+func TestDoctorSearchErrorRate(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	r := newTestRecorder(t, files)
+
+	r.DoctorSearchQueried(QuerySucceeded)
+	r.DoctorSearchQueried(QuerySucceeded)
+	r.DoctorSearchQueried(QueryInvalid)
+	r.DoctorSearchQueried(QueryFailed)
+
+	s := r.Snapshot()
+	if s.DoctorSearch.Queries != 4 || s.DoctorSearch.Invalid != 1 || s.DoctorSearch.Errors != 1 {
+		t.Errorf("unexpected doctor search counts %+v", s.DoctorSearch)
+	}
+	if s.DoctorSearch.ErrorRate != 0.25 {
+		t.Errorf("error rate = %f, expected 0.25", s.DoctorSearch.ErrorRate)
+	}
+}
+
+func TestStatisticsSurviveRestart(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	first := newTestRecorder(t, files)
+	first.ContractGenerated(contractID("a"), time.Second)
+	first.ContractGenerationFailed()
+	first.DoctorSearchQueried(QueryUnavailable)
+	if err := first.(*recorder).persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestRecorder(t, files)
+	s := second.Snapshot()
+	today := time.Now().UTC().Format(dayLayout)
+	if s.Contracts.Total != 1 || s.Contracts.Failures != 1 || s.Contracts.PerDay[today] != 1 {
+		t.Errorf("unexpected contract counts after restart %+v", s.Contracts)
+	}
+	if s.DoctorSearch.Unavailable != 1 {
+		t.Errorf("unexpected doctor search counts after restart %+v", s.DoctorSearch)
+	}
+	if !s.Since.Equal(first.Snapshot().Since) {
+		t.Errorf("start of statistics changed after restart")
+	}
+}
+
+func TestClosePersistsStatistics(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	first := newTestRecorder(t, files)
+	first.ContractGenerated(contractID("a"), time.Second)
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestRecorder(t, files)
+	if s := second.Snapshot(); s.Contracts.Total != 1 || s.Contracts.Unique != 1 {
+		t.Errorf("unexpected contract counts after close %+v", s.Contracts)
+	}
+}
+
+func TestRecordingAfterClose(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	r := newTestRecorder(t, files)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Requests in progress may still record statistics while stopping.
+	r.ContractGenerated(contractID("a"), time.Second)
+	r.ContractGenerationFailed()
+	r.DoctorSearchQueried(QuerySucceeded)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := r.Snapshot(); s.Contracts.Total != 0 || s.Contracts.Failures != 0 || s.DoctorSearch.Queries != 0 {
+		t.Errorf("statistics were recorded after close %+v", s)
+	}
+}
+
+func TestFailedPersistIsRetried(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	r := newTestRecorder(t, files)
+	r.ContractGenerationFailed()
+
+	rec := r.(*recorder)
+	rec.filePath = filepath.Join(filepath.Dir(files.stats), "missing", "stats.json")
+	if err := rec.persist(); err == nil {
+		t.Fatal("persisting to a missing directory did not fail")
+	}
+	rec.filePath = files.stats
+	if err := rec.persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := newTestRecorder(t, files).Snapshot(); s.Contracts.Failures != 1 {
+		t.Errorf("statistics were not persisted after a failure %+v", s.Contracts)
+	}
+}
+
+func TestUniqueContractsAndRegenerations(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	first := newTestRecorder(t, files)
+	first.ContractGenerated(contractID("a"), time.Second)
+	first.ContractGenerated(contractID("a"), time.Second)
+	first.ContractGenerated(contractID("b"), time.Second)
+
+	s := first.Snapshot()
+	if s.Contracts.Unique != 2 || s.Contracts.Regenerations != 1 {
+		t.Errorf("unique = %d, regenerations = %d, expected 2 and 1", s.Contracts.Unique, s.Contracts.Regenerations)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	second := newTestRecorder(t, files)
+	second.ContractGenerated(contractID("b"), time.Second)
+	s = second.Snapshot()
+	if s.Contracts.Unique != 2 || s.Contracts.Regenerations != 2 {
+		t.Errorf("after restart, unique = %d, regenerations = %d, expected 2 and 2", s.Contracts.Unique, s.Contracts.Regenerations)
+	}
+}
+
+func TestContractsLogOutOfOrder(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	// Lines of concurrent regenerations of a contract may be written in any order.
+	log := `{"id":"YQ==","first_seen":"2020-06-01T00:00:00Z","last_seen":"2020-06-02T00:00:00Z","count":3}
+{"id":"YQ==","first_seen":"2020-06-01T00:00:00Z","last_seen":"2020-06-02T00:00:00Z","count":2}
+`
+	if err := ioutil.WriteFile(files.contracts, []byte(log), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestRecorder(t, files).Snapshot()
+	if s.Contracts.Unique != 1 || s.Contracts.Regenerations != 2 {
+		t.Errorf("unique = %d, regenerations = %d, expected 1 and 2", s.Contracts.Unique, s.Contracts.Regenerations)
+	}
+}
+
+func TestContractsFollowKeyRotation(t *testing.T) {
+	files, cleanup := tmpStatsFiles(t)
+	defer cleanup()
+
+	beforeRotation := newTestRecorder(t, files)
+	beforeRotation.ContractGenerated(contractID("old-a"), time.Second)
+	if err := beforeRotation.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	afterRotation := newTestRecorder(t, files)
+	afterRotation.ContractGenerated(ContractID{Current: []byte("new-a"), Previous: []byte("old-a")}, time.Second)
+	afterRotation.ContractGenerated(contractID("new-a"), time.Second)
+
+	s := afterRotation.Snapshot()
+	if s.Contracts.Unique != 1 || s.Contracts.Regenerations != 2 {
+		t.Errorf("unique = %d, regenerations = %d, expected 1 and 2", s.Contracts.Unique, s.Contracts.Regenerations)
+	}
+
+	// The moved record should not come back when replaying the log.
+	if err := afterRotation.Close(); err != nil {
+		t.Fatal(err)
+	}
+	afterRestart := newTestRecorder(t, files)
+	s = afterRestart.Snapshot()
+	if s.Contracts.Unique != 1 || s.Contracts.Regenerations != 2 {
+		t.Errorf("after restart, unique = %d, regenerations = %d, expected 1 and 2", s.Contracts.Unique, s.Contracts.Regenerations)
+	}
+}
@@ -12,39 +12,68 @@ var (
 	TooMany         = validationError("too many values")
 	ParseError      = validationError("could not parse input")
 	LengthError     = validationError("unexpected input length")
+	// InvalidNumber is for identification numbers with a wrong check digit, or which are not only
+	// made of digits.
+	InvalidNumber = validationError("invalid number")
+
+	ReversedPeriod     = validationError("period ends before it starts")
+	OverlappingPeriods = validationError("overlapping periods")
+	OutOfRange         = validationError("date out of range")
+
+	// UnknownRPPS and NameMismatch are warnings, about doctors who could not be found in the
+	// directory of doctors.
+	UnknownRPPS  = validationError("unknown RPPS number")
+	NameMismatch = validationError("name does not match the RPPS number")
 )
 
+var knownErrors = []error{
+	MissingRequired, TooMany, ParseError, LengthError, InvalidNumber,
+	ReversedPeriod, OverlappingPeriods, OutOfRange,
+	UnknownRPPS, NameMismatch,
+}
+
+// Message returns the message of the kind of err, or "" if err is of no known kind.
+func Message(err error) string {
+	for _, known := range knownErrors {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return ""
+}
+
 func validationError(s string) error {
 	return errors.New(s)
 }
 
+// ValidationIssues are errors which prevent processing user input, and warnings which don't.
 type ValidationIssues struct {
-	issues map[string]error
+	issues   map[string]error
+	warnings map[string]error
+	// indexes are those of the values of repeated fields (e.g. periods) which have issues.
+	indexes map[string][]int
 }
 
 func EmptyIssues() ValidationIssues {
 	return ValidationIssues{
-		issues: make(map[string]error, 0),
+		issues:   make(map[string]error, 0),
+		warnings: make(map[string]error, 0),
+		indexes:  make(map[string][]int, 0),
 	}
 }
 
+// MarshalJSON maps the keys of issues to their messages. Warnings, if any, are mapped the same
+// way under the "warnings" key, and the indexes of the values with issues under "indexes".
 func (v ValidationIssues) MarshalJSON() ([]byte, error) {
-	m := make(map[string]string, len(v.issues))
-
+	m := make(map[string]interface{}, len(v.issues)+2)
 	for key, err := range v.issues {
-		var finalValue string
-		if errors.Is(err, MissingRequired) {
-			finalValue = MissingRequired.Error()
-		} else if errors.Is(err, TooMany) {
-			finalValue = TooMany.Error()
-		} else if errors.Is(err, ParseError) {
-			finalValue = ParseError.Error()
-		} else if errors.Is(err, LengthError) {
-			finalValue = LengthError.Error()
-		} else {
-			finalValue = ""
-		}
-		m[key] = finalValue
+		m[key] = Message(err)
+	}
+	if len(v.warnings) > 0 {
+		m["warnings"] = v.WarningMessages()
+	}
+	if len(v.indexes) > 0 {
+		m["indexes"] = v.indexes
 	}
 	return json.Marshal(m)
 }
@@ -53,6 +82,41 @@ func (v ValidationIssues) GetAll() map[string]error {
 	return v.issues
 }
 
+// SetAt records an issue with the value at index of a repeated field. Only the first issue with
+// k is kept, but the indexes of all the values with issues are.
+func (v ValidationIssues) SetAt(k string, index int, e error) {
+	v.Set(k, e)
+	for _, i := range v.indexes[k] {
+		if i == index {
+			return
+		}
+	}
+	v.indexes[k] = append(v.indexes[k], index)
+}
+
+// Indexes returns the indexes of the values of the repeated field k which have issues.
+func (v ValidationIssues) Indexes(k string) []int {
+	return v.indexes[k]
+}
+
+// SetWarning records a warning about k, unless there already is one.
+func (v ValidationIssues) SetWarning(k string, e error) {
+	if _, ok := v.warnings[k]; ok {
+		return
+	}
+	v.warnings[k] = e
+}
+
+// WarningMessages maps the keys of warnings to their messages.
+func (v ValidationIssues) WarningMessages() map[string]string {
+	m := make(map[string]string, len(v.warnings))
+	for key, err := range v.warnings {
+		m[key] = Message(err)
+	}
+	return m
+}
+
+// Error returns an error if there are issues. Warnings alone are not an error.
 func (v ValidationIssues) Error() error {
 	if len(v.issues) == 0 {
 		return nil
@@ -70,11 +134,34 @@ func (v ValidationIssues) Set(k string, e error) {
 	v.issues[k] = e
 }
 
+// Merge adds the issues and warnings of other. Like with Set, the issues and warnings which
+// were already recorded are kept.
 func (v ValidationIssues) Merge(other ValidationIssues) {
-	m := v.issues
 	for key, value := range other.issues {
-		m[key] = value
+		v.Set(key, value)
+	}
+	for key, value := range other.warnings {
+		v.SetWarning(key, value)
 	}
+	for key, indexes := range other.indexes {
+		for _, index := range indexes {
+			v.SetAt(key, index, other.issues[key])
+		}
+	}
+}
+
+// RequestError is about a request which could not be read at all, e.g. because of malformed JSON.
+// Its message is meant to be sent back to the client.
+type RequestError struct {
+	Err error
+}
+
+func (e RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e RequestError) Unwrap() error {
+	return e.Err
 }
 
 type UserError struct {
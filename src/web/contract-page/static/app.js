@@ -2,12 +2,14 @@ import { makeElement } from './utils';
 import { GenericUserError, FormValidationError } from './errors';
 import { createSignatureInput, getSignatureImage } from './signature';
 import { saveFilledFormData, createPersistedDataQuickFillUI } from './form-fill';
-import { Validators, FormErrorHandler, FormValidationIssues } from './live-form-feedback';
+import { FormErrorHandler, FormValidationIssues } from './live-form-feedback';
 import { createSinglePeriodInput, parseFormattedFRDate } from './periods-input';
 import { polyfill } from './polyfills';
 import { InputAutocompleter } from './autocomplete';
 import { Handlers as EmailFormHandlers } from './mailinglist';
 
+const FormSchemaURLPath = 'b/form-schema';
+
 const ElementQueries = {
     SubstituteSignatureParent: 'fieldset#substitute-fieldset',
     RegularSignatureParent: 'fieldset#regular-fieldset',
@@ -302,9 +304,15 @@ const setupDynamicFormChanges = (form) => {
 
 const setupLiveFormFeedback = (form) => {
     const NameMessage = 'Le "Nom complet" doit être renseigné.';
-    const RPPSMessage = 'Le RRPS doit faire 11 chiffres.';
+    const numberMessage = (lengthMessage) => (error) => {
+        if (error === FormValidationIssues.InvalidNumber) {
+            return 'Numéro invalide, il y a peut-être une faute de frappe.';
+        }
+        return lengthMessage;
+    };
+    const RPPSMessage = numberMessage('Le RRPS doit faire 11 chiffres.');
     const AddressMessage = `L'addresse doit être renseignée.`;
-    const SIRETMessage = 'Le SIRET doit faire 14 chiffres.';
+    const SIRETMessage = numberMessage('Le SIRET doit faire 14 chiffres.');
     const PeriodsMessageMap = (error) => {
         if (error === FormValidationIssues.MissingRequired) {
             return 'Il faut préciser au moins une pèriode de remplacement.';
@@ -312,6 +320,15 @@ const setupLiveFormFeedback = (form) => {
         if (error === FormValidationIssues.TooMany) {
             return 'Trop de pèriodes de remplacement, désolé.'
         }
+        if (error === FormValidationIssues.ReversedPeriod) {
+            return 'Une pèriode de remplacement se termine avant de commencer.';
+        }
+        if (error === FormValidationIssues.OverlappingPeriods) {
+            return 'Des pèriodes de remplacement se chevauchent.';
+        }
+        if (error === FormValidationIssues.OutOfRange) {
+            return "Une pèriode de remplacement est trop éloignée de la date d'aujourd'hui.";
+        }
         return "Au moins une pèriode de remplacement n'est pas valide. Il manque peut–être une date de début ou de fin ?";
     }
 
@@ -319,21 +336,18 @@ const setupLiveFormFeedback = (form) => {
         {
             name: 'regular-name',
             querySelector: '#regular-name',
-            check: Validators.Required,
             overridingMesssage: NameMessage,
             errorLink: 'le nom du médecin remplacé',
         },
         {
             name: 'regular-rpps',
             querySelector: '#regular-rpps',
-            check: Validators.Length(11),
             overridingMesssage: RPPSMessage,
             errorLink: 'le RPPS du médecin remplacé',
         },
         {
             name: 'regular-address',
             querySelector: '#regular-address',
-            check: Validators.Required,
             overridingMesssage: AddressMessage,
             errorLink: `l'addresse du médecin remplacé`,
         },
@@ -345,34 +359,29 @@ const setupLiveFormFeedback = (form) => {
         {
             name: 'substitute-name',
             querySelector: '#substitute-name',
-            check: Validators.Required,
             overridingMesssage: NameMessage,
             errorLink: 'le nom du remplaçant',
         },
         {
             name: 'substitute-rpps',
             querySelector: '#substitute-rpps',
-            check: Validators.Length(11),
             overridingMesssage: RPPSMessage,
             errorLink: 'le RPPS du remplaçant',
         },
         {
             name: 'substitute-siret',
             querySelector: '#substitute-siret',
-            check: Validators.Length(14),
             overridingMesssage: SIRETMessage,
             errorLink: 'le SIRET du remplaçant',
         },
         {
             name: 'substitute-substitutingID',
             querySelector: '#substitute-substitutingID',
-            check: Validators.Required,
             errorLink: `le numéro d'inscription au tableau / la licence de remplaçement`,
         },
         {
             name: 'substitute-address',
             querySelector: '#substitute-address',
-            check: Validators.Required,
             overridingMesssage: AddressMessage,
             errorLink: `l'addresse du remplaçant`,
         },
@@ -391,7 +400,6 @@ const setupLiveFormFeedback = (form) => {
         {
             name: 'financials-retrocession',
             querySelector: '#financials-retrocession',
-            check: Validators.Number(0, 100),
             overridingMesssage: "Entre 0 et 100 s'il vous plaît !",
             errorLink: 'la rétrocession',
         },
@@ -402,7 +410,20 @@ const setupLiveFormFeedback = (form) => {
         },
     ];
 
-    return new FormErrorHandler(form, FormFeedbacks);
+    const formErrorHandler = new FormErrorHandler(form, FormFeedbacks);
+
+    // Live feedback is only a convenience, the server validates the form anyway.
+    fetch(FormSchemaURLPath, { cache: 'no-cache', credentials: 'omit' })
+        .then(resp => {
+            if (!resp.ok) {
+                throw new Error(`could not get form schema: ${resp.status}`);
+            }
+            return resp.json();
+        })
+        .then(schema => { formErrorHandler.useSchema(schema); })
+        .catch(() => {});
+
+    return formErrorHandler;
 };
 
 const setupAutocomplete = (form) => {
@@ -2,7 +2,7 @@ import { makeElement } from "./utils";
 import { fillFormField } from "./form-fill";
 
 const AutoCompleteURLPath = 'b/search-doctor';
-const MinQueryLength = 3;
+const MinQueryLength = 2;
 
 const MsDurationToHideOldResultsIfWaitIsTooLong = 1000;
 
@@ -61,14 +61,22 @@ const createAutoCompleteList = (state, parentNode, input, formPart, results) =>
 
     const list = getListEl(el => {
         const ul = makeElement('ul', el => {
-            results.forEach((resultItem) => {
-                const itemEl = makeElement('li');
-                itemEl.setAttribute('tabindex', '0');
-                itemEl.dataset.isAutoCompleteItem = 'true';
-                itemEl.textContent = resultItem.name;
-
-                itemEl.addEventListener('click', onUserSelectAutoCompleteItem(state, resultItem, input, formPart));
-                el.appendChild(itemEl);
+            results.forEach((result) => {
+                // Doctors practicing at several sites get an item per site, so that the user
+                // can pick the right address.
+                const { sites, ...resultItem } = result;
+                const items = (sites && sites.length > 1)
+                    ? sites.map(site => ({ ...resultItem, address: site.address }))
+                    : [resultItem];
+                items.forEach((item) => {
+                    const itemEl = makeElement('li');
+                    itemEl.setAttribute('tabindex', '0');
+                    itemEl.dataset.isAutoCompleteItem = 'true';
+                    itemEl.textContent = items.length > 1 ? `${item.name} (${item.address})` : item.name;
+
+                    itemEl.addEventListener('click', onUserSelectAutoCompleteItem(state, item, input, formPart));
+                    el.appendChild(itemEl);
+                });
             });
         });
 
@@ -201,6 +209,8 @@ export const InputAutocompleter = function (input) {
         const url = new URL(AutoCompleteURLPath, document.URL);
         const params = new URLSearchParams();
         params.set('query', value);
+        // Match the word being typed as the start of a name.
+        params.set('prefix', 'true');
         url.search = params.toString();
 
         const abortController = new AbortController();
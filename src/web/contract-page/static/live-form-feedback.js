@@ -6,32 +6,131 @@ export const FormValidationIssues = {
 	TooMany: 'too many values',
 	ParseError: 'could not parse input',
 	LengthError: 'unexpected input length',
+	InvalidNumber: 'invalid number',
+	ReversedPeriod: 'period ends before it starts',
+	OverlappingPeriods: 'overlapping periods',
+	OutOfRange: 'date out of range',
 };
 
+// luhnSum is the sum of the digits of number, every second digit from the right being doubled.
+const luhnSum = (number) => {
+    let sum = 0;
+    for (let i = 0; i < number.length; i++) {
+        let d = Number.parseInt(number[number.length - 1 - i], 10);
+        if (i % 2 === 1) {
+            d *= 2;
+            if (d > 9) {
+                d -= 9;
+            }
+        }
+        sum += d;
+    }
+    return sum;
+};
+
+const LaPosteSIREN = '356000000';
+
 export const Validators = {
-    Required: (field) => {
-        if (field.trim().length > 0) {
+    // Integer mirrors the server, which only accepts whole numbers.
+    Integer: (min, max) => (field) => {
+        if (!/^-?\d+$/.test(field)) {
+            return FormValidationIssues.ParseError;
+        }
+        const num = Number.parseInt(field, 10);
+        if (num < min || num > max) {
+            return FormValidationIssues.ParseError;
+        }
+        return true;
+    },
+    // Lengths are counted in code points like the server does, rather than in UTF-16 code units.
+    MinLength: (length) => (field) => {
+        if ([...field].length >= length) {
             return true;
         }
-        return FormValidationIssues.MissingRequired;
+        return FormValidationIssues.LengthError;
     },
-    Length: (length) => (field) => {
-        if (field.length === length) {
+    MaxLength: (length) => (field) => {
+        if ([...field].length <= length) {
             return true;
         }
         return FormValidationIssues.LengthError;
     },
-    Number: (min, max) => (field) => {
-        const num = Number.parseFloat(field);
-        const isNumber = Number.isNaN(num) === false;
-        const isValid = isNumber && (num >= min) && (num <= max);
-        if (isValid) {
+    Digits: (field) => {
+        if (/^[0-9]*$/.test(field)) {
+            return true;
+        }
+        return FormValidationIssues.InvalidNumber;
+    },
+    RPPSCheckDigit: (field) => {
+        if (luhnSum(field) % 10 === 0) {
+            return true;
+        }
+        return FormValidationIssues.InvalidNumber;
+    },
+    // La Poste SIRET numbers only need their digits to add up to a multiple of 5.
+    SIRETCheckDigit: (field) => {
+        const siren = field.slice(0, 9);
+        if (luhnSum(siren) % 10 !== 0) {
+            return FormValidationIssues.InvalidNumber;
+        }
+        if (siren === LaPosteSIREN) {
+            const sum = [...field].reduce((acc, c) => acc + Number.parseInt(c, 10), 0);
+            return sum % 5 === 0 ? true : FormValidationIssues.InvalidNumber;
+        }
+        if (luhnSum(field) % 10 === 0) {
+            return true;
+        }
+        return FormValidationIssues.InvalidNumber;
+    },
+    OneOf: (values) => (field) => {
+        if (values.includes(field)) {
             return true;
         }
         return FormValidationIssues.ParseError;
     },
 };
 
+// Builds a check from a field of the server's form schema (served at 'b/form-schema').
+// Returns null for fields which can't be checked on a single input.
+const checkFromSchema = (field) => {
+    if (field.type === 'date' || field.type === 'signature') {
+        return null;
+    }
+
+    const validators = [];
+    for (const v of field.validators || []) {
+        if (v.kind === 'minLength') {
+            validators.push(Validators.MinLength(v.length));
+        } else if (v.kind === 'maxLength') {
+            validators.push(Validators.MaxLength(v.length));
+        } else if (v.kind === 'oneOf') {
+            validators.push(Validators.OneOf(v.values));
+        } else if (v.kind === 'integer') {
+            validators.push(Validators.Integer(v.min, v.max));
+        } else if (v.kind === 'digits') {
+            validators.push(Validators.Digits);
+        } else if (v.kind === 'rppsCheckDigit') {
+            validators.push(Validators.RPPSCheckDigit);
+        } else if (v.kind === 'siretCheckDigit') {
+            validators.push(Validators.SIRETCheckDigit);
+        }
+    }
+
+    return (value) => {
+        const trimmed = value.trim();
+        if (trimmed.length === 0) {
+            return field.optional ? true : FormValidationIssues.MissingRequired;
+        }
+        for (const validator of validators) {
+            const validityCheck = validator(trimmed);
+            if (validityCheck !== true) {
+                return validityCheck;
+            }
+        }
+        return true;
+    };
+};
+
 
 const FormFeedbackParentQuerySelector = '.single-form-input-group';
 
@@ -196,6 +295,9 @@ export function FormErrorHandler(form, formFeedbackDescriptions) {
             if (error === FormValidationIssues.LengthError) {
                 return "Ce champ a une valeur inattendue.";
             }
+            if (error === FormValidationIssues.InvalidNumber) {
+                return "Numéro invalide, il y a peut-être une faute de frappe.";
+            }
             if (error === FormValidationIssues.TooMany) {
                 return "Le nombre de valeurs de ce champ a dépassé une limite.";
             }
@@ -265,6 +367,27 @@ export function FormErrorHandler(form, formFeedbackDescriptions) {
 
     formFeedbackDescriptions.forEach(el => { setupFieldFeedback(eh, el) });
 
+    // Checks fields like the server does, given its form schema.
+    this.useSchema = (schema) => {
+        for (const field of schema.fields) {
+            const feedBackDescription = getCorrespondingFeedbackDescription(eh, field.name);
+            // Radio buttons are always valid once one is picked.
+            if (!feedBackDescription || field.type === 'choice') {
+                continue;
+            }
+            const check = checkFromSchema(field);
+            if (!check) {
+                continue;
+            }
+
+            const hadCheck = Boolean(feedBackDescription.check);
+            feedBackDescription.check = check;
+            if (!hadCheck) {
+                setupFieldFeedback(eh, feedBackDescription);
+            }
+        }
+    };
+
     this.handle = (err) => { eh(err); };
     this.clear = () => { clearFormErrorRecap(eh); };
 };